@@ -0,0 +1,388 @@
+package desync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ACLNoMask is used as MaskPermissions in FormatACLDefault when the default ACL
+// of a directory doesn't have a mask entry.
+const ACLNoMask = math.MaxUint64
+
+// ACLEntry grants permissions to a named user or group in a POSIX ACL.
+type ACLEntry struct {
+	ID          int
+	Name        string
+	Permissions uint64
+}
+
+// ACL holds the POSIX ACLs of a directory or file in a catar archive. The
+// permissions of the owner and others are part of the mode of the node, and so
+// is the mask if there is one. In that case, GroupObj holds the permissions of
+// the owning group. Only directories have default ACLs.
+type ACL struct {
+	User     []ACLEntry
+	Group    []ACLEntry
+	GroupObj *FormatACLGroupObj
+
+	Default      *FormatACLDefault
+	DefaultUser  []ACLEntry
+	DefaultGroup []ACLEntry
+}
+
+// Returns the format elements for the ACL, in the order casync expects them
+// after the xattrs of an entry.
+func (a *ACL) elements() []interface{} {
+	var e []interface{}
+	for _, u := range a.User {
+		e = append(e, FormatACLUser{
+			FormatHeader: FormatHeader{Size: uint64(32 + len(u.Name) + 1), Type: CaFormatACLUser},
+			UID:          uint64(u.ID),
+			Permissions:  u.Permissions,
+			Name:         u.Name,
+		})
+	}
+	for _, g := range a.Group {
+		e = append(e, FormatACLGroup{
+			FormatHeader: FormatHeader{Size: uint64(32 + len(g.Name) + 1), Type: CaFormatACLGroup},
+			GID:          uint64(g.ID),
+			Permissions:  g.Permissions,
+			Name:         g.Name,
+		})
+	}
+	if a.GroupObj != nil {
+		e = append(e, FormatACLGroupObj{
+			FormatHeader: FormatHeader{Size: 24, Type: CaFormatACLGroupObj},
+			Permissions:  a.GroupObj.Permissions,
+		})
+	}
+	if a.Default != nil {
+		e = append(e, FormatACLDefault{
+			FormatHeader:        FormatHeader{Size: 48, Type: CaFormatACLDefault},
+			UserObjPermissions:  a.Default.UserObjPermissions,
+			GroupObjPermissions: a.Default.GroupObjPermissions,
+			OtherPermissions:    a.Default.OtherPermissions,
+			MaskPermissions:     a.Default.MaskPermissions,
+		})
+	}
+	for _, u := range a.DefaultUser {
+		e = append(e, FormatACLDefaultUser{
+			FormatHeader: FormatHeader{Size: uint64(32 + len(u.Name) + 1), Type: CaFormatACLDefaultUser},
+			UID:          uint64(u.ID),
+			Permissions:  u.Permissions,
+			Name:         u.Name,
+		})
+	}
+	for _, g := range a.DefaultGroup {
+		e = append(e, FormatACLDefaultGroup{
+			FormatHeader: FormatHeader{Size: uint64(32 + len(g.Name) + 1), Type: CaFormatACLDefaultGroup},
+			GID:          uint64(g.ID),
+			Permissions:  g.Permissions,
+			Name:         g.Name,
+		})
+	}
+	return e
+}
+
+// Returns true if the ACL holds anything that's not already in the mode.
+func (a *ACL) isEmpty() bool {
+	return len(a.User) == 0 && len(a.Group) == 0 && a.GroupObj == nil && a.Default == nil
+}
+
+// Extended attributes Linux uses to store POSIX ACLs
+const (
+	aclXattrAccess  = "system.posix_acl_access"
+	aclXattrDefault = "system.posix_acl_default"
+)
+
+// Layout of the ACL xattrs, see include/uapi/linux/posix_acl_xattr.h
+const (
+	aclXattrVersion = 2
+
+	aclTagUserObj  = 0x01
+	aclTagUser     = 0x02
+	aclTagGroupObj = 0x04
+	aclTagGroup    = 0x08
+	aclTagMask     = 0x10
+	aclTagOther    = 0x20
+
+	aclUndefinedID = 0xffffffff
+)
+
+type aclXattrEntry struct {
+	Tag  uint16
+	Perm uint16
+	ID   uint32
+}
+
+// Returns true for xattrs that hold ACLs. Those are encoded as ACL elements
+// in archives, not as xattrs.
+func isACLXattr(name string) bool {
+	return name == aclXattrAccess || name == aclXattrDefault
+}
+
+// Decodes the value of an ACL xattr.
+func parseACLXattr(b []byte) ([]aclXattrEntry, error) {
+	if len(b) < 4 || (len(b)-4)%8 != 0 || binary.LittleEndian.Uint32(b) != aclXattrVersion {
+		return nil, errors.New("invalid ACL")
+	}
+	entries := make([]aclXattrEntry, (len(b)-4)/8)
+	if err := binary.Read(bytes.NewReader(b[4:]), binary.LittleEndian, entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Builds an ACL from the entries of the access and default ACL xattrs. Returns
+// nil if there's nothing beyond what's in the mode. Names of users and groups
+// are looked up locally.
+func aclFromXattrs(access, def []aclXattrEntry) *ACL {
+	acl := new(ACL)
+	var hasMask bool
+	var groupObj uint64
+	for _, e := range access {
+		switch e.Tag {
+		case aclTagUser:
+			acl.User = append(acl.User, ACLEntry{ID: int(e.ID), Name: userName(int(e.ID)), Permissions: uint64(e.Perm)})
+		case aclTagGroup:
+			acl.Group = append(acl.Group, ACLEntry{ID: int(e.ID), Name: groupName(int(e.ID)), Permissions: uint64(e.Perm)})
+		case aclTagGroupObj:
+			groupObj = uint64(e.Perm)
+		case aclTagMask:
+			hasMask = true
+		}
+	}
+	// With a mask, the group bits of the mode hold the mask rather than the
+	// permissions of the owning group
+	if hasMask {
+		acl.GroupObj = &FormatACLGroupObj{Permissions: groupObj}
+	}
+
+	if len(def) > 0 {
+		acl.Default = &FormatACLDefault{MaskPermissions: ACLNoMask}
+		for _, e := range def {
+			switch e.Tag {
+			case aclTagUserObj:
+				acl.Default.UserObjPermissions = uint64(e.Perm)
+			case aclTagUser:
+				acl.DefaultUser = append(acl.DefaultUser, ACLEntry{ID: int(e.ID), Name: userName(int(e.ID)), Permissions: uint64(e.Perm)})
+			case aclTagGroupObj:
+				acl.Default.GroupObjPermissions = uint64(e.Perm)
+			case aclTagGroup:
+				acl.DefaultGroup = append(acl.DefaultGroup, ACLEntry{ID: int(e.ID), Name: groupName(int(e.ID)), Permissions: uint64(e.Perm)})
+			case aclTagMask:
+				acl.Default.MaskPermissions = uint64(e.Perm)
+			case aclTagOther:
+				acl.Default.OtherPermissions = uint64(e.Perm)
+			}
+		}
+	}
+	if acl.isEmpty() {
+		return nil
+	}
+	return acl
+}
+
+// Returns the values of the access and default ACL xattrs for an ACL. The mode
+// is needed for the entries of the access ACL that aren't stored in the
+// archive. Either can be nil if there's no such ACL.
+func (a *ACL) xattrs(mode uint64) (access, def []byte) {
+	if len(a.User) > 0 || len(a.Group) > 0 || a.GroupObj != nil {
+		groupObj := (mode >> 3) & 7
+		if a.GroupObj != nil {
+			groupObj = a.GroupObj.Permissions
+		}
+		mask := (mode >> 3) & 7
+		access = aclXattrEntries((mode>>6)&7, groupObj, mode&7, mask, a.User, a.Group)
+	}
+	if a.Default != nil {
+		d := a.Default
+		def = aclXattrEntries(d.UserObjPermissions, d.GroupObjPermissions, d.OtherPermissions, d.MaskPermissions, a.DefaultUser, a.DefaultGroup)
+	}
+	return access, def
+}
+
+// Encodes an ACL in the format of the xattr. Entries need to be sorted by tag
+// and ID. A mask is required when there are named users or groups, it's
+// calculated if there isn't one.
+func aclXattrEntries(userObj, groupObj, other, mask uint64, users, groups []ACLEntry) []byte {
+	users = append([]ACLEntry{}, users...)
+	groups = append([]ACLEntry{}, groups...)
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	sort.Slice(groups, func(i, j int) bool { return groups[i].ID < groups[j].ID })
+
+	entries := []aclXattrEntry{{Tag: aclTagUserObj, Perm: uint16(userObj), ID: aclUndefinedID}}
+	for _, u := range users {
+		entries = append(entries, aclXattrEntry{Tag: aclTagUser, Perm: uint16(u.Permissions), ID: uint32(u.ID)})
+	}
+	entries = append(entries, aclXattrEntry{Tag: aclTagGroupObj, Perm: uint16(groupObj), ID: aclUndefinedID})
+	for _, g := range groups {
+		entries = append(entries, aclXattrEntry{Tag: aclTagGroup, Perm: uint16(g.Permissions), ID: uint32(g.ID)})
+	}
+	if mask == ACLNoMask && (len(users) > 0 || len(groups) > 0) {
+		mask = groupObj
+		for _, e := range append(users, groups...) {
+			mask |= e.Permissions
+		}
+	}
+	if mask != ACLNoMask {
+		entries = append(entries, aclXattrEntry{Tag: aclTagMask, Perm: uint16(mask), ID: aclUndefinedID})
+	}
+	entries = append(entries, aclXattrEntry{Tag: aclTagOther, Perm: uint16(other), ID: aclUndefinedID})
+
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.LittleEndian, uint32(aclXattrVersion))
+	binary.Write(b, binary.LittleEndian, entries)
+	return b.Bytes()
+}
+
+// Returns the access and default ACLs in the text form of acl_to_text(3), with
+// entries separated by commas like GNU tar stores them. Named users and groups
+// are written by name where the archive has one. Either is empty if there's no
+// such ACL.
+func (a *ACL) text(mode uint64) (access, def string) {
+	users := make(map[uint32]string)
+	groups := make(map[uint32]string)
+	for _, e := range append(a.User, a.DefaultUser...) {
+		users[uint32(e.ID)] = e.Name
+	}
+	for _, e := range append(a.Group, a.DefaultGroup...) {
+		groups[uint32(e.ID)] = e.Name
+	}
+	format := func(b []byte) string {
+		entries, err := parseACLXattr(b)
+		if err != nil {
+			return ""
+		}
+		var s []string
+		for _, e := range entries {
+			var tag, qualifier string
+			switch e.Tag {
+			case aclTagUserObj:
+				tag = "user"
+			case aclTagUser:
+				tag, qualifier = "user", users[e.ID]
+				if qualifier == "" {
+					qualifier = strconv.Itoa(int(e.ID))
+				}
+			case aclTagGroupObj:
+				tag = "group"
+			case aclTagGroup:
+				tag, qualifier = "group", groups[e.ID]
+				if qualifier == "" {
+					qualifier = strconv.Itoa(int(e.ID))
+				}
+			case aclTagMask:
+				tag = "mask"
+			case aclTagOther:
+				tag = "other"
+			}
+			s = append(s, tag+":"+qualifier+":"+aclPermText(e.Perm))
+		}
+		return strings.Join(s, ",")
+	}
+	accessXattr, defXattr := a.xattrs(mode)
+	if accessXattr != nil {
+		access = format(accessXattr)
+	}
+	if defXattr != nil {
+		def = format(defXattr)
+	}
+	return access, def
+}
+
+func aclPermText(perm uint16) string {
+	b := []byte("---")
+	if perm&4 != 0 {
+		b[0] = 'r'
+	}
+	if perm&2 != 0 {
+		b[1] = 'w'
+	}
+	if perm&1 != 0 {
+		b[2] = 'x'
+	}
+	return string(b)
+}
+
+// Decodes an ACL in the text form of acl_to_text(3), as stored by GNU tar and
+// star. Entries are separated by commas or newlines and comments are ignored.
+// Named users and groups are looked up locally, unless they're numeric IDs or
+// star added the ID as fourth field.
+func parseACLText(s string) ([]aclXattrEntry, error) {
+	var entries []aclXattrEntry
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if i := strings.IndexByte(field, '#'); i >= 0 {
+			field = field[:i]
+		}
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		parts := strings.Split(field, ":")
+		if len(parts) < 3 {
+			return nil, fmt.Errorf("invalid ACL entry %q", field)
+		}
+		perm, err := parseACLPerm(parts[2])
+		if err != nil {
+			return nil, err
+		}
+		qualifier := parts[1]
+		if len(parts) > 3 && parts[3] != "" {
+			qualifier = parts[3]
+		}
+		e := aclXattrEntry{Perm: perm, ID: aclUndefinedID}
+		switch parts[0] {
+		case "user", "u":
+			e.Tag = aclTagUserObj
+			if qualifier != "" {
+				id, ok := lookupUID(qualifier)
+				if !ok {
+					return nil, fmt.Errorf("unknown user %q in ACL", qualifier)
+				}
+				e.Tag, e.ID = aclTagUser, uint32(id)
+			}
+		case "group", "g":
+			e.Tag = aclTagGroupObj
+			if qualifier != "" {
+				id, ok := lookupGID(qualifier)
+				if !ok {
+					return nil, fmt.Errorf("unknown group %q in ACL", qualifier)
+				}
+				e.Tag, e.ID = aclTagGroup, uint32(id)
+			}
+		case "mask", "m":
+			e.Tag = aclTagMask
+		case "other", "o":
+			e.Tag = aclTagOther
+		default:
+			return nil, fmt.Errorf("invalid ACL entry %q", field)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func parseACLPerm(s string) (uint16, error) {
+	var perm uint16
+	for _, c := range s {
+		switch c {
+		case 'r':
+			perm |= 4
+		case 'w':
+			perm |= 2
+		case 'x':
+			perm |= 1
+		case '-':
+		default:
+			return 0, fmt.Errorf("invalid ACL permissions %q", s)
+		}
+	}
+	return perm, nil
+}
@@ -0,0 +1,60 @@
+// +build linux
+
+package desync
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/pkg/xattr"
+)
+
+// Reads the access and default ACLs of a file or directory. Returns nil if
+// there aren't any beyond what's in the mode, or if the filesystem doesn't
+// support them.
+func readACL(path string) (*ACL, error) {
+	access, err := getACLXattr(path, aclXattrAccess)
+	if err != nil {
+		return nil, err
+	}
+	def, err := getACLXattr(path, aclXattrDefault)
+	if err != nil {
+		return nil, err
+	}
+	return aclFromXattrs(access, def), nil
+}
+
+// Sets the access and default ACLs of a file or directory. The mode is needed
+// for the entries of the access ACL that aren't stored in the archive.
+func writeACL(path string, mode os.FileMode, acl *ACL) error {
+	access, def := acl.xattrs(uint64(mode))
+	if access != nil {
+		if err := xattr.LSet(path, aclXattrAccess, access); err != nil {
+			return err
+		}
+	}
+	if def != nil {
+		if err := xattr.LSet(path, aclXattrDefault, def); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads and decodes an ACL xattr. Returns nil if the file doesn't have one or
+// the filesystem doesn't support ACLs.
+func getACLXattr(path, name string) ([]aclXattrEntry, error) {
+	b, err := xattr.LGet(path, name)
+	if err != nil {
+		if e, ok := err.(*xattr.Error); ok && (e.Err == syscall.ENODATA || e.Err == syscall.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	entries, err := parseACLXattr(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ACL in %s of %s", name, path)
+	}
+	return entries, nil
+}
@@ -0,0 +1,113 @@
+package desync
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/xattr"
+)
+
+func TestTarACL(t *testing.T) {
+	base, err := ioutil.TempDir("", "desync-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	src := filepath.Join(base, "src")
+	dst := filepath.Join(base, "dst")
+	for _, d := range []string{src, dst, filepath.Join(src, "dir")} {
+		if err = os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := filepath.Join(src, "file")
+	if err = ioutil.WriteFile(file, []byte("data"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	// Give a named user and group access to the file, and set a default ACL on
+	// the directory
+	access := aclXattrEntries(6, 4, 0, 6, []ACLEntry{{ID: 1234, Permissions: 6}}, []ACLEntry{{ID: 2345, Permissions: 4}})
+	if err = xattr.LSet(file, aclXattrAccess, access); err != nil {
+		t.Skipf("unable to set ACL, not supported by the filesystem? %s", err)
+	}
+	def := aclXattrEntries(7, 5, 0, ACLNoMask, []ACLEntry{{ID: 1234, Permissions: 7}}, nil)
+	if err = xattr.LSet(filepath.Join(src, "dir"), aclXattrDefault, def); err != nil {
+		t.Fatal(err)
+	}
+
+	// Encode the tree and check the decoded ACLs
+	b := new(bytes.Buffer)
+	if err = Tar(context.Background(), b, src, TarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]*ACL{
+		".": nil,
+		"dir": {
+			Default:     &FormatACLDefault{UserObjPermissions: 7, GroupObjPermissions: 5, OtherPermissions: 0, MaskPermissions: 7},
+			DefaultUser: []ACLEntry{{ID: 1234, Permissions: 7}},
+		},
+		"file": {
+			User:     []ACLEntry{{ID: 1234, Permissions: 6}},
+			Group:    []ACLEntry{{ID: 2345, Permissions: 4}},
+			GroupObj: &FormatACLGroupObj{Permissions: 4},
+		},
+	}
+	d := NewArchiveDecoder(bytes.NewReader(b.Bytes()))
+	for {
+		v, err := d.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v == nil {
+			break
+		}
+		var (
+			name string
+			acl  *ACL
+		)
+		switch n := v.(type) {
+		case NodeDirectory:
+			name, acl = n.Name, n.ACL
+		case NodeFile:
+			name, acl = n.Name, n.ACL
+		default:
+			t.Fatalf("unexpected node %s", reflect.TypeOf(v))
+		}
+		// Headers aren't relevant for the comparison
+		if acl != nil && acl.GroupObj != nil {
+			acl.GroupObj.FormatHeader = FormatHeader{}
+		}
+		if acl != nil && acl.Default != nil {
+			acl.Default.FormatHeader = FormatHeader{}
+		}
+		if !reflect.DeepEqual(expected[name], acl) {
+			t.Fatalf("unexpected ACL for %s: %+v", name, acl)
+		}
+	}
+
+	// Extract it and compare the ACLs to the originals
+	if err = UnTar(context.Background(), bytes.NewReader(b.Bytes()), dst, UntarOptions{NoSameOwner: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"file", "dir"} {
+		for _, x := range []string{aclXattrAccess, aclXattrDefault} {
+			want, err := getACLXattr(filepath.Join(src, name), x)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := getACLXattr(filepath.Join(dst, name), x)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(want, got) {
+				t.Fatalf("%s of %s doesn't match: expected %v, got %v", x, name, want, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package desync
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	minio "github.com/minio/minio-go"
+	"github.com/pkg/errors"
+)
+
+var _ WriteStore = &AdaptiveWriteStore{}
+
+// Number of rounds the minimum latency is remembered. A round is complete when
+// as many requests have finished as the concurrency limit allows.
+const adaptiveLatencyRounds = 10
+
+// AdaptiveOptions control how AdaptiveStore adjusts the number of concurrent
+// requests.
+type AdaptiveOptions struct {
+	// Number of concurrent requests to start with. Defaults to Min.
+	Initial int
+
+	// Range the number of concurrent requests is adjusted in. Min defaults to 1,
+	// Max to Initial.
+	Min, Max int
+
+	// Concurrency is reduced when the average latency of requests in a round is
+	// higher than the lowest recently observed latency times this factor.
+	// Defaults to 2.
+	LatencyFactor float64
+
+	// Number of times requests that were throttled by the store are retried,
+	// with increasing delay. Defaults to 10.
+	ThrottleRetry int
+}
+
+// AdaptiveStats holds the concurrency chosen by an AdaptiveStore and how it got
+// there.
+type AdaptiveStats struct {
+	Location    string `json:"location"`
+	Concurrency int    `json:"concurrency"`
+	Min         int    `json:"concurrency-min"`
+	Max         int    `json:"concurrency-max"`
+	Requests    uint64 `json:"requests"`
+	Throttled   uint64 `json:"throttled"`
+	Increases   uint64 `json:"increases"`
+	Decreases   uint64 `json:"decreases"`
+}
+
+// AdaptiveStore wraps a store and limits the number of concurrent requests to
+// it. The limit is adjusted with additive increase and multiplicative decrease
+// (AIMD). After every round of requests that used up the limit, it's increased
+// by one as long as latency stays low and throughput isn't dropping. It's halved when the
+// store throttles requests or latency goes up. Throttled requests are retried
+// after a delay. Callers need to make at least as many concurrent requests as
+// the maximum for the limit to have any effect.
+type AdaptiveStore struct {
+	s   Store
+	opt AdaptiveOptions
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	limit    int
+	inFlight int
+
+	// Current round
+	roundStart   time.Time
+	roundDone    int
+	roundBytes   int64
+	roundLatency time.Duration
+	roundMin     time.Duration
+	roundFull    bool // The limit was reached during the round
+
+	// Previous rounds
+	lastThroughput float64
+	minLatencies   []time.Duration
+	lastDecrease   time.Time
+
+	stats AdaptiveStats
+}
+
+// NewAdaptiveStore initializes a store wrapper that adjusts the number of
+// concurrent requests.
+func NewAdaptiveStore(s Store, opt AdaptiveOptions) *AdaptiveStore {
+	if opt.Min < 1 {
+		opt.Min = 1
+	}
+	if opt.Initial < opt.Min {
+		opt.Initial = opt.Min
+	}
+	if opt.Max < opt.Initial {
+		opt.Max = opt.Initial
+	}
+	if opt.LatencyFactor <= 1 {
+		opt.LatencyFactor = 2
+	}
+	if opt.ThrottleRetry <= 0 {
+		opt.ThrottleRetry = 10
+	}
+	a := &AdaptiveStore{
+		s:     s,
+		opt:   opt,
+		limit: opt.Initial,
+		stats: AdaptiveStats{
+			Location: s.String(),
+			Min:      opt.Initial,
+			Max:      opt.Initial,
+		},
+	}
+	a.cond = sync.NewCond(&a.mu)
+	return a
+}
+
+// GetChunk reads a chunk from the underlying store once the limit allows.
+func (a *AdaptiveStore) GetChunk(id ChunkID) (*Chunk, error) {
+	var chunk *Chunk
+	err := a.do(func() (int64, error) {
+		var err error
+		if chunk, err = a.s.GetChunk(id); err != nil {
+			return 0, err
+		}
+		return transferSize(chunk), nil
+	})
+	return chunk, err
+}
+
+// HasChunk asks the underlying store for a chunk once the limit allows.
+func (a *AdaptiveStore) HasChunk(id ChunkID) (bool, error) {
+	var has bool
+	err := a.do(func() (int64, error) {
+		var err error
+		has, err = a.s.HasChunk(id)
+		return 0, err
+	})
+	return has, err
+}
+
+// Stats returns the current concurrency limit and how it was adjusted.
+func (a *AdaptiveStore) Stats() AdaptiveStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats := a.stats
+	stats.Concurrency = a.limit
+	return stats
+}
+
+func (a *AdaptiveStore) String() string { return a.s.String() }
+
+// Close the underlying store.
+func (a *AdaptiveStore) Close() error { return a.s.Close() }
+
+// Runs a request when the limit allows it, records the outcome and retries it
+// if it was throttled. The request returns the number of bytes transferred.
+func (a *AdaptiveStore) do(req func() (int64, error)) error {
+	for attempt := 0; ; attempt++ {
+		a.acquire()
+		start := time.Now()
+		n, err := req()
+		throttled := isThrottled(err)
+		a.release(start, n, throttled)
+		if !throttled || attempt >= a.opt.ThrottleRetry {
+			return err
+		}
+		time.Sleep(throttleDelay(attempt))
+	}
+}
+
+func (a *AdaptiveStore) acquire() {
+	a.mu.Lock()
+	for a.inFlight >= a.limit {
+		a.cond.Wait()
+	}
+	a.inFlight++
+	if a.inFlight >= a.limit {
+		a.roundFull = true
+	}
+	if a.roundStart.IsZero() {
+		a.roundStart = time.Now()
+	}
+	a.mu.Unlock()
+}
+
+// Records a finished request and adjusts the limit at the end of a round.
+func (a *AdaptiveStore) release(start time.Time, n int64, throttled bool) {
+	latency := time.Since(start)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	defer a.cond.Broadcast()
+	a.inFlight--
+	a.stats.Requests++
+
+	// Back off right away when throttled. Requests that were started before the
+	// last decrease don't count, they were made with the old limit.
+	if throttled {
+		a.stats.Throttled++
+		if start.After(a.lastDecrease) {
+			a.decrease()
+			a.newRound(0)
+		}
+		return
+	}
+
+	// Requests started before the last decrease are ignored as well, their latency
+	// is the reason for the decrease
+	if start.Before(a.lastDecrease) {
+		return
+	}
+	a.roundDone++
+	a.roundBytes += n
+	a.roundLatency += latency
+	if a.roundMin == 0 || latency < a.roundMin {
+		a.roundMin = latency
+	}
+	if a.roundDone < a.limit {
+		return
+	}
+
+	// The round is complete, compare latency and throughput to previous rounds
+	avg := a.roundLatency / time.Duration(a.roundDone)
+	throughput := float64(a.roundBytes) / time.Since(a.roundStart).Seconds()
+	baseline := a.roundMin
+	for _, l := range a.minLatencies {
+		if l < baseline {
+			baseline = l
+		}
+	}
+	switch {
+	case float64(avg) > float64(baseline)*a.opt.LatencyFactor:
+		a.decrease()
+	case a.roundFull && throughput >= a.lastThroughput*0.9:
+		a.increase()
+	}
+	a.newRound(throughput)
+}
+
+// Starts a new round, remembering the outcome of the last one.
+func (a *AdaptiveStore) newRound(throughput float64) {
+	if a.roundMin > 0 {
+		a.minLatencies = append(a.minLatencies, a.roundMin)
+		if len(a.minLatencies) > adaptiveLatencyRounds {
+			a.minLatencies = a.minLatencies[1:]
+		}
+	}
+	a.lastThroughput = throughput
+	a.roundStart = time.Now()
+	a.roundDone = 0
+	a.roundBytes = 0
+	a.roundLatency = 0
+	a.roundMin = 0
+	a.roundFull = false
+}
+
+func (a *AdaptiveStore) increase() {
+	if a.limit >= a.opt.Max {
+		return
+	}
+	a.setLimit(a.limit + 1)
+	a.stats.Increases++
+}
+
+func (a *AdaptiveStore) decrease() {
+	a.lastDecrease = time.Now()
+	if a.limit <= a.opt.Min {
+		return
+	}
+	limit := a.limit / 2
+	if limit < a.opt.Min {
+		limit = a.opt.Min
+	}
+	a.setLimit(limit)
+	a.stats.Decreases++
+}
+
+// Changes the limit and records the lowest and highest it's been.
+func (a *AdaptiveStore) setLimit(limit int) {
+	a.limit = limit
+	if limit < a.stats.Min {
+		a.stats.Min = limit
+	}
+	if limit > a.stats.Max {
+		a.stats.Max = limit
+	}
+}
+
+// AdaptiveWriteStore is an AdaptiveStore for stores that support writing.
+type AdaptiveWriteStore struct {
+	*AdaptiveStore
+	ws WriteStore
+}
+
+// NewAdaptiveWriteStore initializes a store wrapper that adjusts the number of
+// concurrent requests, including writes.
+func NewAdaptiveWriteStore(s WriteStore, opt AdaptiveOptions) *AdaptiveWriteStore {
+	return &AdaptiveWriteStore{AdaptiveStore: NewAdaptiveStore(s, opt), ws: s}
+}
+
+// StoreChunk writes a chunk to the underlying store once the limit allows.
+func (a *AdaptiveWriteStore) StoreChunk(chunk *Chunk) error {
+	return a.do(func() (int64, error) {
+		return transferSize(chunk), a.ws.StoreChunk(chunk)
+	})
+}
+
+// Approximate number of bytes transferred for a chunk, without compressing or
+// decompressing it.
+func transferSize(c *Chunk) int64 {
+	if len(c.compressed) > 0 {
+		return int64(len(c.compressed))
+	}
+	return int64(len(c.uncompressed))
+}
+
+// Returns true if a store rejected a request because it's overloaded.
+func isThrottled(err error) bool {
+	switch e := errors.Cause(err).(type) {
+	case StoreThrottled:
+		return true
+	case minio.ErrorResponse:
+		return e.Code == "SlowDown" || e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable
+	}
+	return false
+}
+
+// Delay before a throttled request is retried, doubling with every attempt.
+func throttleDelay(attempt int) time.Duration {
+	d := 100 * time.Millisecond << uint(attempt)
+	if d > 5*time.Second || d <= 0 {
+		d = 5 * time.Second
+	}
+	return d
+}
@@ -0,0 +1,106 @@
+package desync
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// Store that throttles requests when more than a given number are in flight.
+type throttlingStore struct {
+	Store
+	max     int
+	latency time.Duration
+
+	mu       sync.Mutex
+	inFlight int
+}
+
+func (s *throttlingStore) GetChunk(id ChunkID) (*Chunk, error) {
+	s.mu.Lock()
+	s.inFlight++
+	n := s.inFlight
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.inFlight--
+		s.mu.Unlock()
+	}()
+	time.Sleep(s.latency)
+	if s.max > 0 && n > s.max {
+		return nil, StoreThrottled{Location: "test", Status: 503}
+	}
+	return NewChunkFromUncompressed([]byte{0}), nil
+}
+
+func (s *throttlingStore) String() string { return "test" }
+
+func TestAdaptiveStore(t *testing.T) {
+	tests := map[string]struct {
+		max            int // Throttle above this, 0 for never
+		initial        int
+		minConcurrency int
+		maxConcurrency int
+		throttled      bool
+	}{
+		"increase without throttling": {
+			initial:        1,
+			minConcurrency: 4,
+			maxConcurrency: 32,
+		},
+		"decrease when throttled": {
+			max:            4,
+			initial:        32,
+			minConcurrency: 1,
+			maxConcurrency: 8,
+			throttled:      true,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := &throttlingStore{max: test.max, latency: time.Millisecond}
+			a := NewAdaptiveStore(s, AdaptiveOptions{Initial: test.initial, Max: 32, ThrottleRetry: 100})
+
+			// Make more concurrent requests than the limit allows
+			var wg sync.WaitGroup
+			for i := 0; i < 32; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 50; j++ {
+						if _, err := a.GetChunk(ChunkID{}); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			stats := a.Stats()
+			if stats.Concurrency < test.minConcurrency || stats.Concurrency > test.maxConcurrency {
+				t.Fatalf("expected concurrency between %d and %d, got %d", test.minConcurrency, test.maxConcurrency, stats.Concurrency)
+			}
+			if test.throttled && (stats.Throttled == 0 || stats.Decreases == 0) {
+				t.Fatalf("expected throttled requests and decreases, got %+v", stats)
+			}
+			if !test.throttled && stats.Increases == 0 {
+				t.Fatalf("expected increases, got %+v", stats)
+			}
+
+			// The range should cover where the limit started and ended up
+			if stats.Min > test.initial || stats.Min > stats.Concurrency {
+				t.Fatalf("expected minimum at or below %d and %d, got %d", test.initial, stats.Concurrency, stats.Min)
+			}
+			if stats.Max < test.initial || stats.Max < stats.Concurrency {
+				t.Fatalf("expected maximum at or above %d and %d, got %d", test.initial, stats.Concurrency, stats.Max)
+			}
+			if test.throttled && stats.Min == test.initial {
+				t.Fatalf("expected minimum below %d, got %+v", test.initial, stats)
+			}
+			if !test.throttled && stats.Max == test.initial {
+				t.Fatalf("expected maximum above %d, got %+v", test.initial, stats)
+			}
+		})
+	}
+}
@@ -14,48 +14,110 @@ type Xattrs map[string]string
 
 // NodeDirectory represents a directory in a catar archive
 type NodeDirectory struct {
-	Name   string
-	UID    int
-	GID    int
-	Mode   os.FileMode
-	MTime  time.Time
-	Xattrs Xattrs
+	Name         string
+	UID          int
+	GID          int
+	User         string
+	Group        string
+	Mode         os.FileMode
+	MTime        time.Time
+	Xattrs       Xattrs
+	ACL          *ACL
+	SELinuxLabel string
+	Flags        uint64 // chattr(1) flags as CaFormatWithFlag* feature flags
 }
 
 // NodeFile holds file permissions and data in a catar archive
 type NodeFile struct {
-	UID    int
-	GID    int
-	Mode   os.FileMode
-	Name   string
-	MTime  time.Time
-	Xattrs Xattrs
-	Data   io.Reader
+	UID          int
+	GID          int
+	User         string
+	Group        string
+	Mode         os.FileMode
+	Name         string
+	MTime        time.Time
+	Xattrs       Xattrs
+	ACL          *ACL
+	Size         uint64
+	Data         io.Reader
+	SELinuxLabel string
+	FCaps        []byte // Content of the security.capability xattr
+	Flags        uint64 // chattr(1) flags as CaFormatWithFlag* feature flags
 }
 
 // NodeSymlink holds symlink information in a catar archive
 type NodeSymlink struct {
-	Name   string
-	UID    int
-	GID    int
-	Mode   os.FileMode
-	MTime  time.Time
-	Xattrs Xattrs
-	Target string
+	Name         string
+	UID          int
+	GID          int
+	User         string
+	Group        string
+	Mode         os.FileMode
+	MTime        time.Time
+	Xattrs       Xattrs
+	Target       string
+	SELinuxLabel string
 }
 
 // NodeDevice holds device information in a catar archive
 type NodeDevice struct {
-	Name   string
-	UID    int
-	GID    int
-	Mode   os.FileMode
-	Major  uint64
-	Minor  uint64
-	Xattrs Xattrs
-	MTime  time.Time
+	Name         string
+	UID          int
+	GID          int
+	User         string
+	Group        string
+	Mode         os.FileMode
+	Major        uint64
+	Minor        uint64
+	Xattrs       Xattrs
+	MTime        time.Time
+	SELinuxLabel string
 }
 
+// NodeFIFO holds information about a named pipe in a catar archive
+type NodeFIFO struct {
+	Name         string
+	UID          int
+	GID          int
+	User         string
+	Group        string
+	Mode         os.FileMode
+	Xattrs       Xattrs
+	MTime        time.Time
+	SELinuxLabel string
+}
+
+// NodeSocket holds information about a unix domain socket in a catar archive
+type NodeSocket struct {
+	Name         string
+	UID          int
+	GID          int
+	User         string
+	Group        string
+	Mode         os.FileMode
+	Xattrs       Xattrs
+	MTime        time.Time
+	SELinuxLabel string
+}
+
+// Extended attributes holding SELinux labels and file capabilities. They are
+// encoded as separate elements in archives, not as xattrs.
+const (
+	xattrSELinux = "security.selinux"
+	xattrFCaps   = "security.capability"
+)
+
+// File type bits in the mode of catar entries. The mode is encoded like it's
+// returned by stat(2), not as os.FileMode. ModeTypeMask selects the type bits
+// of a mode, ModeCharDevice tells character devices apart from block devices.
+const (
+	ModeTypeMask   = 0170000
+	ModeCharDevice = 0020000
+	modeDir        = 0040000
+	modeFIFO       = 0010000
+	modeSocket     = 0140000
+)
+
 // ArchiveDecoder is used to decode a catar archive.
 type ArchiveDecoder struct {
 	d    FormatDecoder
@@ -78,6 +140,11 @@ func (a *ArchiveDecoder) Next() (interface{}, error) {
 		symlink *FormatSymlink
 		device  *FormatDevice
 		xattrs  map[string]string
+		acl     *ACL
+		user    string
+		group   string
+		selinux string
+		fcaps   []byte
 		name    string
 		c       interface{}
 		err     error
@@ -103,14 +170,47 @@ loop:
 				return nil, InvalidFormat{}
 			}
 			entry = &d
-		case FormatUser: // Not supported yet
+		case FormatUser:
+			if entry == nil {
+				return nil, InvalidFormat{}
+			}
+			user = d.Name
 		case FormatGroup:
+			if entry == nil {
+				return nil, InvalidFormat{}
+			}
+			group = d.Name
 		case FormatSELinux:
-		case FormatACLUser:
-		case FormatACLGroup:
-		case FormatACLGroupObj:
-		case FormatACLDefault:
+			if entry == nil {
+				return nil, InvalidFormat{}
+			}
+			selinux = d.Label
+		case FormatACLUser, FormatACLGroup, FormatACLGroupObj, FormatACLDefault, FormatACLDefaultUser, FormatACLDefaultGroup:
+			if entry == nil {
+				return nil, InvalidFormat{}
+			}
+			if acl == nil {
+				acl = new(ACL)
+			}
+			switch d := d.(type) {
+			case FormatACLUser:
+				acl.User = append(acl.User, ACLEntry{ID: int(d.UID), Name: d.Name, Permissions: d.Permissions})
+			case FormatACLGroup:
+				acl.Group = append(acl.Group, ACLEntry{ID: int(d.GID), Name: d.Name, Permissions: d.Permissions})
+			case FormatACLGroupObj:
+				acl.GroupObj = &d
+			case FormatACLDefault:
+				acl.Default = &d
+			case FormatACLDefaultUser:
+				acl.DefaultUser = append(acl.DefaultUser, ACLEntry{ID: int(d.UID), Name: d.Name, Permissions: d.Permissions})
+			case FormatACLDefaultGroup:
+				acl.DefaultGroup = append(acl.DefaultGroup, ACLEntry{ID: int(d.GID), Name: d.Name, Permissions: d.Permissions})
+			}
 		case FormatFCaps:
+			if entry == nil {
+				return nil, InvalidFormat{}
+			}
+			fcaps = d.Data
 		case FormatPayload:
 			if entry == nil {
 				return nil, InvalidFormat{}
@@ -156,56 +256,103 @@ loop:
 		}
 	}
 
+	// FIFOs and sockets are encoded like directories, an entry without any
+	// other elements. They can only be told apart by their mode.
+	switch entry.Mode & ModeTypeMask {
+	case modeFIFO:
+		return NodeFIFO{
+			Name:         filepath.Join(a.dir, name),
+			UID:          entry.UID,
+			GID:          entry.GID,
+			User:         user,
+			Group:        group,
+			Mode:         entry.Mode,
+			MTime:        entry.MTime,
+			Xattrs:       xattrs,
+			SELinuxLabel: selinux,
+		}, nil
+	case modeSocket:
+		return NodeSocket{
+			Name:         filepath.Join(a.dir, name),
+			UID:          entry.UID,
+			GID:          entry.GID,
+			User:         user,
+			Group:        group,
+			Mode:         entry.Mode,
+			MTime:        entry.MTime,
+			Xattrs:       xattrs,
+			SELinuxLabel: selinux,
+		}, nil
+	}
+
 	// If it doesn't have a payload or is a device/symlink, it must be a directory
 	if payload == nil && device == nil && symlink == nil {
 		a.dir = filepath.Join(a.dir, name)
 		return NodeDirectory{
-			Name:   a.dir,
-			UID:    entry.UID,
-			GID:    entry.GID,
-			Mode:   entry.Mode,
-			MTime:  entry.MTime,
-			Xattrs: xattrs,
+			Name:         a.dir,
+			UID:          entry.UID,
+			GID:          entry.GID,
+			User:         user,
+			Group:        group,
+			Mode:         entry.Mode,
+			MTime:        entry.MTime,
+			Xattrs:       xattrs,
+			ACL:          acl,
+			SELinuxLabel: selinux,
+			Flags:        entry.Flags & entry.FeatureFlags,
 		}, nil
 	}
 
 	// Regular file
 	if payload != nil {
 		return NodeFile{
-			Name:   filepath.Join(a.dir, name),
-			UID:    entry.UID,
-			GID:    entry.GID,
-			Mode:   entry.Mode,
-			MTime:  entry.MTime,
-			Xattrs: xattrs,
-			Data:   payload.Data,
+			Name:         filepath.Join(a.dir, name),
+			UID:          entry.UID,
+			GID:          entry.GID,
+			User:         user,
+			Group:        group,
+			Mode:         entry.Mode,
+			MTime:        entry.MTime,
+			Xattrs:       xattrs,
+			ACL:          acl,
+			Size:         payload.Size - 16,
+			Data:         payload.Data,
+			SELinuxLabel: selinux,
+			FCaps:        fcaps,
+			Flags:        entry.Flags & entry.FeatureFlags,
 		}, nil
 	}
 
 	// Device
 	if device != nil {
 		return NodeDevice{
-			Name:   filepath.Join(a.dir, name),
-			UID:    entry.UID,
-			GID:    entry.GID,
-			Mode:   entry.Mode,
-			MTime:  entry.MTime,
-			Xattrs: xattrs,
-			Major:  device.Major,
-			Minor:  device.Minor,
+			Name:         filepath.Join(a.dir, name),
+			UID:          entry.UID,
+			GID:          entry.GID,
+			User:         user,
+			Group:        group,
+			Mode:         entry.Mode,
+			MTime:        entry.MTime,
+			Xattrs:       xattrs,
+			Major:        device.Major,
+			Minor:        device.Minor,
+			SELinuxLabel: selinux,
 		}, nil
 	}
 
 	// Symlink
 	if symlink != nil {
 		return NodeSymlink{
-			Name:   filepath.Join(a.dir, name),
-			UID:    entry.UID,
-			GID:    entry.GID,
-			Mode:   entry.Mode,
-			MTime:  entry.MTime,
-			Xattrs: xattrs,
-			Target: symlink.Target,
+			Name:         filepath.Join(a.dir, name),
+			UID:          entry.UID,
+			GID:          entry.GID,
+			User:         user,
+			Group:        group,
+			Mode:         entry.Mode,
+			MTime:        entry.MTime,
+			Xattrs:       xattrs,
+			Target:       symlink.Target,
+			SELinuxLabel: selinux,
 		}, nil
 	}
 
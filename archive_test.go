@@ -94,3 +94,76 @@ func TestArchiveDecoderNesting(t *testing.T) {
 		}
 	}
 }
+
+func TestArchiveDecoderSpecialFiles(t *testing.T) {
+	f, err := os.Open("testdata/special.catar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	d := NewArchiveDecoder(f)
+
+	// The archive contains a FIFO and a socket, encoded like casync does it
+	expected := []struct {
+		Type interface{}
+		Name string
+	}{
+		{Type: NodeDirectory{}, Name: "."},
+		{Type: NodeFIFO{}, Name: "fifo"},
+		{Type: NodeSocket{}, Name: "socket"},
+		{Type: nil},
+	}
+
+	for _, e := range expected {
+		v, err := d.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reflect.TypeOf(e.Type) != reflect.TypeOf(v) {
+			t.Fatalf("expected %s, got %s", reflect.TypeOf(e.Type), reflect.TypeOf(v))
+		}
+		var name string
+		switch val := v.(type) {
+		case NodeDirectory:
+			name = val.Name
+		case NodeFIFO:
+			name = val.Name
+			if val.Mode&0777 != 0644 {
+				t.Fatalf("expected permissions 0644 for %s, got %o", val.Name, val.Mode&0777)
+			}
+		case NodeSocket:
+			name = val.Name
+			if val.Mode&0777 != 0755 {
+				t.Fatalf("expected permissions 0755 for %s, got %o", val.Name, val.Mode&0777)
+			}
+		}
+		if name != e.Name {
+			t.Fatalf("expected name '%s', got '%s'", e.Name, name)
+		}
+	}
+}
+
+func TestArchiveDecoderSELinux(t *testing.T) {
+	f, err := os.Open("testdata/flat.catar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// All nodes in the casync-produced archive have SELinux labels
+	d := NewArchiveDecoder(f)
+	for {
+		v, err := d.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v == nil {
+			break
+		}
+		label := reflect.ValueOf(v).FieldByName("SELinuxLabel").String()
+		if label == "" {
+			t.Fatalf("expected SELinux label for %s", reflect.TypeOf(v))
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package desync
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// ArchiveNodePos is the location of a node in a catar archive, as found with
+// LookupArchivePath. It covers the filename element of the node, its entry,
+// and everything that follows up to the goodbye element of a directory.
+type ArchiveNodePos struct {
+	Name   string // Path of the node in the archive
+	Offset int64
+	Size   int64
+}
+
+// Decoder returns an ArchiveDecoder for the node and anything below it, read
+// from r which needs to hold the data at the node's position. Names of nodes
+// returned by the decoder are relative to the root of the archive.
+func (p ArchiveNodePos) Decoder(r io.Reader) ArchiveDecoder {
+	dec := NewArchiveDecoder(r)
+	dec.dir = path.Dir(p.Name)
+	return dec
+}
+
+// LookupArchivePath finds a node in a catar archive of the given size without
+// reading it all. Starting at the root, the goodbye table at the end of each
+// directory is searched for the SipHash of the next element in the path. Its
+// item points back at the start of the child. Only goodbye tables, filenames
+// and directory entries along the path are read. Returns an error if the path
+// isn't in the archive.
+func LookupArchivePath(r io.ReadSeeker, size int64, name string) (ArchiveNodePos, error) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	pos := ArchiveNodePos{Name: ".", Size: size}
+	if name == "" {
+		return pos, nil
+	}
+	// Start and end of the directory that's being searched
+	start, end := int64(0), size
+	for _, element := range strings.Split(name, "/") {
+		if err := checkArchiveDir(r, start, pos.Name); err != nil {
+			return pos, err
+		}
+		child, err := lookupGoodbye(r, end, element)
+		if err != nil {
+			return pos, err
+		}
+		if child.Size == 0 {
+			return pos, fmt.Errorf("%s not found in archive", name)
+		}
+		child.Name = path.Join(pos.Name, element)
+		pos = child
+		start, end = pos.Offset+int64(16+len(element)+1), pos.Offset+pos.Size
+	}
+	return pos, nil
+}
+
+// Returns an error if the entry at the offset is not a directory.
+func checkArchiveDir(r io.ReadSeeker, offset int64, name string) error {
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	d := NewFormatDecoder(r)
+	e, err := d.Next()
+	if err != nil {
+		return err
+	}
+	entry, ok := e.(FormatEntry)
+	if !ok {
+		return InvalidFormat{fmt.Sprintf("expected entry for %s", name)}
+	}
+	if entry.Mode&ModeTypeMask != modeDir {
+		return fmt.Errorf("%s is not a directory", name)
+	}
+	return nil
+}
+
+// Searches the goodbye table of a directory ending at the given offset for a
+// child. Returns the position of the child, with Size 0 if there's no child
+// by that name.
+func lookupGoodbye(r io.ReadSeeker, end int64, name string) (ArchiveNodePos, error) {
+	// The tail marker is the last item in the goodbye table and holds the size
+	// of the goodbye element
+	if _, err := r.Seek(end-24, io.SeekStart); err != nil {
+		return ArchiveNodePos{}, err
+	}
+	tail := make([]uint64, 3)
+	if err := binary.Read(r, binary.LittleEndian, tail); err != nil {
+		return ArchiveNodePos{}, err
+	}
+	if tail[2] != CaFormatGoodbyeTailMarker {
+		return ArchiveNodePos{}, InvalidFormat{"tail marker not found"}
+	}
+	start := end - int64(tail[1])
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return ArchiveNodePos{}, err
+	}
+	d := NewFormatDecoder(r)
+	e, err := d.Next()
+	if err != nil {
+		return ArchiveNodePos{}, err
+	}
+	goodbye, ok := e.(FormatGoodbye)
+	if !ok {
+		return ArchiveNodePos{}, InvalidFormat{"expected goodbye element"}
+	}
+	items := goodbye.Items[:len(goodbye.Items)-1]
+
+	// casync orders the items as a BST by hash, but older versions of desync
+	// wrote them in the order of the files. Check all items with a matching
+	// hash, names can have the same hash.
+	hash := SipHash([]byte(name))
+	for _, item := range items {
+		if item.Hash != hash {
+			continue
+		}
+		pos := ArchiveNodePos{Offset: start - int64(item.Offset), Size: int64(item.Size)}
+		if _, err := r.Seek(pos.Offset, io.SeekStart); err != nil {
+			return pos, err
+		}
+		d := NewFormatDecoder(r)
+		e, err := d.Next()
+		if err != nil {
+			return pos, err
+		}
+		filename, ok := e.(FormatFilename)
+		if !ok {
+			return pos, InvalidFormat{"goodbye item doesn't point to a filename"}
+		}
+		if filename.Name == name {
+			return pos, nil
+		}
+	}
+	return ArchiveNodePos{}, nil
+}
@@ -0,0 +1,71 @@
+package desync
+
+import (
+	"context"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLookupArchivePath(t *testing.T) {
+	f, err := os.Open("testdata/nested.catar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Decode the whole archive to get all the names in it
+	var names []string
+	if err := WalkArchive(context.Background(), f, func(n interface{}) error {
+		names = append(names, reflect.ValueOf(n).FieldByName("Name").String())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every node should be found, and decoding from its position should produce
+	// the node and everything below it
+	for _, name := range names {
+		pos, err := LookupArchivePath(f, info.Size(), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pos.Name != name {
+			t.Fatalf("expected %s, got %s", name, pos.Name)
+		}
+		dec := pos.Decoder(io.NewSectionReader(f, pos.Offset, pos.Size))
+		var got []string
+		for {
+			n, err := dec.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n == nil {
+				break
+			}
+			got = append(got, reflect.ValueOf(n).FieldByName("Name").String())
+		}
+		var expected []string
+		for _, n := range names {
+			if name == "." || n == name || strings.HasPrefix(n, name+"/") {
+				expected = append(expected, n)
+			}
+		}
+		if !reflect.DeepEqual(expected, got) {
+			t.Fatalf("expected %v for %s, got %v", expected, name, got)
+		}
+	}
+
+	// Paths that don't exist
+	for _, name := range []string{"missing", "dir1/missing", "dir1/sub11/f11/f"} {
+		if _, err := LookupArchivePath(f, info.Size(), name); err == nil {
+			t.Fatalf("expected error looking up %s", name)
+		}
+	}
+}
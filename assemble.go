@@ -2,22 +2,83 @@ package desync
 
 import (
 	"context"
-	"crypto/sha512"
+	"encoding/hex"
 	"fmt"
 	"os"
+	"sort"
+	"sync"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 )
 
+// How often the journal is written to disk during AssembleFile
+const journalInterval = 10 * time.Second
+
+// AssembleOptions are used to control the behavior of AssembleFile.
+type AssembleOptions struct {
+	// Name of a journal file in which completed ranges of the target are
+	// recorded. When an extract into an existing target is interrupted, the
+	// journal is used to resume without having to read and verify completed
+	// ranges again. The journal is only trusted if the size and modification
+	// time of the target match what was recorded. The first and last chunk of
+	// each completed range are checked against the index as well, all chunks for
+	// block devices. It's removed once the extract completes successfully.
+	Journal string
+
+	// Ignore any existing journal and verify all data already in the target.
+	ForceVerify bool
+
+	// Use BLKZEROOUT for ranges of null chunks when the target is a block device
+	// instead of writing 0 bytes. Depending on the device, this deallocates the
+	// blocks, for example on thin-provisioned volumes. Holes are always punched
+	// into regular files for null chunks.
+	ZeroOutDevice bool
+
+	// Number of goroutines requesting chunks from the store ahead of the writers.
+	// Defaults to the number of writers.
+	FetchConcurrency int
+
+	// Maximum number of bytes of chunk data that has been fetched from the store
+	// but not yet written to the target. This limits how far ahead of the
+	// writers chunks are requested. Defaults to DefaultFetchMemory.
+	FetchMemory int64
+
+	// Expected SHA-256 digest of the whole blob. If set, the digest of the target
+	// is calculated as it's being assembled and compared once it's complete.
+	Digest []byte
+}
+
 // AssembleFile re-assembles a file based on a list of index chunks. It runs n
-// goroutines, creating one filehandle for the file "name" per goroutine
-// and writes to the file simultaneously. If progress is provided, it'll be
-// called when a chunk has been processed.
+// writer goroutines, creating one filehandle for the file "name" per goroutine
+// and writes to the file simultaneously. Chunks are requested from the store by
+// a separate pool of goroutines, well before a writer needs them, so a store
+// with high latency doesn't require a large number of writers. If progress is
+// provided, it'll be called when a chunk has been processed.
 // If the input file exists and is not empty, the algorithm will first
 // confirm if the data matches what is expected and only populate areas that
 // differ from the expected content. This can be used to complete partly
 // written files.
-func AssembleFile(ctx context.Context, name string, idx Index, s Store, seeds []Seed, n int, pb ProgressBar) (*ExtractStats, error) {
+func AssembleFile(ctx context.Context, name string, idx Index, s Store, seeds []Seed, n int, options AssembleOptions, pb ProgressBar) (*ExtractStats, error) {
+	// Setup and start the progressbar if any
+	if pb != nil {
+		pb.SetTotal(len(idx.Chunks))
+		pb.Start()
+		defer pb.Finish()
+	}
+
+	// Start a self-seed which will become usable once chunks are written contigously
+	// beginning at position 0.
+	ss, err := newSelfSeed(name, idx)
+	if err != nil {
+		return &ExtractStats{BytesTotal: idx.Length(), ChunksTotal: len(idx.Chunks)}, err
+	}
+	return assembleFile(ctx, name, idx, s, ss, seeds, n, options, pb)
+}
+
+// Assembles a file like AssembleFile, using a self-seed that was setup by the
+// caller. The progressbar needs to be started by the caller as well.
+func assembleFile(ctx context.Context, name string, idx Index, s Store, ss *selfSeed, seeds []Seed, n int, options AssembleOptions, pb ProgressBar) (*ExtractStats, error) {
 	type Job struct {
 		segment IndexSegment
 		source  SeedSegment
@@ -29,13 +90,6 @@ func AssembleFile(ctx context.Context, name string, idx Index, s Store, seeds []
 	)
 	g, ctx := errgroup.WithContext(ctx)
 
-	// Setup and start the progressbar if any
-	if pb != nil {
-		pb.SetTotal(len(idx.Chunks))
-		pb.Start()
-		defer pb.Finish()
-	}
-
 	// Initialize stats to be gathered during extraction
 	stats := &ExtractStats{
 		BytesTotal:  idx.Length(),
@@ -60,6 +114,21 @@ func AssembleFile(ctx context.Context, name string, idx Index, s Store, seeds []
 		isBlank = true
 	}
 
+	// Read the journal of a previous run if there is one. This needs to happen
+	// before the target is truncated since its size is checked.
+	var (
+		journal   *extractJournal
+		completed [][2]int
+	)
+	if options.Journal != "" {
+		if journal, err = newExtractJournal(options.Journal, idx); err != nil {
+			return stats, err
+		}
+		if !isBlank && !options.ForceVerify {
+			completed = journal.load(name)
+		}
+	}
+
 	// Truncate the output file to the full expected size. Not only does this
 	// confirm there's enough disk space, but it allows for an optimization
 	// when dealing with the Null Chunk
@@ -79,106 +148,256 @@ func AssembleFile(ctx context.Context, name string, idx Index, s Store, seeds []
 		return stats, err
 	}
 	defer ns.close()
+	ns.punchHoles = !isBlkDevice
+	ns.zeroOut = isBlkDevice && options.ZeroOutDevice
 
-	// Start a self-seed which will become usable once chunks are written contigously
-	// beginning at position 0.
-	ss, err := newSelfSeed(name, idx)
-	if err != nil {
-		return stats, err
-	}
+	// Keep the seeds given by the caller separate, the prefetcher only skips
+	// chunks that are available in those
+	callerSeeds := seeds
 	seeds = append([]Seed{ns, ss}, seeds...)
 
 	// Record the total number of seeds and blocksize in the stats
 	stats.Seeds = len(seeds)
 	stats.Blocksize = blocksize
 
+	// Calculate the digest of the target as it's being written if one is expected
+	var digest *fileDigest
+	if options.Digest != nil {
+		if digest, err = newFileDigest(name, idx); err != nil {
+			return stats, err
+		}
+		defer digest.close()
+	}
+
+	// Records a segment as having been written, making it available in the
+	// self-seed and for the digest
+	markWritten := func(segment IndexSegment) {
+		ss.add(segment)
+		if digest != nil {
+			digest.add(segment.first, segment.last)
+		}
+	}
+
+	// Ranges of the index that need to be processed. If there's a journal from a
+	// previous run, the ranges it has as complete are skipped but made available
+	// in the self-seed.
+	var todo [][2]int
+	if len(idx.Chunks) > 0 {
+		todo = [][2]int{{0, len(idx.Chunks) - 1}}
+	}
+	if journal != nil {
+		for _, r := range completed {
+			journal.add(r[0], r[1])
+			markWritten(IndexSegment{index: idx, first: r[0], last: r[1]})
+			stats.addChunksFromJournal(uint64(r[1] - r[0] + 1))
+			if pb != nil {
+				pb.Add(r[1] - r[0] + 1)
+			}
+		}
+		todo = journal.ranges(false)
+	}
+
+	// Chunks from the store are requested by a separate pool of goroutines, ahead
+	// of the writers, but not more than the memory budget allows
+	fetchers := options.FetchConcurrency
+	if fetchers <= 0 {
+		fetchers = n
+	}
+	memory := options.FetchMemory
+	if memory <= 0 {
+		memory = DefaultFetchMemory
+	}
+	prefetcher := newChunkPrefetcher(s, name, isBlank, memory)
+
+	// Seeds that turned out to not match their index, recorded by the workers
+	var (
+		invalidSeeds = make(map[string]struct{})
+		invalidMu    sync.Mutex
+	)
+
+	// Writes a single segment into the target, from a seed or the store. If a seed
+	// turns out to not match its index, it's discarded and the segment is
+	// sequenced again using the remaining seeds and the store.
+	var writeSegment func(f *os.File, segment IndexSegment, source SeedSegment) error
+	writeSegment = func(f *os.File, segment IndexSegment, source SeedSegment) error {
+		if source != nil {
+			offset := segment.start()
+			length := segment.lengthBytes()
+			copied, cloned, offloaded, err := source.WriteInto(f, offset, length, blocksize, isBlank)
+			if e, ok := err.(SeedInvalid); ok {
+				invalidMu.Lock()
+				invalidSeeds[e.File] = struct{}{}
+				invalidMu.Unlock()
+				seq := newSeedSequencerRange(idx, segment.first, segment.last, seeds...)
+				for {
+					segment, source, done := seq.Next()
+					if err := writeSegment(f, segment, source); err != nil {
+						return err
+					}
+					if done {
+						return nil
+					}
+				}
+			}
+			if err != nil {
+				return err
+			}
+			// Chunks in this segment won't be needed from the store anymore
+			prefetcher.discard(segment.first, segment.last)
+			stats.addChunksFromSeed(uint64(segment.lengthChunks()))
+			stats.addBytesCopied(copied)
+			stats.addBytesOffloaded(offloaded)
+			stats.addBytesCloned(cloned)
+			// Record this segment's been written in the self-seed to make it
+			// available going forward
+			markWritten(segment)
+			return nil
+		}
+		c := segment.chunks()[0]
+		// Use the chunk if it was fetched ahead of time, otherwise check the
+		// target and pull it from the store now
+		var (
+			b       []byte
+			inPlace bool
+			err     error
+		)
+		fetch := prefetcher.take(segment.first)
+		if fetch != nil {
+			b, inPlace, err = fetch.wait()
+		} else {
+			// If we operate on an existing file there's a good chance we already
+			// have the data written for this chunk. Let's read it from disk and
+			// compare to what is expected.
+			if !isBlank {
+				inPlace, err = chunkInPlace(f, c)
+			}
+			if err == nil && !inPlace {
+				b, err = fetchChunk(s, c)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if inPlace {
+			// Record this chunk's been written in the self-seed
+			markWritten(segment)
+			// Record we kept this chunk in the file (when using in-place extract)
+			stats.incChunksInPlace()
+			return nil
+		}
+		// Record this chunk having been pulled from the store
+		stats.incChunksFromStore()
+		// Write the decompressed chunk into the file at the right position
+		if _, err = f.WriteAt(b, int64(c.Start)); err != nil {
+			return err
+		}
+		if fetch != nil {
+			prefetcher.release(fetch)
+		}
+		// Record this chunk's been written in the self-seed
+		markWritten(segment)
+		return nil
+	}
+
 	// Start the workers, each having its own filehandle to write concurrently
 	for i := 0; i < n; i++ {
 		f, err := os.OpenFile(name, os.O_RDWR, 0666)
 		if err != nil {
+			close(in)
+			g.Wait()
 			return stats, fmt.Errorf("unable to open file %s, %s", name, err)
 		}
 		defer f.Close()
 		g.Go(func() error {
 			for job := range in {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
 				if pb != nil {
 					pb.Add(job.segment.lengthChunks())
 				}
-				if job.source != nil {
-					stats.addChunksFromSeed(uint64(job.segment.lengthChunks()))
-					offset := job.segment.start()
-					length := job.segment.lengthBytes()
-					copied, cloned, err := job.source.WriteInto(f, offset, length, blocksize, isBlank)
-					if err != nil {
-						return err
-					}
-					stats.addBytesCopied(copied)
-					stats.addBytesCloned(cloned)
-					// Record this segment's been written in the self-seed to make it
-					// available going forward
-					ss.add(job.segment)
-					continue
-				}
-				c := job.segment.chunks()[0]
-				// If we operate on an existing file there's a good chance we already
-				// have the data written for this chunk. Let's read it from disk and
-				// compare to what is expected.
-				if !isBlank {
-					b := make([]byte, c.Size)
-					if _, err := f.ReadAt(b, int64(c.Start)); err != nil {
-						return err
-					}
-					sum := sha512.Sum512_256(b)
-					if sum == c.ID {
-						// Record this chunk's been written in the self-seed
-						ss.add(job.segment)
-						// Record we kept this chunk in the file (when using in-place extract)
-						stats.incChunksInPlace()
-						continue
-					}
-				}
-				// Record this chunk having been pulled from the store
-				stats.incChunksFromStore()
-				// Pull the (compressed) chunk from the store
-				chunk, err := s.GetChunk(c.ID)
-				if err != nil {
-					return err
-				}
-				b, err := chunk.Uncompressed()
-				if err != nil {
+				if err := writeSegment(f, job.segment, job.source); err != nil {
 					return err
 				}
-				// Might as well verify the chunk size while we're at it
-				if c.Size != uint64(len(b)) {
-					return fmt.Errorf("unexpected size for chunk %s", c.ID)
+				if journal != nil {
+					journal.add(job.segment.first, job.segment.last)
 				}
-				// Write the decompressed chunk into the file at the right position
-				if _, err = f.WriteAt(b, int64(c.Start)); err != nil {
-					return err
-				}
-				// Record this chunk's been written in the self-seed
-				ss.add(job.segment)
 			}
 			return nil
 		})
 	}
 
+	// Start fetching chunks once the writers are up
+	if err := prefetcher.start(ctx, g, fetchers, idx, todo, callerSeeds); err != nil {
+		close(in)
+		g.Wait()
+		return stats, err
+	}
+
+	// Write the journal to disk periodically until all workers are done
+	stopJournal := make(chan struct{})
+	journalDone := make(chan struct{})
+	go func() {
+		defer close(journalDone)
+		if journal == nil {
+			return
+		}
+		ticker := time.NewTicker(journalInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				journal.write(name) // Errors here are not fatal, it's retried later
+			case <-stopJournal:
+				return
+			}
+		}
+	}()
+
 	// Let the sequencer break up the index into segments, feed the workers, and
 	// stop if there are any errors
-	seq := NewSeedSequencer(idx, seeds...)
 loop:
-	for {
-		chunks, from, done := seq.Next()
-		select {
-		case <-ctx.Done():
-			break loop
-		case in <- Job{chunks, from}:
-		}
-		if done {
-			break
+	for _, r := range todo {
+		seq := newSeedSequencerRange(idx, r[0], r[1], seeds...)
+		for {
+			chunks, from, done := seq.Next()
+			select {
+			case <-ctx.Done():
+				break loop
+			case in <- Job{chunks, from}:
+			}
+			if done {
+				break
+			}
 		}
 	}
 	close(in)
 
-	return stats, g.Wait()
+	err = g.Wait()
+	close(stopJournal)
+	<-journalDone
+
+	// Compare the digest of the target to what's expected once it's complete
+	if digest != nil && err == nil {
+		var sum []byte
+		sum, err = digest.verify(options.Digest)
+		if sum != nil {
+			stats.Digest = hex.EncodeToString(sum)
+		}
+	}
+
+	// Record what's been done in the journal if the extract didn't complete, and
+	// remove it if it did since it's no longer needed
+	if journal != nil {
+		if err != nil {
+			journal.write(name)
+		} else if jerr := journal.remove(); jerr != nil {
+			err = jerr
+		}
+	}
+	for file := range invalidSeeds {
+		stats.SeedsInvalid = append(stats.SeedsInvalid, file)
+	}
+	sort.Strings(stats.SeedsInvalid)
+	return stats, err
 }
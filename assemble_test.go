@@ -127,7 +127,7 @@ func TestExtract(t *testing.T) {
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
 			defer os.Remove(test.outfile)
-			if _, err := AssembleFile(context.Background(), test.outfile, index, test.store, nil, 10, nil); err != nil {
+			if _, err := AssembleFile(context.Background(), test.outfile, index, test.store, nil, 10, AssembleOptions{}, nil); err != nil {
 				t.Fatal(err)
 			}
 			b, err := ioutil.ReadFile(test.outfile)
@@ -268,7 +268,7 @@ func TestSeed(t *testing.T) {
 				seeds = append(seeds, seed)
 			}
 
-			if _, err := AssembleFile(context.Background(), dst.Name(), dstIndex, s, seeds, 10, nil); err != nil {
+			if _, err := AssembleFile(context.Background(), dst.Name(), dstIndex, s, seeds, 10, AssembleOptions{}, nil); err != nil {
 				t.Fatal(err)
 			}
 			b, err := ioutil.ReadFile(dst.Name())
@@ -284,6 +284,108 @@ func TestSeed(t *testing.T) {
 
 }
 
+func TestSeedInvalid(t *testing.T) {
+	data1, err := ioutil.ReadFile("testdata/chunker.input")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rand1 := make([]byte, 4*ChunkSizeMaxDefault)
+	rand.Read(rand1)
+	target := join(data1, rand1)
+
+	// Setup a temporary store
+	store, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(store)
+
+	s, err := NewLocalStore(store, StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Ways to make the seed no longer match its index after it was chunked
+	tests := map[string]func(name string) error{
+		"modified seed": func(name string) error {
+			b := make([]byte, len(target))
+			rand.Read(b)
+			return ioutil.WriteFile(name, b, 0644)
+		},
+		"truncated seed": func(name string) error {
+			return os.Truncate(name, int64(len(data1)/2))
+		},
+		"removed seed": func(name string) error {
+			return os.Remove(name)
+		},
+	}
+
+	for name, invalidate := range tests {
+		t.Run(name, func(t *testing.T) {
+			// Build a seed with the same content as the target, index it and
+			// put the chunks into the store
+			seedFile, err := ioutil.TempFile("", "seed")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.Copy(seedFile, bytes.NewReader(target)); err != nil {
+				t.Fatal(err)
+			}
+			seedFile.Close()
+			defer os.Remove(seedFile.Name())
+			index, _, err := IndexFromFile(
+				context.Background(),
+				seedFile.Name(),
+				10,
+				ChunkSizeMinDefault, ChunkSizeAvgDefault, ChunkSizeMaxDefault,
+				nil,
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ChopFile(context.Background(), seedFile.Name(), index.Chunks, s, 10, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			// Now change the seed so it no longer matches the index
+			if err := invalidate(seedFile.Name()); err != nil {
+				t.Fatal(err)
+			}
+
+			dst, err := ioutil.TempFile("", "dst")
+			if err != nil {
+				t.Fatal(err)
+			}
+			dst.Close()
+			defer os.Remove(dst.Name())
+
+			seed, err := NewIndexSeed(dst.Name(), seedFile.Name(), index)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The extract should succeed using the store and report the bad seed
+			stats, err := AssembleFile(context.Background(), dst.Name(), index, s, []Seed{seed}, 10, AssembleOptions{}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadFile(dst.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if md5.Sum(b) != md5.Sum(target) {
+				t.Fatal("checksum of extracted file doesn't match expected")
+			}
+			if len(stats.SeedsInvalid) != 1 || stats.SeedsInvalid[0] != seedFile.Name() {
+				t.Fatalf("expected seed %s to be reported as invalid, got %v", seedFile.Name(), stats.SeedsInvalid)
+			}
+			if !seed.IsInvalid() {
+				t.Fatal("expected seed to be marked invalid")
+			}
+		})
+	}
+}
+
 func join(slices ...[]byte) []byte {
 	var out []byte
 	for _, b := range slices {
@@ -0,0 +1,160 @@
+package desync
+
+import (
+	"context"
+	"os"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// AssembleTarget is a file to be assembled from an index by AssembleFiles, with
+// optional seeds for it.
+type AssembleTarget struct {
+	Name  string
+	Index Index
+	Seeds []Seed
+}
+
+// Uses the data that's already been written to another target of AssembleFiles
+// as seed.
+type targetSeed struct {
+	ss         *selfSeed
+	canReflink bool
+}
+
+func (s targetSeed) LongestMatchWith(chunks []IndexChunk) (int, SeedSegment) {
+	return s.ss.longestMatch(chunks, s.canReflink)
+}
+
+// Store used by all targets of AssembleFiles. Chunks that have already been
+// written to one of the targets are read back from there, all others come from
+// the underlying store. It's wrapped in a DedupQueue, so concurrent requests for
+// the same chunk only hit the store once.
+type targetsStore struct {
+	Store
+	seeds []*selfSeed
+}
+
+// GetChunk returns a chunk from a target it's been written to, or from the
+// underlying store otherwise.
+func (s targetsStore) GetChunk(id ChunkID) (*Chunk, error) {
+	for _, ss := range s.seeds {
+		if c, ok := ss.find(id); ok {
+			if chunk, err := readTargetChunk(ss.file, c); err == nil {
+				return chunk, nil
+			}
+			break
+		}
+	}
+	chunk, err := s.Store.GetChunk(id)
+	if err != nil {
+		return nil, err
+	}
+	// The DedupQueue hands the same chunk to all targets waiting for it, so
+	// decompress it before it's shared
+	if _, err := chunk.Uncompressed(); err != nil {
+		return nil, err
+	}
+	return chunk, nil
+}
+
+// Reads a chunk from a target and validates it.
+func readTargetChunk(name string, c IndexChunk) (*Chunk, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b := make([]byte, c.Size)
+	if _, err := f.ReadAt(b, int64(c.Start)); err != nil {
+		return nil, err
+	}
+	return NewChunkWithID(c.ID, b, nil, false)
+}
+
+// AssembleFiles assembles several files at the same time, each using n
+// goroutines like AssembleFile. Concurrent requests of several targets for the
+// same chunk only hit the store once, chunks that are already written to one
+// target are read back from there, and every target is used as seed for the
+// others as data is written to it. Of the options, only
+// FetchConcurrency and FetchMemory are used, they apply to each target. The
+// returned stats are combined for all targets. The progress bar reports
+// progress over all chunks of all targets.
+func AssembleFiles(ctx context.Context, targets []AssembleTarget, s Store, n int, options AssembleOptions, pb ProgressBar) (*ExtractStats, error) {
+	stats := &ExtractStats{}
+	for _, t := range targets {
+		stats.BytesTotal += t.Index.Length()
+		stats.ChunksTotal += len(t.Index.Chunks)
+	}
+
+	// Setup and start the progressbar if any
+	if pb != nil {
+		pb.SetTotal(stats.ChunksTotal)
+		pb.Start()
+		defer pb.Finish()
+	}
+
+	// Create all targets that don't exist yet and setup the self-seeds which are
+	// used as seeds for the other targets
+	selfSeeds := make([]*selfSeed, len(targets))
+	for i, t := range targets {
+		if _, err := os.Stat(t.Name); os.IsNotExist(err) {
+			f, err := os.Create(t.Name)
+			if err != nil {
+				return stats, err
+			}
+			f.Close()
+		}
+		ss, err := newSelfSeed(t.Name, t.Index)
+		if err != nil {
+			return stats, err
+		}
+		selfSeeds[i] = ss
+	}
+
+	// Chunks requested by several targets at the same time only hit the store once
+	s = NewDedupQueue(targetsStore{Store: s, seeds: selfSeeds})
+	opt := AssembleOptions{
+		FetchConcurrency: options.FetchConcurrency,
+		FetchMemory:      options.FetchMemory,
+	}
+
+	results := make([]*ExtractStats, len(targets))
+	g, ctx := errgroup.WithContext(ctx)
+	for i, t := range targets {
+		i, t := i, t
+		seeds := append([]Seed{}, t.Seeds...)
+		for j, ss := range selfSeeds {
+			if j == i {
+				continue
+			}
+			seeds = append(seeds, targetSeed{ss: ss, canReflink: CanClone(t.Name, ss.file)})
+		}
+		g.Go(func() error {
+			var err error
+			results[i], err = assembleFile(ctx, t.Name, t.Index, s, selfSeeds[i], seeds, n, opt, pb)
+			return err
+		})
+	}
+	err := g.Wait()
+
+	// Combine the stats of all targets
+	for _, r := range results {
+		if r == nil {
+			continue
+		}
+		stats.ChunksFromSeeds += r.ChunksFromSeeds
+		stats.ChunksFromStore += r.ChunksFromStore
+		stats.ChunksInPlace += r.ChunksInPlace
+		stats.ChunksFromJournal += r.ChunksFromJournal
+		stats.BytesCopied += r.BytesCopied
+		stats.BytesCloned += r.BytesCloned
+		stats.BytesOffloaded += r.BytesOffloaded
+		stats.Seeds += r.Seeds
+		stats.SeedsInvalid = append(stats.SeedsInvalid, r.SeedsInvalid...)
+		if r.Blocksize > stats.Blocksize {
+			stats.Blocksize = r.Blocksize
+		}
+	}
+	return stats, err
+}
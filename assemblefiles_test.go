@@ -0,0 +1,123 @@
+package desync
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAssembleFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "assemble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := filepath.Join(dir, "store")
+	if err := os.Mkdir(store, 0755); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewLocalStore(store, StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Build a number of random chunks that are shared between the targets
+	size := 1024
+	var chunks [][]byte
+	for i := 0; i < 10; i++ {
+		b := make([]byte, size)
+		rand.Read(b)
+		if err := s.StoreChunk(NewChunkFromUncompressed(b)); err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, b)
+	}
+
+	// Define targets with overlapping content
+	var (
+		targets  []AssembleTarget
+		expected [][]byte
+	)
+	for i, content := range [][]int{
+		{0, 1, 2, 3, 4, 5},
+		{3, 4, 5, 6, 7, 8},
+		{0, 1, 2, 3, 4, 5, 9},
+	} {
+		var (
+			idx  Index
+			data []byte
+		)
+		for j, p := range content {
+			idx.Chunks = append(idx.Chunks, IndexChunk{
+				ID:    NewChunkFromUncompressed(chunks[p]).ID(),
+				Start: uint64(j * size),
+				Size:  uint64(size),
+			})
+			data = append(data, chunks[p]...)
+		}
+		name := filepath.Join(dir, fmt.Sprintf("target%d", i))
+		targets = append(targets, AssembleTarget{Name: name, Index: idx})
+		expected = append(expected, data)
+	}
+
+	// Count how often each chunk is requested from a slow store, so the targets
+	// ask for the same chunks at the same time
+	var (
+		requests = make(map[ChunkID]int)
+		mu       sync.Mutex
+	)
+	counting := &TestStore{
+		GetChunkFunc: func(id ChunkID) (*Chunk, error) {
+			mu.Lock()
+			requests[id]++
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			return s.GetChunk(id)
+		},
+	}
+
+	stats, err := AssembleFiles(context.Background(), targets, counting, 2, AssembleOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, target := range targets {
+		b, err := ioutil.ReadFile(target.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, expected[i]) {
+			t.Fatalf("content of %s doesn't match expected", target.Name)
+		}
+	}
+
+	// Stats should be combined for all targets
+	if stats.ChunksTotal != 19 {
+		t.Fatalf("expected 19 chunks total, got %d", stats.ChunksTotal)
+	}
+	if stats.BytesTotal != int64(19*size) {
+		t.Fatalf("expected %d bytes total, got %d", 19*size, stats.BytesTotal)
+	}
+	if got := stats.ChunksFromSeeds + stats.ChunksFromStore + stats.ChunksInPlace; got != 19 {
+		t.Fatalf("expected 19 chunks from seeds and store, got %d", got)
+	}
+
+	// Concurrent requests for shared chunks are deduplicated and chunks that are
+	// already written to a target are read back from there. A chunk can still be
+	// requested again right after it was fetched for a target, before it's been
+	// written, but nowhere near as often as without sharing.
+	var total int
+	for _, n := range requests {
+		total += n
+	}
+	if limit := len(chunks) + len(targets); total > limit {
+		t.Fatalf("expected at most %d requests to the store, got %d", limit, total)
+	}
+}
@@ -0,0 +1,144 @@
+// +build linux
+
+package desync
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// FS_IOC_GETFLAGS and FS_IOC_SETFLAGS ioctls, _IOR('f', 1, long) and
+// _IOW('f', 2, long)
+const (
+	fsIocGetFlags = 2<<30 | unsafe.Sizeof(uintptr(0))<<16 | 'f'<<8 | 1
+	fsIocSetFlags = 1<<30 | unsafe.Sizeof(uintptr(0))<<16 | 'f'<<8 | 2
+)
+
+// Inode flags as set with chattr(1), see include/uapi/linux/fs.h
+const (
+	fsComprFl       = 0x00000004
+	fsSyncFl        = 0x00000008
+	fsImmutableFl   = 0x00000010
+	fsAppendFl      = 0x00000020
+	fsNoDumpFl      = 0x00000040
+	fsNoAtimeFl     = 0x00000080
+	fsNoCompFl      = 0x00000400
+	fsDirSyncFl     = 0x00010000
+	fsNoCowFl       = 0x00800000
+	fsProjInheritFl = 0x20000000
+)
+
+// Flags that can only be set with CAP_LINUX_IMMUTABLE
+const fsPrivilegedFl = fsImmutableFl | fsAppendFl
+
+// Inode flags and the feature flags they're encoded as in archives
+var chattrFlags = []struct {
+	fs uint32
+	ca uint64
+}{
+	{fsAppendFl, CaFormatWithFlagAppend},
+	{fsNoAtimeFl, CaFormatWithFlagNoAtime},
+	{fsComprFl, CaFormatWithFlagCompr},
+	{fsNoCowFl, CaFormatWithFlagNoCow},
+	{fsNoDumpFl, CaFormatWithFlagNoDump},
+	{fsDirSyncFl, CaFormatWithFlagDirSync},
+	{fsImmutableFl, CaFormatWithFlagImmutable},
+	{fsSyncFl, CaFormatWithFlagSync},
+	{fsNoCompFl, CaFormatWithFlagNoComp},
+	{fsProjInheritFl, CaFormatWithFlagProjectInherit},
+}
+
+// Reads the inode flags of a file or directory. Other types of files can't be
+// opened to read them, so they never have any. Returns 0 if the filesystem
+// doesn't support flags.
+func getAttrFlags(path string, info os.FileInfo) (uint32, error) {
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		return 0, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var flags int32
+	if err := ioctl(f.Fd(), fsIocGetFlags, uintptr(unsafe.Pointer(&flags))); err != nil {
+		if isAttrFlagsUnsupported(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return uint32(flags), nil
+}
+
+// Adds inode flags to a file or directory. Flags the filesystem doesn't
+// support are ignored. Without the privileges to set the immutable and
+// append-only flags, a warning is printed and only the others are set.
+func addAttrFlags(path string, flags uint32) error {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var current int32
+	if err := ioctl(f.Fd(), fsIocGetFlags, uintptr(unsafe.Pointer(&current))); err != nil {
+		if isAttrFlagsUnsupported(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "reading flags of %s", path)
+	}
+	if uint32(current)&flags == flags {
+		return nil
+	}
+	update := current | int32(flags)
+	err = ioctl(f.Fd(), fsIocSetFlags, uintptr(unsafe.Pointer(&update)))
+	if err == syscall.EPERM && flags&fsPrivilegedFl != 0 {
+		fmt.Fprintf(os.Stderr, "skipping immutable and append-only flags of '%s' : %s\n", path, err)
+		update = current | int32(flags&^fsPrivilegedFl)
+		if update == current {
+			return nil
+		}
+		err = ioctl(f.Fd(), fsIocSetFlags, uintptr(unsafe.Pointer(&update)))
+	}
+	if err != nil {
+		if isAttrFlagsUnsupported(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "setting flags of %s", path)
+	}
+	return nil
+}
+
+func isAttrFlagsUnsupported(err error) bool {
+	return err == syscall.ENOTTY || err == syscall.ENOTSUP || err == syscall.EINVAL
+}
+
+// Converts inode flags as returned by getAttrFlags to CaFormatWithFlag*
+// feature flags.
+func chattrFeatureFlags(fs uint32) uint64 {
+	var flags uint64
+	for _, f := range chattrFlags {
+		if fs&f.fs != 0 {
+			flags |= f.ca
+		}
+	}
+	return flags
+}
+
+// Sets the chattr(1) flags of a file or directory given as CaFormatWithFlag*
+// feature flags. Flags that are already set are left alone.
+func writeChattrFlags(path string, flags uint64) error {
+	var fs uint32
+	for _, f := range chattrFlags {
+		if flags&f.ca != 0 {
+			fs |= f.fs
+		}
+	}
+	if fs == 0 {
+		return nil
+	}
+	return addAttrFlags(path, fs)
+}
@@ -0,0 +1,16 @@
+// +build !linux
+
+package desync
+
+import "os"
+
+// Inode flags are only supported on Linux. Files never have any on other
+// platforms and flags in archives are ignored when extracting.
+
+const fsNoDumpFl = 0x00000040
+
+func getAttrFlags(path string, info os.FileInfo) (uint32, error) { return 0, nil }
+
+func chattrFeatureFlags(fs uint32) uint64 { return 0 }
+
+func writeChattrFlags(path string, flags uint64) error { return nil }
@@ -2,6 +2,8 @@ package desync
 
 import (
 	"fmt"
+	"log"
+	"sync"
 
 	"github.com/pkg/errors"
 )
@@ -11,19 +13,64 @@ import (
 // routed to the local store, and if that fails to the slower remote store.
 // Any chunks retrieved from the remote store will be stored in the local one.
 type Cache struct {
-	s Store
-	l WriteStore
+	s  Store
+	l  WriteStore
+	wb *cacheWriteBack
 }
 
+// Queue and workers used to populate the local store in the background.
+type cacheWriteBack struct {
+	queue  chan *Chunk
+	wg     sync.WaitGroup
+	logger *log.Logger
+
+	// Guards the queue from being used while it's being closed
+	mu     sync.RWMutex
+	closed bool
+	once   sync.Once
+}
+
+// Returned by a write-back cache after it's been closed.
+var errCacheClosed = errors.New("cache is closed")
+
 // NewCache returns a cache router that uses a local store as cache before
 // accessing a (supposedly slower) remote one.
 func NewCache(s Store, l WriteStore) Cache {
 	return Cache{s: s, l: l}
 }
 
+// NewWriteBackCache returns a cache router like NewCache, but chunks retrieved
+// from the remote store are written to the local one asynchronously by n
+// goroutines. Up to queueSize chunks can be waiting to be written, GetChunk
+// blocks when the queue is full. Errors writing to the local store are not
+// returned to the caller, they're written to logger instead which can be nil.
+// Close() needs to be called to flush any pending writes. The cache can't be
+// used after that.
+func NewWriteBackCache(s Store, l WriteStore, n, queueSize int, logger *log.Logger) Cache {
+	wb := &cacheWriteBack{
+		queue:  make(chan *Chunk, queueSize),
+		logger: logger,
+	}
+	for i := 0; i < n; i++ {
+		wb.wg.Add(1)
+		go func() {
+			for chunk := range wb.queue {
+				if err := l.StoreChunk(chunk); err != nil && wb.logger != nil {
+					wb.logger.Printf("failed to store chunk %s in local cache: %s", chunk.ID(), err)
+				}
+			}
+			wb.wg.Done()
+		}()
+	}
+	return Cache{s: s, l: l, wb: wb}
+}
+
 // GetChunk first asks the local store for the chunk and then the remote one.
 // If we get a chunk from the remote, it's stored locally too.
 func (c Cache) GetChunk(id ChunkID) (*Chunk, error) {
+	if c.wb.isClosed() {
+		return nil, errCacheClosed
+	}
 	chunk, err := c.l.GetChunk(id)
 	switch err.(type) {
 	case nil:
@@ -37,7 +84,11 @@ func (c Cache) GetChunk(id ChunkID) (*Chunk, error) {
 	if err != nil {
 		return chunk, err
 	}
-	// Got the chunk. Store it in the local cache for next time
+	// Got the chunk. Queue it up for the local cache if running in write-back mode
+	if c.wb != nil {
+		return chunk, c.wb.add(chunk)
+	}
+	// Store it in the local cache for next time
 	if err = c.l.StoreChunk(chunk); err != nil {
 		return chunk, errors.Wrap(err, "failed to store in local cache")
 	}
@@ -46,6 +97,9 @@ func (c Cache) GetChunk(id ChunkID) (*Chunk, error) {
 
 // HasChunk first checks the cache for the chunk, then the store.
 func (c Cache) HasChunk(id ChunkID) (bool, error) {
+	if c.wb.isClosed() {
+		return false, errCacheClosed
+	}
 	if hasChunk, err := c.l.HasChunk(id); err != nil || hasChunk {
 		return hasChunk, err
 	}
@@ -56,8 +110,60 @@ func (c Cache) String() string {
 	return fmt.Sprintf("store:%s with cache %s", c.s, c.l)
 }
 
-// Close the underlying writable chunk store
+// Close the underlying writable chunk store. In write-back mode, any pending
+// writes to the local store are completed first.
 func (c Cache) Close() error {
+	if c.wb != nil {
+		c.wb.close()
+	}
 	c.l.Close()
 	return c.s.Close()
 }
+
+// Queues a chunk to be written to the local store. The chunk is shared with
+// the caller, so the writers get their own with the ID and compressed data
+// already calculated.
+func (wb *cacheWriteBack) add(chunk *Chunk) error {
+	id := chunk.ID()
+	b, err := chunk.Compressed()
+	if err != nil {
+		if wb.logger != nil {
+			wb.logger.Printf("failed to store chunk %s in local cache: %s", id, err)
+		}
+		return nil
+	}
+	c, err := NewChunkWithID(id, nil, b, true)
+	if err != nil {
+		return err
+	}
+	wb.mu.RLock()
+	defer wb.mu.RUnlock()
+	if wb.closed {
+		return errCacheClosed
+	}
+	wb.queue <- c
+	return nil
+}
+
+// Returns true if the write-back queue has been closed. A nil queue is never
+// closed.
+func (wb *cacheWriteBack) isClosed() bool {
+	if wb == nil {
+		return false
+	}
+	wb.mu.RLock()
+	defer wb.mu.RUnlock()
+	return wb.closed
+}
+
+// Stops accepting new chunks and waits for the pending writes to complete. Can
+// be called more than once.
+func (wb *cacheWriteBack) close() {
+	wb.once.Do(func() {
+		wb.mu.Lock()
+		wb.closed = true
+		close(wb.queue)
+		wb.mu.Unlock()
+		wb.wg.Wait()
+	})
+}
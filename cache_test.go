@@ -0,0 +1,83 @@
+package desync
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestWriteBackCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local, err := NewLocalStore(dir, StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Put a chunk into the "remote" store
+	chunk := NewChunkFromUncompressed([]byte("some data"))
+	b, err := chunk.Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &TestStore{Chunks: map[ChunkID][]byte{chunk.ID(): b}}
+
+	c := NewWriteBackCache(remote, local, 2, 10, nil)
+	if _, err := c.GetChunk(chunk.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once closed, any pending writes should have been completed
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	hasChunk, err := local.HasChunk(chunk.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasChunk {
+		t.Fatal("chunk not written to the cache")
+	}
+
+	// Closing it again shouldn't panic, and it can't be used anymore
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetChunk(chunk.ID()); err == nil {
+		t.Fatal("expected error using a closed cache")
+	}
+}
+
+// Store that fails all writes, used to simulate a broken cache.
+type failingCacheStore struct {
+	TestStore
+}
+
+func (s *failingCacheStore) StoreChunk(*Chunk) error { return errors.New("failed") }
+
+func TestWriteBackCacheError(t *testing.T) {
+	chunk := NewChunkFromUncompressed([]byte("some data"))
+	b, err := chunk.Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &TestStore{Chunks: map[ChunkID][]byte{chunk.ID(): b}}
+	local := &failingCacheStore{}
+
+	// A failure to write to the cache should only be logged
+	buf := new(bytes.Buffer)
+	c := NewWriteBackCache(remote, local, 1, 1, log.New(buf, "", 0))
+	if _, err := c.GetChunk(chunk.ID()); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if buf.Len() == 0 {
+		t.Fatal("expected cache write error to be logged")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/folbricht/desync"
+)
+
+// Collects the remote stores that adjust their concurrency, so their stats can
+// be reported once a command is done.
+type adaptiveStores struct {
+	mu     sync.Mutex
+	stores []*desync.AdaptiveStore
+}
+
+// Wraps a remote store to adjust the number of concurrent requests to it,
+// starting with -n and going up to --adaptive-max.
+func (a *adaptiveStores) wrap(s desync.Store, cmdOpt cmdStoreOptions) desync.Store {
+	opt := desync.AdaptiveOptions{
+		Initial: cmdOpt.n,
+		Max:     cmdOpt.adaptiveMax,
+	}
+	var (
+		as  *desync.AdaptiveStore
+		ret desync.Store
+	)
+	if ws, ok := s.(desync.WriteStore); ok {
+		aws := desync.NewAdaptiveWriteStore(ws, opt)
+		as, ret = aws.AdaptiveStore, aws
+	} else {
+		as = desync.NewAdaptiveStore(s, opt)
+		ret = as
+	}
+	a.mu.Lock()
+	a.stores = append(a.stores, as)
+	a.mu.Unlock()
+	return ret
+}
+
+// Returns the stats of all stores with adaptive concurrency.
+func (a *adaptiveStores) stats() []desync.AdaptiveStats {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var stats []desync.AdaptiveStats
+	for _, s := range a.stores {
+		stats = append(stats, s.Stats())
+	}
+	return stats
+}
+
+// Stats printed by commands that don't have any of their own.
+type storeStats struct {
+	Stores []desync.AdaptiveStats `json:"stores"`
+}
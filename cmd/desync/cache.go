@@ -10,8 +10,9 @@ import (
 
 type cacheOptions struct {
 	cmdStoreOptions
-	stores []string
-	cache  string
+	stores     []string
+	cache      string
+	printStats bool
 }
 
 func newCacheCommand(ctx context.Context) *cobra.Command {
@@ -23,7 +24,9 @@ func newCacheCommand(ctx context.Context) *cobra.Command {
 		Long: `Read chunk IDs from caibx or caidx files from one or more stores without
 writing to disk. Can be used (with -c) to populate a store with desired chunks
 either to be used as cache, or to populate a store with chunks referenced in an
-index file. Use '-' to read (a single) index from STDIN.`,
+index file. Use '-' to read (a single) index from STDIN. With --adaptive, the
+number of concurrent requests to remote stores is adjusted between 1 and
+--adaptive-max based on latency, throughput and throttling by the store.`,
 		Example: `  desync cache -s http://192.168.1.1/ -c /path/to/local file.caibx`,
 		Args:    cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -34,7 +37,9 @@ index file. Use '-' to read (a single) index from STDIN.`,
 	flags := cmd.Flags()
 	flags.StringSliceVarP(&opt.stores, "store", "s", nil, "source store(s)")
 	flags.StringVarP(&opt.cache, "cache", "c", "", "target store")
+	flags.BoolVar(&opt.printStats, "print-stats", false, "print statistics of stores with adaptive concurrency")
 	addStoreOptions(&opt.cmdStoreOptions, flags)
+	addAdaptiveOptions(&opt.cmdStoreOptions, flags)
 	return cmd
 }
 
@@ -83,5 +88,11 @@ func runCache(ctx context.Context, opt cacheOptions, args []string) error {
 	pb := NewProgressBar("")
 
 	// Pull all the chunks, and load them into the cache in the process
-	return desync.Copy(ctx, ids, s, dst, opt.n, pb)
+	if err := desync.Copy(ctx, ids, s, dst, opt.requests(), pb); err != nil {
+		return err
+	}
+	if opt.printStats {
+		return printJSON(stdout, storeStats{Stores: opt.adaptiveStores.stats()})
+	}
+	return nil
 }
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"io"
 	"os"
@@ -15,6 +17,7 @@ type catOptions struct {
 	stores         []string
 	cache          string
 	offset, length int
+	digest         bool
 }
 
 func newCatCommand(ctx context.Context) *cobra.Command {
@@ -45,7 +48,10 @@ Use '-' to read the index from STDIN.`,
 	flags.StringVarP(&opt.cache, "cache", "c", "", "store to be used as cache")
 	flags.IntVarP(&opt.offset, "offset", "o", 0, "offset in bytes to seek to before reading")
 	flags.IntVarP(&opt.length, "length", "l", 0, "number of bytes to read")
+	flags.BoolVar(&opt.digest, "verify-digest", false, "verify the blob against the SHA-256 digest stored next to the index")
 	addStoreOptions(&opt.cmdStoreOptions, flags)
+	addIndexVerifyOptions(&opt.cmdStoreOptions, flags)
+	addCacheOptions(&opt.cmdStoreOptions, flags)
 	return cmd
 }
 
@@ -53,6 +59,9 @@ func runCat(ctx context.Context, opt catOptions, args []string) error {
 	if err := opt.cmdStoreOptions.validate(); err != nil {
 		return err
 	}
+	if opt.digest && (opt.offset > 0 || opt.length > 0) {
+		return errors.New("--verify-digest can't be used with --offset or --length")
+	}
 
 	var (
 		outFile io.Writer
@@ -88,6 +97,18 @@ func runCat(ctx context.Context, opt catOptions, args []string) error {
 		return err
 	}
 
+	// Read the expected digest of the blob and calculate it while writing
+	var (
+		expected []byte
+		hash     = sha256.New()
+	)
+	if opt.digest {
+		if expected, err = readBlobDigest(inFile, opt.cmdStoreOptions); err != nil {
+			return err
+		}
+		outFile = io.MultiWriter(outFile, hash)
+	}
+
 	// Write the output
 	readSeeker := desync.NewIndexReadSeeker(c, s)
 	if _, err = readSeeker.Seek(int64(opt.offset), io.SeekStart); err != nil {
@@ -99,5 +120,13 @@ func runCat(ctx context.Context, opt catOptions, args []string) error {
 	} else {
 		_, err = io.Copy(outFile, readSeeker)
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	if expected != nil {
+		if sum := hash.Sum(nil); !bytes.Equal(sum, expected) {
+			return desync.BlobDigestMismatch{Expected: expected, Actual: sum}
+		}
+	}
+	return nil
 }
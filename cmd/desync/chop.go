@@ -10,8 +10,10 @@ import (
 
 type chopOptions struct {
 	cmdStoreOptions
-	store         string
+	cmdReplicationOptions
+	stores        []string
 	ignoreIndexes []string
+	printStats    bool
 }
 
 func newChopCommand(ctx context.Context) *cobra.Command {
@@ -26,7 +28,10 @@ local or remote.
 Does not modify the input file or index in any. It's used to populate a chunk
 store by chopping up a file according to an existing index.
 
-Use '-' to read the index from STDIN.`,
+Use '-' to read the index from STDIN. With --adaptive, the number of concurrent
+requests to remote stores is adjusted between 1 and --adaptive-max based on
+latency, throughput and throttling by the store. Chunks are then read and
+compressed by --adaptive-max goroutines instead of -n.`,
 		Example: `  desync chop -s sftp://192.168.1.1/store file.caibx largefile.bin`,
 		Args:    cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -35,9 +40,12 @@ Use '-' to read the index from STDIN.`,
 		SilenceUsage: true,
 	}
 	flags := cmd.Flags()
-	flags.StringVarP(&opt.store, "store", "s", "", "target store")
+	flags.StringArrayVarP(&opt.stores, "store", "s", nil, "target store(s)")
 	flags.StringSliceVarP(&opt.ignoreIndexes, "ignore", "", nil, "index(s) to ignore chunks from")
 	addStoreOptions(&opt.cmdStoreOptions, flags)
+	flags.BoolVar(&opt.printStats, "print-stats", false, "print statistics of stores with adaptive concurrency")
+	addReplicationOptions(&opt.cmdReplicationOptions, flags)
+	addAdaptiveOptions(&opt.cmdStoreOptions, flags)
 	return cmd
 }
 
@@ -45,7 +53,7 @@ func runChop(ctx context.Context, opt chopOptions, args []string) error {
 	if err := opt.cmdStoreOptions.validate(); err != nil {
 		return err
 	}
-	if opt.store == "" {
+	if len(opt.stores) == 0 {
 		return errors.New("no target store provided")
 	}
 
@@ -53,7 +61,7 @@ func runChop(ctx context.Context, opt chopOptions, args []string) error {
 	dataFile := args[1]
 
 	// Open the target store
-	s, err := WritableStore(opt.store, opt.cmdStoreOptions)
+	s, err := replicatedWritableStore(opt.stores, opt.cmdReplicationOptions, opt.cmdStoreOptions)
 	if err != nil {
 		return err
 	}
@@ -90,6 +98,14 @@ func runChop(ctx context.Context, opt chopOptions, args []string) error {
 	// If this is a terminal, we want a progress bar
 	pb := NewProgressBar("")
 
-	// Chop up the file into chunks and store them in the target store
-	return desync.ChopFile(ctx, dataFile, chunks, s, opt.n, pb)
+	// Chop up the file into chunks and store them in the target store. The same
+	// workers read, compress and store chunks, so with --adaptive there need to be
+	// as many of them as requests can be made.
+	if err := desync.ChopFile(ctx, dataFile, chunks, s, opt.requests(), pb); err != nil {
+		return err
+	}
+	if opt.printStats {
+		return printJSON(stdout, storeStats{Stores: opt.adaptiveStores.stats()})
+	}
+	return nil
 }
@@ -62,3 +62,42 @@ func TestChopErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestChopReplicated(t *testing.T) {
+	store1, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(store1)
+	store2, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(store2)
+	tmp, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	journal := filepath.Join(tmp, "journal")
+
+	cmd := newChopCommand(context.Background())
+	cmd.SetArgs([]string{"-s", store1, "-s", store2, "--journal", journal, "testdata/blob1.caibx", "testdata/blob1"})
+	stderr = ioutil.Discard
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+
+	// Both stores should have the same chunks now
+	for _, store := range []string{store1, store2} {
+		verifyCmd := newVerifyCommand(context.Background())
+		verifyCmd.SetArgs([]string{"-s", store})
+		_, err = verifyCmd.ExecuteC()
+		require.NoError(t, err)
+
+		extractCmd := newExtractCommand(context.Background())
+		out := filepath.Join(tmp, "blob1")
+		extractCmd.SetArgs([]string{"-s", store, "testdata/blob1.caibx", out})
+		_, err = extractCmd.ExecuteC()
+		require.NoError(t, err)
+	}
+
+	// There were no failures, so the journal should be empty
+	b, err := ioutil.ReadFile(journal)
+	require.NoError(t, err)
+	require.Empty(t, b)
+}
@@ -61,6 +61,7 @@ needs to be chosen carefully if the server is under high load.
 	flags.BoolVarP(&opt.uncompressed, "uncompressed", "u", false, "serve uncompressed chunks")
 	flags.StringVar(&opt.logFile, "log", "", "request log file or - for STDOUT")
 	addStoreOptions(&opt.cmdStoreOptions, flags)
+	addCacheOptions(&opt.cmdStoreOptions, flags)
 	addServerOptions(&opt.cmdServerOptions, flags)
 	return cmd
 }
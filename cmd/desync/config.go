@@ -35,6 +35,10 @@ type Config struct {
 	HTTPErrorRetry int                            `json:"http-error-retry,omitempty"`
 	S3Credentials  map[string]S3Creds             `json:"s3-credentials"`
 	StoreOptions   map[string]desync.StoreOptions `json:"store-options"`
+
+	// Public key files used to verify index signatures. If set, only indexes
+	// signed with one of these keys are trusted.
+	IndexVerifyKeys []string `json:"index-verify-keys,omitempty"`
 }
 
 // GetS3CredentialsFor attempts to find creds and region for an S3 location in the
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/folbricht/desync"
+	"github.com/spf13/cobra"
+)
+
+type diffOptions struct {
+	cmdStoreOptions
+	printFormat string
+}
+
+func newDiffCommand(ctx context.Context) *cobra.Command {
+	var opt diffOptions
+
+	cmd := &cobra.Command{
+		Use:   "diff <index-a> <index-b>",
+		Short: "Show the differences between two indexes",
+		Long: `Compares the chunks of two indexes and shows how many chunks and bytes they
+share, which were added in the second and which were removed from the first.
+It also lists the byte ranges in the blob of the second index that differ from
+the first, and an estimate of how much data needs to be downloaded to update a
+blob from the first to the second index. The download size is based on the
+uncompressed size of the chunks. Use '-' to read one of the indexes from STDIN.`,
+		Example: `  desync diff --format=plain image-v1.caibx image-v2.caibx`,
+		Args:    cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runDiff(ctx, opt, args)
+		},
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	flags.StringVarP(&opt.printFormat, "format", "f", "json", "output format, plain or json")
+	addStoreOptions(&opt.cmdStoreOptions, flags)
+	return cmd
+}
+
+// Range of bytes in a blob
+type diffRange struct {
+	Start uint64 `json:"start"`
+	Size  uint64 `json:"size"`
+}
+
+type diffResults struct {
+	SizeA         uint64      `json:"size-a"`
+	SizeB         uint64      `json:"size-b"`
+	SharedChunks  int         `json:"shared-chunks"`
+	SharedBytes   uint64      `json:"shared-bytes"`
+	AddedChunks   int         `json:"added-chunks"`
+	AddedBytes    uint64      `json:"added-bytes"`
+	RemovedChunks int         `json:"removed-chunks"`
+	RemovedBytes  uint64      `json:"removed-bytes"`
+	ChangedBytes  uint64      `json:"changed-bytes"`
+	ChangedRanges []diffRange `json:"changed-ranges"`
+	DownloadSize  uint64      `json:"download-size"`
+}
+
+func runDiff(ctx context.Context, opt diffOptions, args []string) error {
+	if err := opt.cmdStoreOptions.validate(); err != nil {
+		return err
+	}
+
+	a, err := readCaibxFile(args[0], opt.cmdStoreOptions)
+	if err != nil {
+		return err
+	}
+	b, err := readCaibxFile(args[1], opt.cmdStoreOptions)
+	if err != nil {
+		return err
+	}
+
+	results := diffIndexes(a, b)
+
+	switch opt.printFormat {
+	case "json":
+		if err := printJSON(stdout, results); err != nil {
+			return err
+		}
+	case "plain":
+		fmt.Fprintln(stdout, "Blob size A:", results.SizeA)
+		fmt.Fprintln(stdout, "Blob size B:", results.SizeB)
+		fmt.Fprintln(stdout, "Shared chunks:", results.SharedChunks)
+		fmt.Fprintln(stdout, "Shared bytes:", results.SharedBytes)
+		fmt.Fprintln(stdout, "Added chunks:", results.AddedChunks)
+		fmt.Fprintln(stdout, "Added bytes:", results.AddedBytes)
+		fmt.Fprintln(stdout, "Removed chunks:", results.RemovedChunks)
+		fmt.Fprintln(stdout, "Removed bytes:", results.RemovedBytes)
+		fmt.Fprintln(stdout, "Changed bytes:", results.ChangedBytes)
+		fmt.Fprintln(stdout, "Download size:", results.DownloadSize)
+		fmt.Fprintln(stdout, "Changed ranges:")
+		for _, r := range results.ChangedRanges {
+			fmt.Fprintf(stdout, "  %d-%d (%d bytes)\n", r.Start, r.Start+r.Size, r.Size)
+		}
+	default:
+		return fmt.Errorf("unsupported output format '%s', expected plain or json", opt.printFormat)
+	}
+	return nil
+}
+
+// Compare the chunks in two indexes. Shared, added and removed chunks are counted
+// once even if they appear multiple times in an index.
+func diffIndexes(a, b desync.Index) diffResults {
+	var results diffResults
+	results.SizeA = indexBlobSize(a)
+	results.SizeB = indexBlobSize(b)
+
+	// Build a list of unique chunks in both indexes with their sizes
+	inA := make(map[desync.ChunkID]uint64)
+	for _, c := range a.Chunks {
+		inA[c.ID] = c.Size
+	}
+	inB := make(map[desync.ChunkID]uint64)
+	for _, c := range b.Chunks {
+		inB[c.ID] = c.Size
+	}
+
+	for id, size := range inB {
+		if _, ok := inA[id]; ok {
+			results.SharedChunks++
+			results.SharedBytes += size
+			continue
+		}
+		results.AddedChunks++
+		results.AddedBytes += size
+	}
+	for id, size := range inA {
+		if _, ok := inB[id]; !ok {
+			results.RemovedChunks++
+			results.RemovedBytes += size
+		}
+	}
+
+	// Only chunks that are new need to be downloaded, and only once
+	results.DownloadSize = results.AddedBytes
+
+	// Go through the chunks of B in order and merge the ranges of adjacent chunks
+	// not present in A
+	results.ChangedRanges = []diffRange{}
+	for _, c := range b.Chunks {
+		if _, ok := inA[c.ID]; ok {
+			continue
+		}
+		results.ChangedBytes += c.Size
+		if n := len(results.ChangedRanges); n > 0 {
+			last := &results.ChangedRanges[n-1]
+			if last.Start+last.Size == c.Start {
+				last.Size += c.Size
+				continue
+			}
+		}
+		results.ChangedRanges = append(results.ChangedRanges, diffRange{Start: c.Start, Size: c.Size})
+	}
+	return results
+}
+
+// Returns the size of the blob referenced by an index.
+func indexBlobSize(idx desync.Index) uint64 {
+	if len(idx.Chunks) == 0 {
+		return 0
+	}
+	last := idx.Chunks[len(idx.Chunks)-1]
+	return last.Start + last.Size
+}
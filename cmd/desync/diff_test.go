@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffCommand(t *testing.T) {
+	cmd := newDiffCommand(context.Background())
+	cmd.SetArgs([]string{"testdata/blob1.caibx", "testdata/blob2.caibx"})
+	b := new(bytes.Buffer)
+
+	// Redirect the command's output
+	stdout = b
+	cmd.SetOutput(ioutil.Discard)
+	_, err := cmd.ExecuteC()
+	require.NoError(t, err)
+
+	var got diffResults
+	err = json.Unmarshal(b.Bytes(), &got)
+	require.NoError(t, err)
+
+	require.Equal(t, uint64(2097152), got.SizeB)
+	require.Equal(t, 124, got.SharedChunks)
+	require.Equal(t, 7, got.AddedChunks)
+	require.Equal(t, 7, got.RemovedChunks)
+	require.Equal(t, uint64(80029), got.DownloadSize)
+
+	// The changed ranges should add up to the changed bytes
+	var total uint64
+	for _, r := range got.ChangedRanges {
+		total += r.Size
+	}
+	require.Equal(t, got.ChangedBytes, total)
+}
+
+func TestDiffCommandSameIndex(t *testing.T) {
+	cmd := newDiffCommand(context.Background())
+	cmd.SetArgs([]string{"testdata/blob1.caibx", "testdata/blob1.caibx"})
+	b := new(bytes.Buffer)
+	stdout = b
+	cmd.SetOutput(ioutil.Discard)
+	_, err := cmd.ExecuteC()
+	require.NoError(t, err)
+
+	var got diffResults
+	err = json.Unmarshal(b.Bytes(), &got)
+	require.NoError(t, err)
+	require.Zero(t, got.AddedChunks)
+	require.Zero(t, got.RemovedChunks)
+	require.Empty(t, got.ChangedRanges)
+	require.Zero(t, got.DownloadSize)
+}
@@ -0,0 +1,102 @@
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/folbricht/desync"
+	"github.com/spf13/cobra"
+)
+
+type exportTarOptions struct {
+	cmdStoreOptions
+	stores    []string
+	cache     string
+	readIndex bool
+}
+
+func newExportTarCommand(ctx context.Context) *cobra.Command {
+	var opt exportTarOptions
+
+	cmd := &cobra.Command{
+		Use:   "export-tar <catar|index> <output>",
+		Short: "Convert a catar archive or index to a tar file",
+		Long: `Converts a catar archive or the archive an index refers to into a tar file in
+PAX format, without extracting it to disk. Use '-' to read the catar or index
+from STDIN, or to write the tar file to STDOUT.
+
+Ownership is stored with both numeric IDs and names. Extended attributes and
+file capabilities are stored as SCHILY.xattr records, ACLs as SCHILY.acl records
+and SELinux labels as RHT.security.selinux records, which GNU tar restores with
+--xattrs, --acls and --selinux. Sockets can't be stored in tar files and are
+left out.`,
+		Example: `  desync export-tar docs.catar docs.tar
+  desync export-tar -s http://192.168.1.1/ -i docs.caidx - | gzip > docs.tar.gz`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runExportTar(ctx, opt, args)
+		},
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	flags.StringSliceVarP(&opt.stores, "store", "s", nil, "source store(s), used with -i")
+	flags.StringVarP(&opt.cache, "cache", "c", "", "store to be used as cache")
+	flags.BoolVarP(&opt.readIndex, "index", "i", false, "read index file (caidx), not catar")
+	addStoreOptions(&opt.cmdStoreOptions, flags)
+	addIndexVerifyOptions(&opt.cmdStoreOptions, flags)
+	addCacheOptions(&opt.cmdStoreOptions, flags)
+	return cmd
+}
+
+func runExportTar(ctx context.Context, opt exportTarOptions, args []string) error {
+	if err := opt.cmdStoreOptions.validate(); err != nil {
+		return err
+	}
+	if opt.readIndex && len(opt.stores) == 0 {
+		return errors.New("-i requires at least one store (-s <location>)")
+	}
+
+	input := args[0]
+	output := args[1]
+
+	var w io.Writer
+	if output == "-" {
+		w = os.Stdout
+	} else {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	// If we got a catar file convert that and exit
+	if !opt.readIndex {
+		if input == "-" {
+			return desync.ExportTar(ctx, w, os.Stdin)
+		}
+		f, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return desync.ExportTar(ctx, w, f)
+	}
+
+	s, err := MultiStoreWithCache(opt.cmdStoreOptions, opt.cache, opt.stores...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	index, err := readCaibxFile(input, opt.cmdStoreOptions)
+	if err != nil {
+		return err
+	}
+	return desync.ExportTarIndex(ctx, w, index, s, opt.n, NewProgressBar("Exporting "))
+}
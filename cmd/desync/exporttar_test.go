@@ -0,0 +1,43 @@
+// +build !windows
+
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportTarCommandIndex(t *testing.T) {
+	out, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(out)
+	tarFile := filepath.Join(out, "tree.tar")
+
+	// Convert the archive in a caidx into a tar file
+	cmd := newExportTarCommand(context.Background())
+	cmd.SetArgs([]string{"-s", "testdata/tree.store", "-i", "testdata/tree.caidx", tarFile})
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+
+	f, err := os.Open(tarFile)
+	require.NoError(t, err)
+	defer f.Close()
+	tr := tar.NewReader(f)
+	var entries int
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		entries++
+	}
+	require.NotZero(t, entries)
+}
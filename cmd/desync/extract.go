@@ -14,12 +14,21 @@ import (
 
 type extractOptions struct {
 	cmdStoreOptions
-	stores     []string
-	cache      string
-	seeds      []string
-	seedDirs   []string
-	inPlace    bool
-	printStats bool
+	stores      []string
+	cache       string
+	seeds       []string
+	seedFiles   []string
+	seedDirs    []string
+	seedCache   string
+	inPlace     bool
+	printStats  bool
+	dryRun      bool
+	journal     string
+	forceVerify bool
+	zeroOut     bool
+	digest      bool
+	fetchers    int
+	fetchMemory int
 }
 
 func newExtractCommand(ctx context.Context) *cobra.Command {
@@ -32,14 +41,38 @@ func newExtractCommand(ctx context.Context) *cobra.Command {
 When using -k, the blob will be extracted in-place utilizing existing data and
 the target file will not be deleted on error. This can be used to restart a
 failed prior extraction without having to retrieve completed chunks again.
+Progress of in-place extracts is recorded in a journal file next to the target
+(or in the file given with --journal, required for block devices). When the
+extract is restarted, the journal is only used if the size and modification
+time of the target haven't changed since it was written. Of regular files, only
+the first and last chunk of each completed range are then read and verified
+again, block devices are verified completely. Use --force-verify to ignore the
+journal. Ranges
+of null chunks are deallocated in existing files to keep them sparse. For block
+devices, --zero-out can be used to zero them out with BLKZEROOUT which allows
+the device to deallocate them.
 Muptiple optional seed indexes can be given with -seed. The matching blob needs
-to have the same name as the indexfile without the .caibx extension. If several
+to have the same name as the indexfile without the .caibx extension. Plain files
+or block devices without index can be given with --seed-file, they're chunked
+before the extract. Use --seed-index-cache to keep the indexes of chunked seed
+files in a directory to avoid chunking them again in later runs. If several
 seed files and indexes are available, the -seed-dir option can be used to
 automatically select call .caibx files in a directory as seeds. Use '-' to read
-the index from STDIN.`,
+the index from STDIN. With --dry-run, nothing is written. Instead, a plan is
+printed in JSON format showing which ranges would come from seeds, which chunks
+need to be read from the store and how much of that is already in the cache.
+The blob is written by -n goroutines. Chunks are requested from the store ahead
+of them by --fetch-concurrency goroutines, holding up to --fetch-memory MiB of
+chunk data that hasn't been written yet. For stores with high latency, increase
+--fetch-concurrency rather than -n. With --adaptive, the number of concurrent
+requests to remote stores is adjusted during the extract, between 1 and
+--adaptive-max, based on latency, throughput and throttling by the store.`,
 		Example: `  desync extract -s http://192.168.1.1/ -c /path/to/local file.caibx largefile.bin
   desync extract -s /mnt/store -s /tmp/other/store file.tar.caibx file.tar
-  desync extract -s /mnt/store --seed /mnt/v1.caibx v2.caibx v2.vmdk`,
+  desync extract -s /mnt/store --seed /mnt/v1.caibx v2.caibx v2.vmdk
+  desync extract -s /mnt/store --seed-file /mnt/v1.vmdk v2.caibx v2.vmdk
+  desync extract --adaptive --print-stats -s s3+https://s3.example.com/store file.caibx largefile.bin
+  desync extract --dry-run -c /path/to/local --seed /mnt/v1.caibx v2.caibx v2.vmdk`,
 		Args: cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return runExtract(ctx, opt, args)
@@ -49,11 +82,23 @@ the index from STDIN.`,
 	flags := cmd.Flags()
 	flags.StringSliceVarP(&opt.stores, "store", "s", nil, "source store(s)")
 	flags.StringSliceVar(&opt.seeds, "seed", nil, "seed indexes")
+	flags.StringSliceVar(&opt.seedFiles, "seed-file", nil, "seed files or block devices without index")
 	flags.StringSliceVar(&opt.seedDirs, "seed-dir", nil, "directory with seed index files")
+	flags.StringVar(&opt.seedCache, "seed-index-cache", "", "directory to cache indexes of seed files without index")
 	flags.StringVarP(&opt.cache, "cache", "c", "", "store to be used as cache")
 	flags.BoolVarP(&opt.inPlace, "in-place", "k", false, "extract the file in place and keep it in case of error")
+	flags.StringVar(&opt.journal, "journal", "", "journal file used to resume in-place extracts")
+	flags.BoolVar(&opt.forceVerify, "force-verify", false, "verify all data in the target, ignoring the journal")
+	flags.BoolVar(&opt.zeroOut, "zero-out", false, "zero out null chunk ranges on block devices instead of writing them")
 	flags.BoolVarP(&opt.printStats, "print-stats", "", false, "print statistics")
+	flags.IntVar(&opt.fetchers, "fetch-concurrency", 0, "number of concurrent chunk requests to the store (default same as -n)")
+	flags.IntVar(&opt.fetchMemory, "fetch-memory", desync.DefaultFetchMemory>>20, "MiB of chunk data to fetch from the store ahead of the writers")
+	flags.BoolVar(&opt.digest, "verify-digest", false, "verify the blob against the SHA-256 digest stored next to the index")
+	flags.BoolVar(&opt.dryRun, "dry-run", false, "print a transfer plan without writing the output")
 	addStoreOptions(&opt.cmdStoreOptions, flags)
+	addIndexVerifyOptions(&opt.cmdStoreOptions, flags)
+	addCacheOptions(&opt.cmdStoreOptions, flags)
+	addAdaptiveOptions(&opt.cmdStoreOptions, flags)
 	return cmd
 }
 
@@ -68,6 +113,10 @@ func runExtract(ctx context.Context, opt extractOptions, args []string) error {
 		return errors.New("input and output filenames match")
 	}
 
+	if opt.dryRun {
+		return runExtractPlan(ctx, opt, inFile, outFile)
+	}
+
 	// Checkout the store
 	if len(opt.stores) == 0 {
 		return errors.New("no store provided")
@@ -88,7 +137,7 @@ func runExtract(ctx context.Context, opt extractOptions, args []string) error {
 	}
 
 	// Build a list of seeds if any were given in the command line
-	seeds, err := readSeeds(outFile, opt.seeds, opt.cmdStoreOptions)
+	seeds, err := readSeeds(ctx, outFile, idx, opt)
 	if err != nil {
 		return err
 	}
@@ -100,22 +149,74 @@ func runExtract(ctx context.Context, opt extractOptions, args []string) error {
 	}
 	seeds = append(seeds, dSeeds...)
 
+	// Read the expected digest of the blob if it's to be verified
+	assembleOpt := desync.AssembleOptions{
+		FetchConcurrency: opt.fetchers,
+		FetchMemory:      int64(opt.fetchMemory) << 20,
+	}
+	if opt.adaptive && opt.fetchers == 0 {
+		assembleOpt.FetchConcurrency = opt.requests()
+	}
+	if opt.digest {
+		if assembleOpt.Digest, err = readBlobDigest(inFile, opt.cmdStoreOptions); err != nil {
+			return err
+		}
+	}
+
 	var stats *desync.ExtractStats
 	if opt.inPlace {
-		stats, err = writeInplace(ctx, outFile, idx, s, seeds, opt.n)
+		assembleOpt.Journal = extractJournalFile(outFile, opt.journal)
+		assembleOpt.ForceVerify = opt.forceVerify
+		assembleOpt.ZeroOutDevice = opt.zeroOut
+		stats, err = writeInplace(ctx, outFile, idx, s, seeds, opt.n, assembleOpt)
 	} else {
-		stats, err = writeWithTmpFile(ctx, outFile, idx, s, seeds, opt.n)
+		stats, err = writeWithTmpFile(ctx, outFile, idx, s, seeds, opt.n, assembleOpt)
 	}
 	if err != nil {
 		return err
 	}
 	if opt.printStats {
+		stats.Stores = opt.adaptiveStores.stats()
 		return printJSON(stdout, stats)
 	}
 	return nil
 }
 
-func writeWithTmpFile(ctx context.Context, name string, idx desync.Index, s desync.Store, seeds []desync.Seed, n int) (*desync.ExtractStats, error) {
+// Builds and prints the plan for an extract without writing anything. No store is
+// needed, only the cache is queried for chunks if one was provided.
+func runExtractPlan(ctx context.Context, opt extractOptions, inFile, outFile string) error {
+	idx, err := readCaibxFile(inFile, opt.cmdStoreOptions)
+	if err != nil {
+		return err
+	}
+	seeds, err := readSeeds(ctx, outFile, idx, opt)
+	if err != nil {
+		return err
+	}
+	dSeeds, err := readSeedDirs(outFile, inFile, opt.seedDirs, opt.cmdStoreOptions)
+	if err != nil {
+		return err
+	}
+	seeds = append(seeds, dSeeds...)
+
+	var cache desync.Store
+	if opt.cache != "" {
+		c, err := storeFromLocation(opt.cache, opt.cmdStoreOptions)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		cache = c
+	}
+
+	plan, err := desync.PlanExtract(ctx, outFile, idx, cache, seeds)
+	if err != nil {
+		return err
+	}
+	return printJSON(stdout, plan)
+}
+
+func writeWithTmpFile(ctx context.Context, name string, idx desync.Index, s desync.Store, seeds []desync.Seed, n int, opt desync.AssembleOptions) (*desync.ExtractStats, error) {
 	// Prepare a tempfile that'll hold the output during processing. Close it, we
 	// just need the name here since it'll be opened multiple times during write.
 	// Also make sure it gets removed regardless of any errors below.
@@ -128,7 +229,7 @@ func writeWithTmpFile(ctx context.Context, name string, idx desync.Index, s desy
 	defer os.Remove(tmp.Name())
 
 	// Build the blob from the chunks, writing everything into the tempfile
-	if stats, err = writeInplace(ctx, tmp.Name(), idx, s, seeds, n); err != nil {
+	if stats, err = writeInplace(ctx, tmp.Name(), idx, s, seeds, n, opt); err != nil {
 		return stats, err
 	}
 
@@ -136,16 +237,32 @@ func writeWithTmpFile(ctx context.Context, name string, idx desync.Index, s desy
 	return stats, os.Rename(tmp.Name(), name)
 }
 
-func writeInplace(ctx context.Context, name string, idx desync.Index, s desync.Store, seeds []desync.Seed, n int) (*desync.ExtractStats, error) {
+func writeInplace(ctx context.Context, name string, idx desync.Index, s desync.Store, seeds []desync.Seed, n int, opt desync.AssembleOptions) (*desync.ExtractStats, error) {
 	pb := NewProgressBar("")
 
 	// Build the blob from the chunks, writing everything into given filename
-	return desync.AssembleFile(ctx, name, idx, s, seeds, n, pb)
+	return desync.AssembleFile(ctx, name, idx, s, seeds, n, opt, pb)
 }
 
-func readSeeds(dstFile string, locations []string, opts cmdStoreOptions) ([]desync.Seed, error) {
+// Returns the name of the journal for an in-place extract. Unless one was given,
+// it's a hidden file next to the target. Block devices don't get a journal by
+// default since there's no good place to put it.
+func extractJournalFile(name, journal string) string {
+	if journal != "" {
+		return journal
+	}
+	if info, err := os.Stat(name); err == nil && info.Mode()&os.ModeDevice != 0 {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+".journal")
+}
+
+func readSeeds(ctx context.Context, dstFile string, idx desync.Index, opt extractOptions) ([]desync.Seed, error) {
+	// Seeds are local and typically not signed, don't verify their indexes
+	opts := opt.cmdStoreOptions
+	opts.skipIndexVerify = true
 	var seeds []desync.Seed
-	for _, srcIndexFile := range locations {
+	for _, srcIndexFile := range opt.seeds {
 		srcIndex, err := readCaibxFile(srcIndexFile, opts)
 		if err != nil {
 			return nil, err
@@ -158,10 +275,20 @@ func readSeeds(dstFile string, locations []string, opts cmdStoreOptions) ([]desy
 		}
 		seeds = append(seeds, seed)
 	}
+	// Chunk seeds that come without index
+	for _, srcFile := range opt.seedFiles {
+		seed, err := readRawSeed(ctx, dstFile, srcFile, idx, opt.seedCache, opt.n)
+		if err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, seed)
+	}
 	return seeds, nil
 }
 
 func readSeedDirs(dstFile, dstIdxFile string, dirs []string, opts cmdStoreOptions) ([]desync.Seed, error) {
+	// Seeds are local and typically not signed, don't verify their indexes
+	opts.skipIndexVerify = true
 	var seeds []desync.Seed
 	absIn, err := filepath.Abs(dstIdxFile)
 	if err != nil {
@@ -1,14 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/hex"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 
+	"github.com/folbricht/desync"
+	"github.com/spf13/cobra"
 	"github.com/stretchr/testify/require"
 )
 
@@ -32,6 +39,11 @@ func TestExtractCommand(t *testing.T) {
 	require.NoError(t, err)
 	defer os.RemoveAll(cacheDir)
 
+	// Make a dir for indexes of raw seeds
+	seedCacheDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(seedCacheDir)
+
 	for _, test := range []struct {
 		name   string
 		args   []string
@@ -47,10 +59,16 @@ func TestExtractCommand(t *testing.T) {
 			[]string{"--store", "testdata/blob1.store", "--seed", "testdata/blob2.caibx", "testdata/blob1.caibx"}, out1},
 		{"extract with multi seed",
 			[]string{"-s", "testdata/blob1.store", "--seed", "testdata/blob2.caibx", "--seed", "testdata/blob1.caibx", "testdata/blob1.caibx"}, out1},
+		{"extract with raw seed",
+			[]string{"--store", "testdata/blob1.store", "--seed-file", "testdata/blob2", "testdata/blob1.caibx"}, out1},
+		{"extract with cached raw seed index",
+			[]string{"--store", "testdata/blob1.store", "--seed-file", "testdata/blob2", "--seed-index-cache", seedCacheDir, "testdata/blob1.caibx"}, out1},
 		{"extract with seed directory",
 			[]string{"-s", "testdata/blob1.store", "--seed-dir", "testdata", "testdata/blob1.caibx"}, out1},
 		{"extract with cache",
 			[]string{"-s", "testdata/blob1.store", "-c", cacheDir, "testdata/blob1.caibx"}, out1},
+		{"extract with write-back cache",
+			[]string{"-s", "testdata/blob1.store", "-c", cacheDir, "--cache-write-back", "10", "testdata/blob1.caibx"}, out1},
 		{"extract with multiple stores",
 			[]string{"-s", "testdata/blob2.store", "-s", "testdata/blob1.store", "testdata/blob1.caibx"}, out1},
 		{"extract with multiple stores and cache",
@@ -96,3 +114,277 @@ func TestExtractWithFailover(t *testing.T) {
 	_, err = cmd.ExecuteC()
 	require.NoError(t, err)
 }
+
+func TestExtractSignedIndex(t *testing.T) {
+	outDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(outDir)
+	index := filepath.Join(outDir, "blob1.caibx")
+	out := filepath.Join(outDir, "out")
+	store := filepath.Join(outDir, "store")
+	require.NoError(t, os.Mkdir(store, 0755))
+
+	// Make a signed index
+	makeCmd := newMakeCommand(context.Background())
+	makeCmd.SetArgs([]string{"-s", store, "--sign-key", "testdata/index-sign.key", index, "testdata/blob1"})
+	stderr = ioutil.Discard
+	makeCmd.SetOutput(ioutil.Discard)
+	_, err = makeCmd.ExecuteC()
+	require.NoError(t, err)
+	_, err = os.Stat(index + ".sig")
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		name  string
+		key   string
+		index string
+		fail  bool
+	}{
+		{"valid signature", "testdata/index-sign.key.pub", index, false},
+		{"wrong key", "testdata/index-other.key.pub", index, true},
+		{"unsigned index", "testdata/index-sign.key.pub", "testdata/blob1.caibx", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cmd := newExtractCommand(context.Background())
+			cmd.SetArgs([]string{"-s", store, "-s", "testdata/blob1.store", "--verify-key", test.key, test.index, out})
+			cmd.SetOutput(ioutil.Discard)
+			_, err := cmd.ExecuteC()
+			if test.fail {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestExtractDryRun(t *testing.T) {
+	outDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(outDir)
+	out := filepath.Join(outDir, "out")
+
+	cmd := newExtractCommand(context.Background())
+	cmd.SetArgs([]string{"--dry-run", "-c", "testdata/blob1.store", "--seed", "testdata/blob2.caibx", "testdata/blob1.caibx", out})
+	b := new(bytes.Buffer)
+	stdout = b
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+
+	// Nothing should have been written
+	_, err = os.Stat(out)
+	require.True(t, os.IsNotExist(err))
+
+	// All chunks from the store are in the cache, nothing to download
+	var plan desync.ExtractPlan
+	require.NoError(t, json.Unmarshal(b.Bytes(), &plan))
+	require.Equal(t, 161, plan.ChunksTotal)
+	require.Equal(t, uint64(plan.ChunksTotal), plan.ChunksFromSeeds+plan.ChunksFromStore)
+	require.NotZero(t, plan.ChunksFromSeeds)
+	require.Equal(t, plan.UniqueChunksFromStore, plan.ChunksInCache)
+	require.Zero(t, plan.BytesToDownload)
+}
+
+func TestExtractRawSeedCache(t *testing.T) {
+	outDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(outDir)
+	out := filepath.Join(outDir, "out")
+	seedCacheDir := filepath.Join(outDir, "seeds")
+	require.NoError(t, os.Mkdir(seedCacheDir, 0755))
+
+	// Extract twice, the index of the seed is cached in the first run and should
+	// be re-used in the second
+	for i := 0; i < 2; i++ {
+		cmd := newExtractCommand(context.Background())
+		cmd.SetArgs([]string{"-s", "testdata/blob1.store", "--seed-file", "testdata/blob2", "--seed-index-cache", seedCacheDir, "--print-stats", "testdata/blob1.caibx", out})
+		b := new(bytes.Buffer)
+		stdout = b
+		stderr = ioutil.Discard
+		cmd.SetOutput(ioutil.Discard)
+		_, err = cmd.ExecuteC()
+		require.NoError(t, err)
+
+		var stats desync.ExtractStats
+		require.NoError(t, json.Unmarshal(b.Bytes(), &stats))
+		require.NotZero(t, stats.ChunksFromSeeds)
+
+		cached, err := filepath.Glob(filepath.Join(seedCacheDir, "*.caibx"))
+		require.NoError(t, err)
+		require.Len(t, cached, 1)
+	}
+}
+
+func TestExtractJournal(t *testing.T) {
+	outDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(outDir)
+	out := filepath.Join(outDir, "out")
+	journal := filepath.Join(outDir, ".out.journal")
+
+	// Build a store with only the first few chunks of the index
+	partial := filepath.Join(outDir, "store")
+	require.NoError(t, os.Mkdir(partial, 0755))
+	src, err := desync.NewLocalStore("testdata/blob1.store", desync.StoreOptions{})
+	require.NoError(t, err)
+	dst, err := desync.NewLocalStore(partial, desync.StoreOptions{})
+	require.NoError(t, err)
+	idx, err := readCaibxFile("testdata/blob1.caibx", cmdStoreOptions{})
+	require.NoError(t, err)
+	for _, c := range idx.Chunks[:10] {
+		chunk, err := src.GetChunk(c.ID)
+		require.NoError(t, err)
+		require.NoError(t, dst.StoreChunk(chunk))
+	}
+
+	// Extract in-place from the store that doesn't have all chunks. That should
+	// fail and leave a journal behind.
+	cmd := newExtractCommand(context.Background())
+	cmd.SetArgs([]string{"-k", "-n", "1", "-s", partial, "testdata/blob1.caibx", out})
+	stderr = ioutil.Discard
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.Error(t, err)
+	_, err = os.Stat(journal)
+	require.NoError(t, err)
+
+	// Resume with the complete store, chunks in the journal don't need to be read
+	cmd = newExtractCommand(context.Background())
+	cmd.SetArgs([]string{"-k", "-s", "testdata/blob1.store", "--print-stats", "testdata/blob1.caibx", out})
+	b := new(bytes.Buffer)
+	stdout = b
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+
+	var stats desync.ExtractStats
+	require.NoError(t, json.Unmarshal(b.Bytes(), &stats))
+	require.NotZero(t, stats.ChunksFromJournal)
+
+	// Compare to what we should have gotten, the journal should be gone
+	expected, err := ioutil.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+	got, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, expected, got)
+	_, err = os.Stat(journal)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestExtractDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	index := filepath.Join(dir, "blob1.caibx")
+	out := filepath.Join(dir, "out")
+	store := filepath.Join(dir, "store")
+	require.NoError(t, os.Mkdir(store, 0755))
+
+	// Make an index with a digest of the blob next to it. Both should be stored
+	// when the stats are printed as well.
+	cmd := newMakeCommand(context.Background())
+	cmd.SetArgs([]string{"--digest", "--print-stats", "-s", store, index, "testdata/blob1"})
+	stderr = ioutil.Discard
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+	_, err = os.Stat(index)
+	require.NoError(t, err)
+	sum, err := desync.BlobDigest(context.Background(), "testdata/blob1")
+	require.NoError(t, err)
+	digestFile, err := ioutil.ReadFile(index + desync.IndexDigestExt)
+	require.NoError(t, err)
+	require.Equal(t, hex.EncodeToString(sum)+"\n", string(digestFile))
+
+	// Extract the blob and verify its digest
+	cmd = newExtractCommand(context.Background())
+	cmd.SetArgs([]string{"--verify-digest", "-s", store, "--print-stats", index, out})
+	b := new(bytes.Buffer)
+	stdout = b
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+	var stats desync.ExtractStats
+	require.NoError(t, json.Unmarshal(b.Bytes(), &stats))
+	require.NotEmpty(t, stats.Digest)
+
+	// The digest should verify with cat and verify-index as well
+	cmd = newCatCommand(context.Background())
+	cmd.SetArgs([]string{"--verify-digest", "-s", store, index})
+	stdout = ioutil.Discard
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+
+	cmd = newVerifyIndexCommand(context.Background())
+	cmd.SetArgs([]string{"--verify-digest", index, out})
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+
+	// Replace the digest with a different one, now all of them should fail
+	err = ioutil.WriteFile(index+desync.IndexDigestExt, []byte(strings.Repeat("0", 64)+"\n"), 0644)
+	require.NoError(t, err)
+	for _, cmd := range []*cobra.Command{
+		newExtractCommand(context.Background()),
+		newCatCommand(context.Background()),
+		newVerifyIndexCommand(context.Background()),
+	} {
+		switch cmd.Name() {
+		case "extract":
+			cmd.SetArgs([]string{"--verify-digest", "-s", store, index, out})
+		case "cat":
+			cmd.SetArgs([]string{"--verify-digest", "-s", store, index})
+		default:
+			cmd.SetArgs([]string{"--verify-digest", index, out})
+		}
+		cmd.SetOutput(ioutil.Discard)
+		_, err = cmd.ExecuteC()
+		require.Error(t, err, cmd.Name())
+		require.Contains(t, err.Error(), "digest")
+	}
+}
+
+func TestExtractAdaptive(t *testing.T) {
+	outDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(outDir)
+	out := filepath.Join(outDir, "out")
+
+	// Serve the store over HTTP and throttle every 5th request
+	s, err := desync.NewLocalStore("testdata/blob1.store", desync.StoreOptions{})
+	require.NoError(t, err)
+	handler := desync.NewHTTPHandler(s, false, false, false, "")
+	var requests int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1)%5 == 0 {
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	cmd := newExtractCommand(context.Background())
+	cmd.SetArgs([]string{"--adaptive", "--adaptive-max", "16", "--print-stats", "-s", ts.URL, "testdata/blob1.caibx", out})
+	b := new(bytes.Buffer)
+	stdout = b
+	stderr = ioutil.Discard
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+
+	// The throttled requests should have been retried and reported in the stats
+	var stats desync.ExtractStats
+	require.NoError(t, json.Unmarshal(b.Bytes(), &stats))
+	require.Len(t, stats.Stores, 1)
+	require.NotZero(t, stats.Stores[0].Throttled)
+	require.True(t, stats.Stores[0].Concurrency >= 1 && stats.Stores[0].Concurrency <= 16)
+
+	b1, err := ioutil.ReadFile("testdata/blob1")
+	require.NoError(t, err)
+	b2, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(b1, b2))
+}
@@ -48,6 +48,7 @@ enables writing to this store.`,
 	flags.BoolVarP(&opt.writable, "writeable", "w", false, "support writing")
 	flags.StringVar(&opt.logFile, "log", "", "request log file or - for STDOUT")
 	addStoreOptions(&opt.cmdStoreOptions, flags)
+	addIndexVerifyOptions(&opt.cmdStoreOptions, flags)
 	addServerOptions(&opt.cmdServerOptions, flags)
 	return cmd
 }
@@ -71,6 +71,45 @@ func TestIndexServerWriteCommand(t *testing.T) {
 	require.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
 }
 
+func TestIndexServerSignedIndex(t *testing.T) {
+	store, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(store)
+	chunks, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(chunks)
+
+	// Start a read-write server that only serves signed indexes
+	addr, cancel := startIndexServer(t, "-s", store, "-w", "--verify-key", "testdata/index-sign.key.pub")
+	defer cancel()
+
+	// Store a signed index on the server, the signature goes to the server as well
+	makeCmd := newMakeCommand(context.Background())
+	makeCmd.SetArgs([]string{"-s", chunks, "--sign-key", "testdata/index-sign.key", fmt.Sprintf("http://%s/new.caibx", addr), "testdata/blob1"})
+	makeCmd.SetOutput(ioutil.Discard)
+	_, err = makeCmd.ExecuteC()
+	require.NoError(t, err)
+
+	// Extract using the index from the server, verifying the signature on the client
+	out := store + "/out"
+	extractCmd := newExtractCommand(context.Background())
+	extractCmd.SetArgs([]string{"-s", chunks, "--verify-key", "testdata/index-sign.key.pub", fmt.Sprintf("http://%s/new.caibx", addr), out})
+	extractCmd.SetOutput(ioutil.Discard)
+	_, err = extractCmd.ExecuteC()
+	require.NoError(t, err)
+
+	// An unsigned index stored on the server should not be served
+	makeCmd = newMakeCommand(context.Background())
+	makeCmd.SetArgs([]string{fmt.Sprintf("http://%s/unsigned.caibx", addr), "testdata/blob1"})
+	makeCmd.SetOutput(ioutil.Discard)
+	_, err = makeCmd.ExecuteC()
+	require.NoError(t, err)
+	resp, err := http.Get(fmt.Sprintf("http://%s/unsigned.caibx", addr))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.NotEqual(t, http.StatusOK, resp.StatusCode)
+}
+
 func startIndexServer(t *testing.T, args ...string) (string, context.CancelFunc) {
 	// Find a free local port to be used to run the index server on
 	l, err := net.Listen("tcp", "127.0.0.1:0")
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/spf13/cobra"
+)
+
+type lsOptions struct {
+	cmdStoreOptions
+	stores      []string
+	cache       string
+	readIndex   bool
+	printFormat string
+}
+
+// Entry of an archive as it's listed by the ls command
+type lsEntry struct {
+	Path   string            `json:"path"`
+	Type   string            `json:"type"`
+	Mode   string            `json:"mode"`
+	UID    int               `json:"uid"`
+	GID    int               `json:"gid"`
+	User   string            `json:"user,omitempty"`
+	Group  string            `json:"group,omitempty"`
+	Size   uint64            `json:"size"`
+	MTime  time.Time         `json:"mtime"`
+	Target string            `json:"target,omitempty"`
+	Major  uint64            `json:"major,omitempty"`
+	Minor  uint64            `json:"minor,omitempty"`
+	Xattrs map[string][]byte `json:"xattrs,omitempty"` // base64 in JSON, values can be binary
+
+	mode os.FileMode // Mode as returned by stat(2)
+}
+
+func newLsCommand(ctx context.Context) *cobra.Command {
+	var opt lsOptions
+
+	cmd := &cobra.Command{
+		Use:   "ls <catar|index> [<path>...]",
+		Short: "List the content of a catar archive or index",
+		Long: `Lists the files, directories and other nodes in a catar archive or the archive
+an index refers to, without extracting it. Use '-' to read the catar or index
+from STDIN. With -i, the chunks are streamed from the store.
+
+If paths are given, only those and what's below them are listed. Paths are
+relative to the root of the archive.
+
+The output format can be plain (similar to 'ls -l'), json, or mtree, which can
+be used to compare the archive with a directory tree.`,
+		Example: `  desync ls docs.catar
+  desync ls -s /path/to/local -i -f json rootfs.caidx etc/ssh`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runLs(ctx, opt, args)
+		},
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	flags.StringSliceVarP(&opt.stores, "store", "s", nil, "source store(s), used with -i")
+	flags.StringVarP(&opt.cache, "cache", "c", "", "store to be used as cache")
+	flags.BoolVarP(&opt.readIndex, "index", "i", false, "read index file (caidx), not catar")
+	flags.StringVarP(&opt.printFormat, "format", "f", "plain", "output format, plain, json or mtree")
+	addStoreOptions(&opt.cmdStoreOptions, flags)
+	addIndexVerifyOptions(&opt.cmdStoreOptions, flags)
+	addCacheOptions(&opt.cmdStoreOptions, flags)
+	return cmd
+}
+
+func runLs(ctx context.Context, opt lsOptions, args []string) error {
+	if err := opt.cmdStoreOptions.validate(); err != nil {
+		return err
+	}
+	if opt.readIndex && len(opt.stores) == 0 {
+		return errors.New("-i requires at least one store (-s <location>)")
+	}
+
+	var (
+		entries []lsEntry
+		output  func(lsEntry) error
+	)
+	switch opt.printFormat {
+	case "plain":
+		output = func(e lsEntry) error { return printLsPlain(stdout, e) }
+	case "json": // Printed as one list once all entries are known
+		output = func(e lsEntry) error {
+			entries = append(entries, e)
+			return nil
+		}
+	case "mtree":
+		fmt.Fprintln(stdout, "#mtree")
+		output = func(e lsEntry) error { return printLsMtree(stdout, e) }
+	default:
+		return fmt.Errorf("unsupported output format '%s', expected plain, json or mtree", opt.printFormat)
+	}
+
+	// Normalize the paths to filter by, to match the names in the archive
+	var filter []string
+	for _, p := range args[1:] {
+		name := strings.TrimPrefix(path.Clean("/"+p), "/")
+		if name == "" {
+			name = "."
+		}
+		filter = append(filter, name)
+	}
+
+	walk := func(node interface{}) error {
+		e := newLsEntry(node)
+		if !lsMatch(e.Path, filter) {
+			return nil
+		}
+		return output(e)
+	}
+
+	input := args[0]
+	if !opt.readIndex {
+		var r io.Reader = os.Stdin
+		if input != "-" {
+			f, err := os.Open(input)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		if err := desync.WalkArchive(ctx, r, walk); err != nil {
+			return err
+		}
+	} else {
+		s, err := MultiStoreWithCache(opt.cmdStoreOptions, opt.cache, opt.stores...)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		index, err := readCaibxFile(input, opt.cmdStoreOptions)
+		if err != nil {
+			return err
+		}
+		if err := desync.WalkArchiveIndex(ctx, index, s, opt.n, nil, walk); err != nil {
+			return err
+		}
+	}
+
+	if opt.printFormat == "json" {
+		if entries == nil {
+			entries = []lsEntry{}
+		}
+		return printJSON(stdout, entries)
+	}
+	return nil
+}
+
+// Returns the listing of a node decoded from an archive.
+func newLsEntry(node interface{}) lsEntry {
+	var e lsEntry
+	var xattrs desync.Xattrs
+	var selinux string
+	switch n := node.(type) {
+	case desync.NodeDirectory:
+		e = lsEntry{Path: n.Name, Type: "dir", UID: n.UID, GID: n.GID, User: n.User, Group: n.Group, MTime: n.MTime, mode: n.Mode}
+		xattrs, selinux = n.Xattrs, n.SELinuxLabel
+	case desync.NodeFile:
+		e = lsEntry{Path: n.Name, Type: "file", UID: n.UID, GID: n.GID, User: n.User, Group: n.Group, MTime: n.MTime, Size: n.Size, mode: n.Mode}
+		xattrs, selinux = n.Xattrs, n.SELinuxLabel
+		if len(n.FCaps) > 0 {
+			e.Xattrs = map[string][]byte{"security.capability": n.FCaps}
+		}
+	case desync.NodeSymlink:
+		e = lsEntry{Path: n.Name, Type: "link", UID: n.UID, GID: n.GID, User: n.User, Group: n.Group, MTime: n.MTime, Target: n.Target, mode: n.Mode}
+		xattrs, selinux = n.Xattrs, n.SELinuxLabel
+	case desync.NodeDevice:
+		e = lsEntry{Path: n.Name, Type: "block", UID: n.UID, GID: n.GID, User: n.User, Group: n.Group, MTime: n.MTime, Major: n.Major, Minor: n.Minor, mode: n.Mode}
+		if n.Mode&desync.ModeTypeMask == desync.ModeCharDevice {
+			e.Type = "char"
+		}
+		xattrs, selinux = n.Xattrs, n.SELinuxLabel
+	case desync.NodeFIFO:
+		e = lsEntry{Path: n.Name, Type: "fifo", UID: n.UID, GID: n.GID, User: n.User, Group: n.Group, MTime: n.MTime, mode: n.Mode}
+		xattrs, selinux = n.Xattrs, n.SELinuxLabel
+	case desync.NodeSocket:
+		e = lsEntry{Path: n.Name, Type: "socket", UID: n.UID, GID: n.GID, User: n.User, Group: n.Group, MTime: n.MTime, mode: n.Mode}
+		xattrs, selinux = n.Xattrs, n.SELinuxLabel
+	}
+	e.Mode = fmt.Sprintf("%04o", e.mode&07777)
+	for key, value := range xattrs {
+		if e.Xattrs == nil {
+			e.Xattrs = make(map[string][]byte)
+		}
+		e.Xattrs[key] = []byte(value)
+	}
+	if selinux != "" {
+		if e.Xattrs == nil {
+			e.Xattrs = make(map[string][]byte)
+		}
+		e.Xattrs["security.selinux"] = []byte(selinux)
+	}
+	return e
+}
+
+// Returns true if the path is one of the filter paths or below one of them.
+// Everything matches an empty filter.
+func lsMatch(name string, filter []string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, f := range filter {
+		if f == "." || name == f || strings.HasPrefix(name, f+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Type characters as used by 'ls -l'
+var lsTypeChars = map[string]byte{
+	"dir":    'd',
+	"file":   '-',
+	"link":   'l',
+	"char":   'c',
+	"block":  'b',
+	"fifo":   'p',
+	"socket": 's',
+}
+
+// Prints an entry similar to 'ls -l', followed by its xattrs.
+func printLsPlain(w io.Writer, e lsEntry) error {
+	mode := []byte{lsTypeChars[e.Type]}
+	for i := 8; i >= 0; i-- {
+		if e.mode&(1<<uint(i)) != 0 {
+			mode = append(mode, "rwxrwxrwx"[8-i])
+		} else {
+			mode = append(mode, '-')
+		}
+	}
+	// setuid, setgid and sticky bits replace the execute bits
+	for _, s := range []struct {
+		bit      os.FileMode
+		pos      int
+		set, off byte
+	}{{04000, 3, 's', 'S'}, {02000, 6, 's', 'S'}, {01000, 9, 't', 'T'}} {
+		if e.mode&s.bit == 0 {
+			continue
+		}
+		if mode[s.pos] == 'x' {
+			mode[s.pos] = s.set
+		} else {
+			mode[s.pos] = s.off
+		}
+	}
+
+	owner := fmt.Sprintf("%d/%d", e.UID, e.GID)
+	if e.User != "" || e.Group != "" {
+		owner = fmt.Sprintf("%s/%s", lsName(e.User, e.UID), lsName(e.Group, e.GID))
+	}
+	size := fmt.Sprintf("%d", e.Size)
+	if e.Type == "char" || e.Type == "block" {
+		size = fmt.Sprintf("%d,%d", e.Major, e.Minor)
+	}
+	name := e.Path
+	if e.Type == "link" {
+		name += " -> " + e.Target
+	}
+	if _, err := fmt.Fprintf(w, "%s %s %10s %s %s\n", mode, owner, size, e.MTime.UTC().Format("2006-01-02 15:04:05"), name); err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(e.Xattrs) {
+		if _, err := fmt.Fprintf(w, "    %s=%q\n", key, e.Xattrs[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the name of a user or group, or the ID if there's no name.
+func lsName(name string, id int) string {
+	if name == "" {
+		return fmt.Sprintf("%d", id)
+	}
+	return name
+}
+
+// Prints an entry as a line of an mtree(5) specification, with the full path
+// of the entry. Xattrs are base64 encoded like go-mtree does.
+func printLsMtree(w io.Writer, e lsEntry) error {
+	name := "."
+	if e.Path != "." {
+		name = "./" + e.Path
+	}
+	keywords := []string{
+		mtreeEscape(name),
+		"type=" + e.Type,
+		"mode=" + e.Mode,
+		fmt.Sprintf("uid=%d", e.UID),
+		fmt.Sprintf("gid=%d", e.GID),
+	}
+	if e.User != "" {
+		keywords = append(keywords, "uname="+mtreeEscape(e.User))
+	}
+	if e.Group != "" {
+		keywords = append(keywords, "gname="+mtreeEscape(e.Group))
+	}
+	switch e.Type {
+	case "file":
+		keywords = append(keywords, fmt.Sprintf("size=%d", e.Size))
+	case "link":
+		keywords = append(keywords, "link="+mtreeEscape(e.Target))
+	case "char", "block":
+		keywords = append(keywords, fmt.Sprintf("device=native,%d,%d", e.Major, e.Minor))
+	}
+	keywords = append(keywords, fmt.Sprintf("time=%d.%09d", e.MTime.Unix(), e.MTime.Nanosecond()))
+	for _, key := range sortedKeys(e.Xattrs) {
+		keywords = append(keywords, "xattr."+mtreeEscape(key)+"="+base64.StdEncoding.EncodeToString(e.Xattrs[key]))
+	}
+	_, err := fmt.Fprintln(w, strings.Join(keywords, " "))
+	return err
+}
+
+// Encodes whitespace, backslashes, '#' and non-printable characters as octal
+// escapes, as mtree(5) expects them.
+func mtreeEscape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if c <= ' ' || c >= 0x7f || c == '\\' || c == '#' {
+			fmt.Fprintf(&b, "\\%03o", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func sortedKeys(m map[string][]byte) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/folbricht/desync"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLsCommand(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		args []string
+	}{
+		{"catar", []string{"testdata/tree.catar"}},
+		{"caidx", []string{"-s", "testdata/tree.store", "-i", "testdata/tree.caidx"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// List everything in the archive
+			b := new(bytes.Buffer)
+			stdout = b
+			cmd := newLsCommand(context.Background())
+			cmd.SetArgs(test.args)
+			cmd.SetOutput(ioutil.Discard)
+			_, err := cmd.ExecuteC()
+			require.NoError(t, err)
+			require.Contains(t, b.String(), " subdir1/f1\n")
+			require.Contains(t, b.String(), " nested1/nested2/f\n")
+
+			// Only list what's below one path, in JSON
+			b.Reset()
+			cmd = newLsCommand(context.Background())
+			cmd.SetArgs(append([]string{"-f", "json"}, append(test.args, "/subdir1")...))
+			cmd.SetOutput(ioutil.Discard)
+			_, err = cmd.ExecuteC()
+			require.NoError(t, err)
+			var entries []lsEntry
+			require.NoError(t, json.Unmarshal(b.Bytes(), &entries))
+			require.Len(t, entries, 2)
+			require.Equal(t, "subdir1", entries[0].Path)
+			require.Equal(t, "dir", entries[0].Type)
+			require.Equal(t, "subdir1/f1", entries[1].Path)
+			require.Equal(t, "file", entries[1].Type)
+			require.Equal(t, uint64(16), entries[1].Size)
+		})
+	}
+}
+
+func TestLsCommandMtree(t *testing.T) {
+	b := new(bytes.Buffer)
+	stdout = b
+	cmd := newLsCommand(context.Background())
+	cmd.SetArgs([]string{"-f", "mtree", "testdata/tree.catar", "subdir2/f2"})
+	cmd.SetOutput(ioutil.Discard)
+	_, err := cmd.ExecuteC()
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	require.Equal(t, []string{"#mtree", "./subdir2/f2 type=file mode=0664 uid=1000 gid=1000 size=16 time=1538248039.139611211"}, lines)
+}
+
+func TestMtreeEscape(t *testing.T) {
+	require.Equal(t, `a\040b\134c\043`, mtreeEscape(`a b\c#`))
+}
+
+func TestLsEntryBinaryXattrs(t *testing.T) {
+	caps := []byte{0x00, 0x00, 0x00, 0x02, 0xff, 0xfe}
+	e := newLsEntry(desync.NodeFile{Name: "f", Mode: 0100644, FCaps: caps})
+	b, err := json.Marshal(e)
+	require.NoError(t, err)
+	var decoded lsEntry
+	require.NoError(t, json.Unmarshal(b, &decoded))
+	require.Equal(t, caps, decoded.Xattrs["security.capability"])
+}
+
+func TestLsEntryCharDevice(t *testing.T) {
+	require.Equal(t, "char", newLsEntry(desync.NodeDevice{Name: "null", Mode: 0020666, Major: 1, Minor: 3}).Type)
+	require.Equal(t, "block", newLsEntry(desync.NodeDevice{Name: "sda", Mode: 0060660, Major: 8}).Type)
+}
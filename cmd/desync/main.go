@@ -44,15 +44,21 @@ func main() {
 		newExtractCommand(ctx),
 		newChopCommand(ctx),
 		newChunkCommand(ctx),
+		newDiffCommand(ctx),
 		newInfoCommand(ctx),
 		newListCommand(ctx),
+		newLsCommand(ctx),
 		newMountIndexCommand(ctx),
+		newMultiExtractCommand(ctx),
 		newPruneCommand(ctx),
+		newRebalanceCommand(ctx),
+		newRepairCommand(ctx),
 		newPullCommand(ctx),
 		newIndexServerCommand(ctx),
 		newChunkServerCommand(ctx),
 		newTarCommand(ctx),
 		newUntarCommand(ctx),
+		newExportTarCommand(ctx),
 		newVerifyCommand(ctx),
 		newVerifyIndexCommand(ctx),
 	)
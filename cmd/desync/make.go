@@ -13,9 +13,11 @@ import (
 
 type makeOptions struct {
 	cmdStoreOptions
-	store      string
+	cmdReplicationOptions
+	stores     []string
 	chunkSize  string
 	printStats bool
+	digest     bool
 }
 
 func newMakeCommand(ctx context.Context) *cobra.Command {
@@ -36,10 +38,13 @@ to STDOUT.`,
 		SilenceUsage: true,
 	}
 	flags := cmd.Flags()
-	flags.StringVarP(&opt.store, "store", "s", "", "target store")
+	flags.StringArrayVarP(&opt.stores, "store", "s", nil, "target store(s)")
 	flags.StringVarP(&opt.chunkSize, "chunk-size", "m", "16:64:256", "min:avg:max chunk size in kb")
 	flags.BoolVarP(&opt.printStats, "print-stats", "", false, "show chunking statistics")
+	flags.BoolVarP(&opt.digest, "digest", "", false, "store the SHA-256 digest of the blob next to the index")
 	addStoreOptions(&opt.cmdStoreOptions, flags)
+	addIndexSignOptions(&opt.cmdStoreOptions, flags)
+	addReplicationOptions(&opt.cmdReplicationOptions, flags)
 	return cmd
 }
 
@@ -47,6 +52,9 @@ func runMake(ctx context.Context, opt makeOptions, args []string) error {
 	if err := opt.cmdStoreOptions.validate(); err != nil {
 		return err
 	}
+	if opt.digest && args[0] == "-" {
+		return errors.New("--digest is not supported when writing the index to STDOUT")
+	}
 
 	min, avg, max, err := parseChunkSizeParam(opt.chunkSize)
 	if err != nil {
@@ -58,17 +66,27 @@ func runMake(ctx context.Context, opt makeOptions, args []string) error {
 
 	// Open the target store if one was given
 	var s desync.WriteStore
-	if opt.store != "" {
-		s, err = WritableStore(opt.store, opt.cmdStoreOptions)
+	if len(opt.stores) > 0 {
+		s, err = replicatedWritableStore(opt.stores, opt.cmdReplicationOptions, opt.cmdStoreOptions)
 		if err != nil {
 			return err
 		}
 		defer s.Close()
 	}
 
-	// Split up the file and create and index from it
+	// Split up the file and create and index from it, calculating the digest of
+	// the whole blob on the way if requested
+	var (
+		index  desync.Index
+		stats  desync.ChunkingStats
+		digest []byte
+	)
 	pb := NewProgressBar("Chunking ")
-	index, stats, err := desync.IndexFromFile(ctx, dataFile, opt.n, min, avg, max, pb)
+	if opt.digest {
+		index, stats, digest, err = desync.IndexFromFileWithDigest(ctx, dataFile, opt.n, min, avg, max, pb)
+	} else {
+		index, stats, err = desync.IndexFromFile(ctx, dataFile, opt.n, min, avg, max, pb)
+	}
 	if err != nil {
 		return err
 	}
@@ -80,10 +98,18 @@ func runMake(ctx context.Context, opt makeOptions, args []string) error {
 			return err
 		}
 	}
+	if err := storeCaibxFile(index, indexFile, opt.cmdStoreOptions); err != nil {
+		return err
+	}
+	if digest != nil {
+		if err := storeBlobDigest(digest, indexFile, opt.cmdStoreOptions); err != nil {
+			return err
+		}
+	}
 	if opt.printStats {
 		return printJSON(stderr, stats) // write to stderr since stdout could be used for index data
 	}
-	return storeCaibxFile(index, indexFile, opt.cmdStoreOptions)
+	return nil
 }
 
 func parseChunkSizeParam(s string) (min, avg, max uint64, err error) {
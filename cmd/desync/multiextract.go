@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/folbricht/desync"
+	"github.com/folbricht/tempfile"
+	"github.com/spf13/cobra"
+)
+
+type multiExtractOptions struct {
+	cmdStoreOptions
+	stores      []string
+	cache       string
+	seeds       []string
+	seedFiles   []string
+	seedDirs    []string
+	seedCache   string
+	printStats  bool
+	fetchers    int
+	fetchMemory int
+}
+
+// Entry in a multi-extract manifest
+type multiExtractEntry struct {
+	Index     string   `json:"index"`
+	Target    string   `json:"target"`
+	Seeds     []string `json:"seeds,omitempty"`
+	SeedFiles []string `json:"seedFiles,omitempty"`
+}
+
+func newMultiExtractCommand(ctx context.Context) *cobra.Command {
+	var opt multiExtractOptions
+
+	cmd := &cobra.Command{
+		Use:   "multi-extract <manifest>",
+		Short: "Build several blobs from indexes listed in a manifest",
+		Long: `Reads a manifest in JSON format listing indexes and the blobs to build from them,
+and extracts all of them at the same time. Blobs requesting the same chunk at the
+same time share one request to the store, chunks already written to one blob are
+read back from it, and every blob is used as seed for the others as it's being
+written. The manifest is a list of objects, each
+with an "index" and a "target", and optionally lists of "seeds" (indexes) and
+"seedFiles" (files without index) for that target. Seeds given with --seed,
+--seed-file and --seed-dir are used for all targets. The
+blobs are written to temporary files which are only renamed once all of them
+have been completed. Use '-' to read the manifest from STDIN. Each blob is
+written by -n goroutines, with --fetch-concurrency and --fetch-memory applying
+to each blob like they do for extract.`,
+		Example: `  desync multi-extract -s http://192.168.1.1/ -c /path/to/local release.json
+
+  With release.json:
+  [
+    {"index": "rootfs.caibx", "target": "rootfs.img"},
+    {"index": "data.caibx", "target": "data.img", "seeds": ["data-v1.img.caibx"]}
+  ]`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runMultiExtract(ctx, opt, args)
+		},
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	flags.StringSliceVarP(&opt.stores, "store", "s", nil, "source store(s)")
+	flags.StringSliceVar(&opt.seeds, "seed", nil, "seed indexes")
+	flags.StringSliceVar(&opt.seedFiles, "seed-file", nil, "seed files or block devices without index")
+	flags.StringSliceVar(&opt.seedDirs, "seed-dir", nil, "directory with seed index files")
+	flags.StringVar(&opt.seedCache, "seed-index-cache", "", "directory to cache indexes of seed files without index")
+	flags.StringVarP(&opt.cache, "cache", "c", "", "store to be used as cache")
+	flags.BoolVarP(&opt.printStats, "print-stats", "", false, "print statistics")
+	flags.IntVar(&opt.fetchers, "fetch-concurrency", 0, "number of concurrent chunk requests to the store per blob (default same as -n)")
+	flags.IntVar(&opt.fetchMemory, "fetch-memory", desync.DefaultFetchMemory>>20, "MiB of chunk data to fetch from the store ahead of the writers of each blob")
+	addStoreOptions(&opt.cmdStoreOptions, flags)
+	addIndexVerifyOptions(&opt.cmdStoreOptions, flags)
+	addCacheOptions(&opt.cmdStoreOptions, flags)
+	return cmd
+}
+
+func runMultiExtract(ctx context.Context, opt multiExtractOptions, args []string) error {
+	if err := opt.cmdStoreOptions.validate(); err != nil {
+		return err
+	}
+	if len(opt.stores) == 0 {
+		return errors.New("no store provided")
+	}
+
+	entries, err := readMultiExtractManifest(args[0])
+	if err != nil {
+		return err
+	}
+
+	// Parse the store locations, open the stores and add a cache is requested
+	s, err := MultiStoreWithCache(opt.cmdStoreOptions, opt.cache, opt.stores...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// Prepare a tempfile for every target and make sure they get removed
+	// regardless of any errors below
+	var targets []desync.AssembleTarget
+	for _, e := range entries {
+		tmp, err := tempfile.NewMode(filepath.Dir(e.Target), "."+filepath.Base(e.Target), 0644)
+		if err != nil {
+			return err
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+
+		idx, err := readCaibxFile(e.Index, opt.cmdStoreOptions)
+		if err != nil {
+			return err
+		}
+
+		// Build the list of seeds for this target
+		seedOpt := extractOptions{
+			cmdStoreOptions: opt.cmdStoreOptions,
+			seeds:           append(append([]string{}, opt.seeds...), e.Seeds...),
+			seedFiles:       append(append([]string{}, opt.seedFiles...), e.SeedFiles...),
+			seedCache:       opt.seedCache,
+		}
+		seeds, err := readSeeds(ctx, tmp.Name(), idx, seedOpt)
+		if err != nil {
+			return err
+		}
+		dSeeds, err := readSeedDirs(tmp.Name(), e.Index, opt.seedDirs, opt.cmdStoreOptions)
+		if err != nil {
+			return err
+		}
+		seeds = append(seeds, dSeeds...)
+
+		targets = append(targets, desync.AssembleTarget{
+			Name:  tmp.Name(),
+			Index: idx,
+			Seeds: seeds,
+		})
+	}
+
+	// Build all blobs at the same time
+	assembleOpt := desync.AssembleOptions{
+		FetchConcurrency: opt.fetchers,
+		FetchMemory:      int64(opt.fetchMemory) << 20,
+	}
+	pb := NewProgressBar("")
+	stats, err := desync.AssembleFiles(ctx, targets, s, opt.n, assembleOpt, pb)
+	if err != nil {
+		return err
+	}
+
+	// Everything's been written, rename the tempfiles to the targets
+	for i, e := range entries {
+		if err := os.Rename(targets[i].Name, e.Target); err != nil {
+			return err
+		}
+	}
+	if opt.printStats {
+		return printJSON(stdout, stats)
+	}
+	return nil
+}
+
+// Reads and validates a manifest of indexes and their targets.
+func readMultiExtractManifest(name string) ([]multiExtractEntry, error) {
+	f := os.Stdin
+	if name != "-" {
+		var err error
+		if f, err = os.Open(name); err != nil {
+			return nil, err
+		}
+		defer f.Close()
+	}
+	var entries []multiExtractEntry
+	if err := json.NewDecoder(f).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %s", name, err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no indexes in manifest %s", name)
+	}
+	targets := make(map[string]struct{})
+	for _, e := range entries {
+		if e.Index == "" || e.Target == "" {
+			return nil, fmt.Errorf("manifest %s requires an index and a target in every entry", name)
+		}
+		if e.Index == "-" {
+			return nil, errors.New("reading indexes from STDIN is not supported with multi-extract")
+		}
+		abs, err := filepath.Abs(e.Target)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := targets[abs]; ok {
+			return nil, fmt.Errorf("target %s used more than once in manifest %s", e.Target, name)
+		}
+		targets[abs] = struct{}{}
+	}
+	return entries, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/folbricht/desync"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiExtractCommand(t *testing.T) {
+	outDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(outDir)
+
+	// Write a manifest for two blobs
+	out1 := filepath.Join(outDir, "blob1")
+	out2 := filepath.Join(outDir, "blob2")
+	manifest := filepath.Join(outDir, "manifest.json")
+	require.NoError(t, ioutil.WriteFile(manifest, []byte(fmt.Sprintf(`[
+	{"index": "testdata/blob1.caibx", "target": %q},
+	{"index": "testdata/blob2.caibx", "target": %q}
+]`, out1, out2)), 0644))
+
+	cmd := newMultiExtractCommand(context.Background())
+	cmd.SetArgs([]string{"-s", "testdata/blob1.store", "-s", "testdata/blob2.store", "--print-stats", manifest})
+	b := new(bytes.Buffer)
+	stdout = b
+	stderr = ioutil.Discard
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+
+	// Compare the blobs to what we should have gotten
+	for _, name := range []string{"blob1", "blob2"} {
+		expected, err := ioutil.ReadFile(filepath.Join("testdata", name))
+		require.NoError(t, err)
+		got, err := ioutil.ReadFile(filepath.Join(outDir, name))
+		require.NoError(t, err)
+		require.Equal(t, expected, got)
+	}
+
+	// The stats should cover both blobs
+	var stats desync.ExtractStats
+	require.NoError(t, json.Unmarshal(b.Bytes(), &stats))
+	require.Equal(t, 322, stats.ChunksTotal)
+
+	// No temp files should be left behind
+	files, err := ioutil.ReadDir(outDir)
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+}
+
+func TestMultiExtractInvalidManifest(t *testing.T) {
+	outDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(outDir)
+	manifest := filepath.Join(outDir, "manifest.json")
+
+	for _, test := range []struct {
+		name     string
+		manifest string
+	}{
+		{"empty", `[]`},
+		{"missing target", `[{"index": "testdata/blob1.caibx"}]`},
+		{"duplicate target", `[{"index": "testdata/blob1.caibx", "target": "out"}, {"index": "testdata/blob2.caibx", "target": "out"}]`},
+		{"not json", `index=blob1.caibx`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			require.NoError(t, ioutil.WriteFile(manifest, []byte(test.manifest), 0644))
+			cmd := newMultiExtractCommand(context.Background())
+			cmd.SetArgs([]string{"-s", "testdata/blob1.store", manifest})
+			cmd.SetOutput(ioutil.Discard)
+			_, err := cmd.ExecuteC()
+			require.Error(t, err)
+		})
+	}
+}
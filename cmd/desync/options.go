@@ -16,6 +16,55 @@ type cmdStoreOptions struct {
 	caCert        string
 	skipVerify    bool
 	trustInsecure bool
+
+	// Size of the queue for asynchronous writes into the cache store, only
+	// used in commands that support a cache. 0 writes synchronously.
+	cacheWriteBack int
+
+	// Private key file to sign indexes with when writing them.
+	signKey string
+
+	// Public key files to verify index signatures with. If not set, the keys
+	// from the config file are used.
+	verifyKeys []string
+
+	// Don't verify index signatures, even if keys are configured. Not a flag,
+	// used for indexes that are not expected to be signed, like seeds.
+	skipIndexVerify bool
+
+	// Adjust the number of concurrent requests to remote stores instead of
+	// using a fixed number. Starts with n requests and goes up to adaptiveMax,
+	// as far as the command makes that many requests.
+	adaptive    bool
+	adaptiveMax int
+
+	// Remote stores that were created with adaptive concurrency, to report
+	// their stats once the command is done.
+	adaptiveStores *adaptiveStores
+}
+
+// Returns the number of goroutines a command should use for requests to stores.
+// With adaptive concurrency, that's the maximum and the stores limit how many
+// of them are actually in flight. Commands with separate goroutines for local
+// work like writing use n of those, commands that make requests from the same
+// goroutines as the local work, like chop, use this for all of them.
+func (o cmdStoreOptions) requests() int {
+	if o.adaptive {
+		return o.adaptiveMax
+	}
+	return o.n
+}
+
+// Returns the files containing public keys that index signatures need to be
+// verified with, either from the command line or the config file.
+func (o cmdStoreOptions) indexVerifyKeys() []string {
+	if o.skipIndexVerify {
+		return nil
+	}
+	if len(o.verifyKeys) > 0 {
+		return o.verifyKeys
+	}
+	return cfg.IndexVerifyKeys
 }
 
 // MergeWith takes store options as read from the config, and applies command-line
@@ -45,6 +94,12 @@ func (o cmdStoreOptions) validate() error {
 	if (o.clientKey == "") != (o.clientCert == "") {
 		return errors.New("--client-key and --client-cert options need to be provided together")
 	}
+	if o.cacheWriteBack < 0 {
+		return errors.New("--cache-write-back can not be negative")
+	}
+	if o.adaptive && o.adaptiveMax < o.n {
+		return errors.New("--adaptive-max can not be lower than --concurrency")
+	}
 	return nil
 }
 
@@ -57,6 +112,43 @@ func addStoreOptions(o *cmdStoreOptions, f *pflag.FlagSet) {
 	f.BoolVarP(&o.trustInsecure, "trust-insecure", "t", false, "trust invalid certificates")
 }
 
+// Add cache option flags to a command flagset. Only used by commands that support
+// a cache store with -c.
+func addCacheOptions(o *cmdStoreOptions, f *pflag.FlagSet) {
+	f.IntVar(&o.cacheWriteBack, "cache-write-back", 0, "write chunks to the cache asynchronously with a queue of this size")
+}
+
+// Add adaptive concurrency flags to a command flagset. Used by commands that
+// make many requests to stores.
+func addAdaptiveOptions(o *cmdStoreOptions, f *pflag.FlagSet) {
+	f.BoolVar(&o.adaptive, "adaptive", false, "adjust concurrent requests to remote stores based on latency, throughput and throttling")
+	f.IntVar(&o.adaptiveMax, "adaptive-max", 64, "maximum number of concurrent requests per remote store with --adaptive")
+	o.adaptiveStores = new(adaptiveStores)
+}
+
+// Add index signing flags to a command flagset. Used by commands that write indexes.
+func addIndexSignOptions(o *cmdStoreOptions, f *pflag.FlagSet) {
+	f.StringVar(&o.signKey, "sign-key", "", "sign the index with this Ed25519 private key")
+}
+
+// Add index verification flags to a command flagset.
+func addIndexVerifyOptions(o *cmdStoreOptions, f *pflag.FlagSet) {
+	f.StringSliceVar(&o.verifyKeys, "verify-key", nil, "only trust indexes signed by one of these Ed25519 public keys")
+}
+
+// cmdReplicationOptions are used by commands that can write chunks into multiple
+// stores at once.
+type cmdReplicationOptions struct {
+	quorum  int
+	journal string
+}
+
+// Add replication option flags to a command flagset.
+func addReplicationOptions(o *cmdReplicationOptions, f *pflag.FlagSet) {
+	f.IntVar(&o.quorum, "quorum", 0, "number of target stores that need to store a chunk, 0 for all")
+	f.StringVar(&o.journal, "journal", "", "record failed writes to target stores in this file")
+}
+
 // cmdServerOptions hold command line options used in HTTP servers.
 type cmdServerOptions struct {
 	cert      string
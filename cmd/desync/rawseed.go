@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/folbricht/desync"
+)
+
+// Chunks a plain file or block device so it can be used as seed. The same chunk
+// sizes as in the target index are used, otherwise the chunks wouldn't match.
+// If cacheDir is set, the index of a regular file is stored there and re-used
+// as long as path, size and modification time of the file don't change. Block
+// devices are always chunked since their modification time doesn't reflect
+// changes to the data.
+func readRawSeed(ctx context.Context, dstFile, srcFile string, idx desync.Index, cacheDir string, n int) (desync.Seed, error) {
+	abs, err := filepath.Abs(srcFile)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("seed %s is a directory", srcFile)
+	}
+	min, avg, max := idx.Index.ChunkSizeMin, idx.Index.ChunkSizeAvg, idx.Index.ChunkSizeMax
+
+	// Look for the seed's index in the cache first
+	var (
+		cache desync.LocalIndexStore
+		key   string
+	)
+	if cacheDir != "" && info.Mode().IsRegular() {
+		if cache, err = desync.NewLocalIndexStore(cacheDir); err != nil {
+			return nil, err
+		}
+		key = rawSeedCacheKey(abs, info, min, avg, max)
+		if seedIndex, err := cache.GetIndex(key); err == nil {
+			return desync.NewIndexSeed(dstFile, abs, seedIndex)
+		}
+	}
+
+	// Not in the cache, chunk the file
+	pb := NewProgressBar("Chunking seed ")
+	seedIndex, _, err := desync.IndexFromFile(ctx, abs, n, min, avg, max, pb)
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		if err := cache.StoreIndex(key, seedIndex); err != nil {
+			return nil, err
+		}
+	}
+	return desync.NewIndexSeed(dstFile, abs, seedIndex)
+}
+
+// Returns the name of a cached seed index for a file. It's derived from the
+// path, size and modification time of the file and the chunk sizes.
+func rawSeedCacheKey(path string, info os.FileInfo, min, avg, max uint64) string {
+	key := fmt.Sprintf("%s\x00%d\x00%d\x00%d:%d:%d", path, info.Size(), info.ModTime().UnixNano(), min, avg, max)
+	return fmt.Sprintf("%x.caibx", sha256.Sum256([]byte(key)))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/folbricht/desync"
+	"github.com/spf13/cobra"
+)
+
+type rebalanceOptions struct {
+	cmdStoreOptions
+	store   string
+	sources []string
+}
+
+func newRebalanceCommand(ctx context.Context) *cobra.Command {
+	var opt rebalanceOptions
+
+	cmd := &cobra.Command{
+		Use:   "rebalance <index> [<index>...]",
+		Short: "Move chunks to their owning shard in a sharded store",
+		Long: `Read chunk IDs from caibx or caidx files and make sure each chunk is present in
+the shard that owns it in a sharded store. A sharded store is given as list of
+stores separated by ';'. Chunks missing from their owning shard are read from
+any other shard, or from the stores provided with --from, which is typically
+used for shards that have been removed. Chunks are not deleted from their old
+location, use prune on the sharded store afterwards to remove them. Use '-' to
+read (a single) index from STDIN.`,
+		Example: `  desync rebalance -s "/mnt/shard1;/mnt/shard2;/mnt/shard3" --from /mnt/old file.caibx`,
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runRebalance(ctx, opt, args)
+		},
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	flags.StringVarP(&opt.store, "store", "s", "", "target sharded store")
+	flags.StringSliceVar(&opt.sources, "from", nil, "additional source store(s)")
+	addStoreOptions(&opt.cmdStoreOptions, flags)
+	return cmd
+}
+
+func runRebalance(ctx context.Context, opt rebalanceOptions, args []string) error {
+	if err := opt.cmdStoreOptions.validate(); err != nil {
+		return err
+	}
+	if opt.store == "" {
+		return errors.New("no store provided")
+	}
+
+	// Open the target store and make sure it's sharded
+	s, err := storeFromLocation(opt.store, opt.cmdStoreOptions)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	sharded, ok := s.(*desync.ShardedStore)
+	if !ok {
+		return fmt.Errorf("store '%s' is not a sharded store", opt.store)
+	}
+
+	// Read the input files and merge all chunk IDs in a map to de-dup them
+	idm := make(map[desync.ChunkID]struct{})
+	for _, name := range args {
+		c, err := readCaibxFile(name, opt.cmdStoreOptions)
+		if err != nil {
+			return err
+		}
+		for _, c := range c.Chunks {
+			idm[c.ID] = struct{}{}
+		}
+	}
+	ids := make([]desync.ChunkID, 0, len(idm))
+	for id := range idm {
+		ids = append(ids, id)
+	}
+
+	// Any additional stores to read chunks from
+	var src desync.Store
+	if len(opt.sources) > 0 {
+		src, err = multiStoreWithRouter(opt.cmdStoreOptions, opt.sources...)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+	}
+
+	// If this is a terminal, we want a progress bar
+	pb := NewProgressBar("")
+
+	return sharded.Rebalance(ctx, ids, src, opt.n, pb)
+}
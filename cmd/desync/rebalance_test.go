@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebalanceCommand(t *testing.T) {
+	// Create two blank stores to be used as shards
+	shard1, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(shard1)
+	shard2, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(shard2)
+	sharded := shard1 + ";" + shard2
+
+	// Move the chunks from the old store into the sharded one
+	cmd := newRebalanceCommand(context.Background())
+	cmd.SetArgs([]string{"-s", sharded, "--from", "testdata/blob1.store", "testdata/blob1.caibx"})
+	stderr = ioutil.Discard
+	cmd.SetOutput(ioutil.Discard)
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+
+	// Both shards should have chunks now
+	for _, dir := range []string{shard1, shard2} {
+		dirs, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		require.NotEmpty(t, dirs)
+	}
+
+	// Extract the blob from the sharded store to confirm all chunks are there
+	out, err := ioutil.TempFile("", "")
+	require.NoError(t, err)
+	out.Close()
+	defer os.Remove(out.Name())
+	extractCmd := newExtractCommand(context.Background())
+	extractCmd.SetArgs([]string{"-s", sharded, "testdata/blob1.caibx", out.Name()})
+	_, err = extractCmd.ExecuteC()
+	require.NoError(t, err)
+}
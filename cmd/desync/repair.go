@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/folbricht/desync"
+	"github.com/folbricht/tempfile"
+	"github.com/spf13/cobra"
+)
+
+type repairOptions struct {
+	cmdStoreOptions
+	stores  []string
+	journal string
+}
+
+func newRepairCommand(ctx context.Context) *cobra.Command {
+	var opt repairOptions
+
+	cmd := &cobra.Command{
+		Use:   "repair-replicas",
+		Short: "Copy chunks into replicated stores that failed to store them",
+		Long: `Reads the journal of failed writes that was recorded while writing to multiple
+stores with make, chop or tar, and copies the affected chunks from any other
+store into the stores that are missing them. The target stores need to be given
+with -s in the same way they were when the journal was written. Any failures
+during the repair, including chunks that can't be read from any store, are
+recorded in a new journal that replaces the previous one once the repair is
+complete. If the repair is interrupted, the previous journal is left unchanged.`,
+		Example: `  desync repair-replicas -s /path/to/store1 -s sftp://192.168.1.1/store --journal failed.log`,
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runRepair(ctx, opt)
+		},
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	flags.StringArrayVarP(&opt.stores, "store", "s", nil, "replicated target stores")
+	flags.StringVar(&opt.journal, "journal", "", "journal of failed writes")
+	addStoreOptions(&opt.cmdStoreOptions, flags)
+	return cmd
+}
+
+func runRepair(ctx context.Context, opt repairOptions) error {
+	if err := opt.cmdStoreOptions.validate(); err != nil {
+		return err
+	}
+	if len(opt.stores) < 2 {
+		return errors.New("at least two stores are required")
+	}
+	if opt.journal == "" {
+		return errors.New("no journal provided")
+	}
+
+	var replicas []desync.WriteStore
+	for _, location := range opt.stores {
+		s, err := WritableStore(location, opt.cmdStoreOptions)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		replicas = append(replicas, s)
+	}
+
+	// Failures during the repair are written into a new journal which replaces
+	// the old one once the repair is done. If the repair is interrupted, the old
+	// journal is kept with all its entries.
+	b, err := ioutil.ReadFile(opt.journal)
+	if err != nil {
+		return err
+	}
+	journal, err := tempfile.NewMode(filepath.Dir(opt.journal), "."+filepath.Base(opt.journal), 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		journal.Close()
+		os.Remove(journal.Name())
+	}()
+
+	// Use a quorum of 1 since the repair only writes to individual replicas
+	s, err := desync.NewReplicatedStore(1, journal, replicas...)
+	if err != nil {
+		return err
+	}
+
+	// If this is a terminal, we want a progress bar
+	pb := NewProgressBar("")
+
+	if err := s.Repair(ctx, bytes.NewReader(b), opt.n, pb); err != nil {
+		return err
+	}
+	if err := journal.Sync(); err != nil {
+		return err
+	}
+	if err := journal.Close(); err != nil {
+		return err
+	}
+	return os.Rename(journal.Name(), opt.journal)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// Reads an Ed25519 private key used to sign indexes. The key is expected to be in
+// OpenSSH format, as created by "ssh-keygen -t ed25519", and can not be encrypted.
+func readSigningKey(name string) (ed25519.PrivateKey, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ssh.ParseRawPrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse key %s : %s", name, err)
+	}
+	switch k := key.(type) {
+	case *ed25519.PrivateKey:
+		return *k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	}
+	return nil, fmt.Errorf("key %s is not an Ed25519 private key", name)
+}
+
+// Reads Ed25519 public keys used to verify index signatures. Each file is expected
+// to contain one key in the format used by OpenSSH in authorized_keys files, like
+// the .pub file created by "ssh-keygen -t ed25519".
+func readVerifyKeys(names []string) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	for _, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse key %s : %s", name, err)
+		}
+		cpk, ok := pub.(ssh.CryptoPublicKey)
+		if !ok {
+			return nil, fmt.Errorf("key %s is not an Ed25519 public key", name)
+		}
+		key, ok := cpk.CryptoPublicKey().(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("key %s is not an Ed25519 public key", name)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"log"
 	"net/url"
+	"os"
 	"path"
 	"path/filepath"
 	"strings"
@@ -10,6 +13,7 @@ import (
 	"github.com/folbricht/desync"
 	"github.com/minio/minio-go"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/ed25519"
 )
 
 // MultiStoreWithCache is used to parse store and cache locations given in the
@@ -34,7 +38,16 @@ func MultiStoreWithCache(cmdOpt cmdStoreOptions, cacheLocation string, storeLoca
 		if ls, ok := cache.(desync.LocalStore); ok {
 			ls.UpdateTimes = true
 		}
-		store = desync.NewCache(store, cache)
+		if cmdOpt.cacheWriteBack > 0 {
+			n := cmdOpt.n
+			if n < 1 {
+				n = 1
+			}
+			logger := log.New(stderr, "", log.LstdFlags)
+			store = desync.NewWriteBackCache(store, cache, n, cmdOpt.cacheWriteBack, logger)
+		} else {
+			store = desync.NewCache(store, cache)
+		}
 	}
 	return store, nil
 }
@@ -73,6 +86,21 @@ func storeGroup(location string, cmdOpt cmdStoreOptions) (desync.Store, error) {
 	return desync.NewFailoverGroup(stores...), nil
 }
 
+// shardedStore parses a store-location string with members separated by ";" and
+// initializes each one before combining them into a ShardedStore. All members need
+// to be writable.
+func shardedStore(location string, cmdOpt cmdStoreOptions) (*desync.ShardedStore, error) {
+	var shards []desync.WriteStore
+	for _, m := range strings.Split(location, ";") {
+		s, err := WritableStore(m, cmdOpt)
+		if err != nil {
+			return nil, err
+		}
+		shards = append(shards, s)
+	}
+	return desync.NewShardedStore(shards...), nil
+}
+
 // WritableStore is used to parse a store location from the command line for
 // commands that expect to write chunks, such as make or tar. It determines
 // which type of writable store is needed, instantiates and returns a
@@ -89,8 +117,58 @@ func WritableStore(location string, cmdOpt cmdStoreOptions) (desync.WriteStore,
 	return store, nil
 }
 
+// replicatedWritableStore is used by commands that write chunks and accept multiple
+// target stores. If more than one location is given, the stores are combined into a
+// ReplicatedStore that writes every chunk to all of them. With just one location it
+// returns the same as WritableStore.
+func replicatedWritableStore(locations []string, rOpt cmdReplicationOptions, cmdOpt cmdStoreOptions) (desync.WriteStore, error) {
+	if len(locations) == 1 {
+		return WritableStore(locations[0], cmdOpt)
+	}
+	var (
+		replicas []desync.WriteStore
+		journal  io.Writer
+	)
+	// Close whatever was opened already if there's an error
+	fail := func(err error) (desync.WriteStore, error) {
+		for _, r := range replicas {
+			r.Close()
+		}
+		if c, ok := journal.(io.Closer); ok {
+			c.Close()
+		}
+		return nil, err
+	}
+	for _, location := range locations {
+		s, err := WritableStore(location, cmdOpt)
+		if err != nil {
+			return fail(err)
+		}
+		replicas = append(replicas, s)
+	}
+	if rOpt.journal != "" {
+		f, err := os.OpenFile(rOpt.journal, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fail(err)
+		}
+		journal = f
+	}
+	s, err := desync.NewReplicatedStore(rOpt.quorum, journal, replicas...)
+	if err != nil {
+		return fail(err)
+	}
+	return s, nil
+}
+
 // Parse a single store URL or path and return an initialized instance of it
 func storeFromLocation(location string, cmdOpt cmdStoreOptions) (desync.Store, error) {
+	if strings.Contains(location, ";") {
+		s, err := shardedStore(location, cmdOpt)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
 	loc, err := url.Parse(location)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to parse store location %s : %s", location, err)
@@ -149,11 +227,19 @@ func storeFromLocation(location string, cmdOpt cmdStoreOptions) (desync.Store, e
 		if err != nil {
 			return nil, err
 		}
+		return s, nil
+	}
+	// Only requests to remote stores are limited with adaptive concurrency
+	if cmdOpt.adaptive {
+		s = cmdOpt.adaptiveStores.wrap(s, cmdOpt)
 	}
 	return s, nil
 }
 
 func readCaibxFile(location string, cmdOpt cmdStoreOptions) (c desync.Index, err error) {
+	if location == "-" && len(cmdOpt.indexVerifyKeys()) > 0 {
+		return c, errors.New("unable to verify the signature of an index read from STDIN")
+	}
 	is, indexName, err := indexStoreFromLocation(location, cmdOpt)
 	if err != nil {
 		return c, err
@@ -172,6 +258,33 @@ func storeCaibxFile(idx desync.Index, location string, cmdOpt cmdStoreOptions) e
 	return is.StoreIndex(indexName, idx)
 }
 
+// Writes the SHA-256 digest of a blob next to its index.
+func storeBlobDigest(digest []byte, location string, cmdOpt cmdStoreOptions) error {
+	if location == "-" {
+		return errors.New("unable to store the blob digest of an index written to STDOUT")
+	}
+	is, indexName, err := indexStoreFromLocation(location, cmdOpt)
+	if err != nil {
+		return err
+	}
+	defer is.Close()
+	return errors.Wrap(desync.StoreBlobDigest(is, indexName, digest), location)
+}
+
+// Reads the SHA-256 digest of a blob that was stored next to its index.
+func readBlobDigest(location string, cmdOpt cmdStoreOptions) ([]byte, error) {
+	if location == "-" {
+		return nil, errors.New("unable to read the blob digest of an index read from STDIN")
+	}
+	is, indexName, err := indexStoreFromLocation(location, cmdOpt)
+	if err != nil {
+		return nil, err
+	}
+	defer is.Close()
+	digest, err := desync.GetBlobDigest(is, indexName)
+	return digest, errors.Wrap(err, location)
+}
+
 // WritableIndexStore is used to parse a store location from the command line for
 // commands that expect to write indexes, such as make or tar. It determines
 // which type of writable store is needed, instantiates and returns a
@@ -265,5 +378,25 @@ func indexStoreFromLocation(location string, cmdOpt cmdStoreOptions) (desync.Ind
 			indexName = filepath.Base(location)
 		}
 	}
+
+	// Sign and/or verify indexes if any keys were provided
+	verifyKeys := cmdOpt.indexVerifyKeys()
+	if cmdOpt.signKey != "" || len(verifyKeys) > 0 {
+		var key ed25519.PrivateKey
+		if cmdOpt.signKey != "" {
+			if location == "-" {
+				return nil, "", errors.New("signing is not supported for indexes written to STDOUT")
+			}
+			key, err = readSigningKey(cmdOpt.signKey)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+		keys, err := readVerifyKeys(verifyKeys)
+		if err != nil {
+			return nil, "", err
+		}
+		s = desync.NewSignedIndexStore(s, key, keys...)
+	}
 	return s, indexName, nil
 }
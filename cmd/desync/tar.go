@@ -4,9 +4,13 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/folbricht/desync"
 	"github.com/spf13/cobra"
@@ -14,10 +18,16 @@ import (
 
 type tarOptions struct {
 	cmdStoreOptions
-	store         string
-	chunkSize     string
-	createIndex   bool
-	oneFileSystem bool
+	cmdReplicationOptions
+	desync.TarOptions
+	stores       []string
+	chunkSize    string
+	createIndex  bool
+	digest       bool
+	reproducible bool
+	clampMTime   string
+	owner        string
+	inputFormat  string
 }
 
 func newTarCommand(ctx context.Context) *cobra.Command {
@@ -28,9 +38,33 @@ func newTarCommand(ctx context.Context) *cobra.Command {
 		Short: "Store a directory tree in a catar archive or index",
 		Long: `Encodes a directory tree into a catar archive or alternatively an index file
 with the archive chunked into a store. Use '-' to write the output,
-catar or index to STDOUT.`,
+catar or index to STDOUT.
+
+With --input-format=tar, the source is a tar file (plain, gzip or zstd
+compressed) rather than a directory, and is encoded without unpacking it to
+disk. Use '-' to read the tar stream from STDIN. Hardlinks in the tar stream are
+stored as copies of the file. ACLs and SELinux labels are read from the records
+GNU tar writes with --acls and --selinux, or from SCHILY.xattr records.
+
+Files and directories can be left out of the archive with --exclude, using
+glob patterns relative to the source. Patterns without a slash match names at
+any depth, '**' matches any number of directories, and a trailing slash only
+matches directories. Like casync, patterns are also read from .caexclude files
+in the source, and files and directories with the nodump flag (chattr +d) are
+skipped.
+
+With --reproducible, archives don't depend on who created them. Files are
+stored as owned by 0:0 (or --owner), with normalized permissions, without chattr
+flags and with times truncated to seconds (or --time-granularity). Modification
+times later than SOURCE_DATE_EPOCH (or --clamp-mtime) are replaced with it.
+Without either, the modification times of the files are stored as they are, so
+touching a file changes the archive. Device numbers of device nodes are stored
+as found on the host.`,
 		Example: `  desync tar documents.catar $HOME/Documents
-  desync make -s /path/to/local pics.caibx $HOME/Pictures`,
+  desync make -s /path/to/local pics.caibx $HOME/Pictures
+  desync tar --exclude '*.o' --exclude build/ src.catar $HOME/src
+  SOURCE_DATE_EPOCH=1577836800 desync tar --reproducible -i -s /path/to/local build.caidx ./build
+  docker export container | desync tar --input-format=tar -i -s /path/to/local rootfs.caidx -`,
 		Args: cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return runTar(ctx, opt, args)
@@ -38,11 +72,25 @@ catar or index to STDOUT.`,
 		SilenceUsage: true,
 	}
 	flags := cmd.Flags()
-	flags.StringVarP(&opt.store, "store", "s", "", "target store (used with -i)")
+	flags.StringArrayVarP(&opt.stores, "store", "s", nil, "target store(s) (used with -i)")
 	flags.StringVarP(&opt.chunkSize, "chunk-size", "m", "16:64:256", "min:avg:max chunk size in kb")
 	flags.BoolVarP(&opt.createIndex, "index", "i", false, "create index file (caidx), not catar")
-	flags.BoolVarP(&opt.oneFileSystem, "one-file-system", "x", false, "don't cross filesystem boundaries")
+	flags.StringVar(&opt.inputFormat, "input-format", "disk", "format of the source, 'disk' for a directory or 'tar' for a tar file")
+	flags.BoolVarP(&opt.OneFileSystem, "one-file-system", "x", false, "don't cross filesystem boundaries")
+	flags.StringArrayVar(&opt.Exclude, "exclude", nil, "leave out files and directories matching this pattern")
+	flags.BoolVar(&opt.NoExcludeFile, "no-exclude-file", false, "ignore "+desync.ExcludeFileName+" files")
+	flags.BoolVar(&opt.IncludeNoDump, "include-nodump", false, "include files and directories with the nodump flag")
+	flags.BoolVar(&opt.NoChattr, "no-chattr", false, "don't store chattr flags like immutable or nocow")
+	flags.BoolVar(&opt.reproducible, "reproducible", false, "create the same archive for the same content, implies --owner 0:0 --normalize-permissions --no-chattr --time-granularity 1s")
+	flags.StringVar(&opt.clampMTime, "clamp-mtime", "", "store later modification times as this time, in seconds since epoch or RFC3339")
+	flags.DurationVar(&opt.TimeGranularity, "time-granularity", 0, "granularity of modification times, 1ns, 1us, 1s or 2s")
+	flags.StringVar(&opt.owner, "owner", "", "store all files as owned by this <uid>:<gid>")
+	flags.BoolVar(&opt.NormalizePermissions, "normalize-permissions", false, "store permissions as 0755 for directories and executables, 0644 for other files")
+	flags.StringArrayVar(&opt.ExcludeXattrs, "exclude-xattr", nil, "don't store extended attributes matching this pattern")
+	flags.BoolVarP(&opt.digest, "digest", "", false, "store the SHA-256 digest of the archive next to the index (used with -i)")
 	addStoreOptions(&opt.cmdStoreOptions, flags)
+	addIndexSignOptions(&opt.cmdStoreOptions, flags)
+	addReplicationOptions(&opt.cmdReplicationOptions, flags)
 	return cmd
 }
 
@@ -50,13 +98,42 @@ func runTar(ctx context.Context, opt tarOptions, args []string) error {
 	if err := opt.cmdStoreOptions.validate(); err != nil {
 		return err
 	}
-	if opt.createIndex && opt.store == "" {
+	if opt.createIndex && len(opt.stores) == 0 {
 		return errors.New("-i requires a store (-s <location>)")
 	}
+	if opt.digest && (!opt.createIndex || args[0] == "-") {
+		return errors.New("--digest requires an index (-i) that is not written to STDOUT")
+	}
+	if err := opt.parseReproducibleOptions(); err != nil {
+		return err
+	}
 
 	output := args[0]
 	source := args[1]
 
+	// Pick the encoder for the source, either a directory or a tar stream
+	var encode func(io.Writer) error
+	switch opt.inputFormat {
+	case "disk":
+		encode = func(w io.Writer) error {
+			return desync.Tar(ctx, w, source, opt.TarOptions)
+		}
+	case "tar":
+		encode = func(w io.Writer) error {
+			if source == "-" {
+				return desync.ImportTar(ctx, w, os.Stdin, opt.TarOptions)
+			}
+			f, err := os.Open(source)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return desync.ImportTar(ctx, w, f, opt.TarOptions)
+		}
+	default:
+		return fmt.Errorf("invalid input format %q, expected 'disk' or 'tar'", opt.inputFormat)
+	}
+
 	// Just make the catar and stop if that's all that was required
 	if !opt.createIndex {
 		var w io.Writer
@@ -70,7 +147,7 @@ func runTar(ctx context.Context, opt tarOptions, args []string) error {
 			defer f.Close()
 			w = f
 		}
-		return desync.Tar(ctx, w, source, opt.oneFileSystem)
+		return encode(w)
 	}
 
 	// An index is requested, so stream the output of the tar command directly
@@ -78,7 +155,7 @@ func runTar(ctx context.Context, opt tarOptions, args []string) error {
 	r, w := io.Pipe()
 
 	// Open the target store
-	s, err := WritableStore(opt.store, opt.cmdStoreOptions)
+	s, err := replicatedWritableStore(opt.stores, opt.cmdReplicationOptions, opt.cmdStoreOptions)
 	if err != nil {
 		return err
 	}
@@ -89,7 +166,15 @@ func runTar(ctx context.Context, opt tarOptions, args []string) error {
 	if err != nil {
 		return err
 	}
-	c, err := desync.NewChunker(r, min, avg, max)
+	// Hash the archive on its way into the chunker if its digest is needed
+	var (
+		in   io.Reader = r
+		hash           = sha256.New()
+	)
+	if opt.digest {
+		in = io.TeeReader(r, hash)
+	}
+	c, err := desync.NewChunker(in, min, avg, max)
 	if err != nil {
 		return err
 	}
@@ -97,7 +182,7 @@ func runTar(ctx context.Context, opt tarOptions, args []string) error {
 	// Run the tar bit in a goroutine, writing to the pipe
 	var tarErr error
 	go func() {
-		tarErr = desync.Tar(ctx, w, source, opt.oneFileSystem)
+		tarErr = encode(w)
 		w.Close()
 	}()
 
@@ -108,13 +193,63 @@ func runTar(ctx context.Context, opt tarOptions, args []string) error {
 		return err
 	}
 
-	index.Index.FeatureFlags |= desync.TarFeatureFlags
+	index.Index.FeatureFlags |= opt.FeatureFlags()
 
 	// See if Tar encountered an error along the way
 	if tarErr != nil {
 		return tarErr
 	}
 
-	// Write the index
-	return storeCaibxFile(index, output, opt.cmdStoreOptions)
+	// Write the index, and the digest of the archive if requested
+	if err := storeCaibxFile(index, output, opt.cmdStoreOptions); err != nil {
+		return err
+	}
+	if opt.digest {
+		return storeBlobDigest(hash.Sum(nil), output, opt.cmdStoreOptions)
+	}
+	return nil
+}
+
+// Sets the options for reproducible archives from the command line and the
+// SOURCE_DATE_EPOCH environment variable.
+func (o *tarOptions) parseReproducibleOptions() error {
+	clamp := o.clampMTime
+	if o.reproducible {
+		if clamp == "" {
+			clamp = os.Getenv("SOURCE_DATE_EPOCH")
+		}
+		if o.TimeGranularity == 0 {
+			o.TimeGranularity = time.Second
+		}
+		o.NormalizeOwner = true
+		o.NormalizePermissions = true
+		o.NoChattr = true
+	}
+	if clamp != "" {
+		t, err := parseTimestamp(clamp)
+		if err != nil {
+			return err
+		}
+		o.ClampMTime = t
+	}
+	if o.owner != "" {
+		if _, err := fmt.Sscanf(o.owner, "%d:%d", &o.UID, &o.GID); err != nil {
+			return fmt.Errorf("invalid owner %q, expected <uid>:<gid>", o.owner)
+		}
+		o.NormalizeOwner = true
+	}
+	return nil
+}
+
+// Parses a time given in seconds since epoch, like SOURCE_DATE_EPOCH, or in
+// RFC3339 format.
+func parseTimestamp(s string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected seconds since epoch or RFC3339", s)
+	}
+	return t, nil
 }
@@ -4,10 +4,12 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -39,3 +41,111 @@ func TestTarCommandIndex(t *testing.T) {
 	_, err = cmd.ExecuteC()
 	require.NoError(t, err)
 }
+
+func TestTarCommandIndexExclude(t *testing.T) {
+	out, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(out)
+	index := filepath.Join(out, "tree.caidx")
+
+	// Build an index leaving out a directory and a file
+	cmd := newTarCommand(context.Background())
+	cmd.SetArgs([]string{"-s", out, "-i", "--exclude", "subdir1", "--exclude", "/subdir2/f2", index, "testdata/tree"})
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+
+	// Extract it again, the excluded files should be missing
+	dst := filepath.Join(out, "dst")
+	require.NoError(t, os.Mkdir(dst, 0755))
+	cmd = newUntarCommand(context.Background())
+	cmd.SetArgs([]string{"-s", out, "-i", "--no-same-owner", "--no-same-permissions", index, dst})
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+
+	_, err = os.Stat(filepath.Join(dst, "subdir1"))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dst, "subdir2", "f2"))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dst, "subdir3", "f3"))
+	require.NoError(t, err)
+}
+
+func TestTarCommandReproducible(t *testing.T) {
+	out, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(out)
+	src := filepath.Join(out, "src")
+	require.NoError(t, os.Mkdir(src, 0755))
+	file := filepath.Join(src, "file")
+	require.NoError(t, ioutil.WriteFile(file, []byte("content"), 0644))
+
+	os.Setenv("SOURCE_DATE_EPOCH", "1577836800")
+	defer os.Unsetenv("SOURCE_DATE_EPOCH")
+
+	// Build the index twice, with different permissions and times on the file
+	var indexes [][]byte
+	for i, mode := range []os.FileMode{0644, 0640} {
+		require.NoError(t, os.Chmod(file, mode))
+		mtime := time.Now().Add(time.Duration(i) * time.Hour)
+		require.NoError(t, os.Chtimes(file, mtime, mtime))
+
+		index := filepath.Join(out, fmt.Sprintf("%d.caidx", i))
+		cmd := newTarCommand(context.Background())
+		cmd.SetArgs([]string{"-s", out, "-i", "--reproducible", index, src})
+		_, err = cmd.ExecuteC()
+		require.NoError(t, err)
+		b, err := ioutil.ReadFile(index)
+		require.NoError(t, err)
+		indexes = append(indexes, b)
+	}
+	require.Equal(t, indexes[0], indexes[1])
+
+	// chattr flags aren't stored
+	opt := tarOptions{reproducible: true}
+	require.NoError(t, opt.parseReproducibleOptions())
+	require.True(t, opt.NoChattr)
+
+	// Invalid options
+	cmd := newTarCommand(context.Background())
+	cmd.SetArgs([]string{"--owner", "nobody", filepath.Join(out, "a.catar"), src})
+	_, err = cmd.ExecuteC()
+	require.Error(t, err)
+}
+
+func TestTarCommandTarInput(t *testing.T) {
+	out, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(out)
+	archive := filepath.Join(out, "tree.catar")
+	tarFile := filepath.Join(out, "tree.tar")
+	converted := filepath.Join(out, "converted.catar")
+
+	// Build a catar from the directory and export it as tar file
+	cmd := newTarCommand(context.Background())
+	cmd.SetArgs([]string{archive, "testdata/tree"})
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+
+	cmd = newExportTarCommand(context.Background())
+	cmd.SetArgs([]string{archive, tarFile})
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+
+	// Encoding the tar file again should give the same archive
+	cmd = newTarCommand(context.Background())
+	cmd.SetArgs([]string{"--input-format", "tar", converted, tarFile})
+	_, err = cmd.ExecuteC()
+	require.NoError(t, err)
+
+	b1, err := ioutil.ReadFile(archive)
+	require.NoError(t, err)
+	b2, err := ioutil.ReadFile(converted)
+	require.NoError(t, err)
+	require.Equal(t, b1, b2)
+
+	// Unknown input format
+	cmd = newTarCommand(context.Background())
+	cmd.SetArgs([]string{"--input-format", "zip", converted, tarFile})
+	_, err = cmd.ExecuteC()
+	require.Error(t, err)
+}
@@ -15,9 +15,12 @@ import (
 type untarOptions struct {
 	cmdStoreOptions
 	desync.UntarOptions
-	stores    []string
-	cache     string
-	readIndex bool
+	stores     []string
+	cache      string
+	readIndex  bool
+	printStats bool
+	ownerMap   string
+	paths      []string
 }
 
 func newUntarCommand(ctx context.Context) *cobra.Command {
@@ -27,9 +30,23 @@ func newUntarCommand(ctx context.Context) *cobra.Command {
 		Use:   "untar <catar|index> <target>",
 		Short: "Extract directory tree from a catar archive or index",
 		Long: `Extracts a directory tree from a catar file or an index. Use '-' to read the
-index from STDIN.`,
+index from STDIN. When reading an index with --adaptive, the number of
+concurrent requests to remote stores is adjusted between 1 and --adaptive-max
+based on latency, throughput and throttling by the store. Chunks are then
+retrieved and decompressed by --adaptive-max goroutines instead of -n.
+
+Files are owned by the same numeric user and group IDs as in the archive. With
+--owner-by-name, the user and group names stored in the archive are used
+instead, if they exist on this host. Owners can also be mapped explicitly with
+--owner-map, using a file with one mapping per line in the form
+"user|group <name or ID in archive> <local name or ID>".
+
+With --path, only the given files or directories are extracted, along with
+everything below them. They're located with the goodbye tables of the archive,
+and only the chunks needed to find and extract them are retrieved.`,
 		Example: `  desync untar docs.catar /tmp/documents
-  desync untar -s http://192.168.1.1/ -c /path/to/local docs.caidx /tmp/documents`,
+  desync untar -s http://192.168.1.1/ -c /path/to/local docs.caidx /tmp/documents
+  desync untar -s http://192.168.1.1/ -i --path etc/os-release rootfs.caidx /tmp/rootfs`,
 		Args: cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return runUntar(ctx, opt, args)
@@ -40,9 +57,19 @@ index from STDIN.`,
 	flags.StringSliceVarP(&opt.stores, "store", "s", nil, "source store(s), used with -i")
 	flags.StringVarP(&opt.cache, "cache", "c", "", "store to be used as cache")
 	flags.BoolVarP(&opt.readIndex, "index", "i", false, "read index file (caidx), not catar")
-	flags.BoolVar(&opt.NoSameOwner, "no-same-owner", false, "extract files as current user")
+	flags.BoolVar(&opt.NoSameOwner, "no-same-owner", false, "extract files as current user, without SELinux labels and file capabilities")
 	flags.BoolVar(&opt.NoSamePermissions, "no-same-permissions", false, "use current user's umask instead of what is in the archive")
+	flags.BoolVar(&opt.NoSELinux, "no-selinux", false, "don't restore SELinux labels")
+	flags.BoolVar(&opt.NoFCaps, "no-fcaps", false, "don't restore file capabilities")
+	flags.BoolVar(&opt.NoChattr, "no-chattr", false, "don't restore chattr flags like immutable or nocow")
+	flags.BoolVar(&opt.OwnerByName, "owner-by-name", false, "set owners by user and group name rather than ID where possible")
+	flags.StringArrayVar(&opt.paths, "path", nil, "only extract this file or directory from the archive, can be used multiple times")
+	flags.StringVar(&opt.ownerMap, "owner-map", "", "map users and groups in the archive to local ones as listed in this file")
 	addStoreOptions(&opt.cmdStoreOptions, flags)
+	addIndexVerifyOptions(&opt.cmdStoreOptions, flags)
+	flags.BoolVar(&opt.printStats, "print-stats", false, "print statistics of stores with adaptive concurrency, used with -i")
+	addCacheOptions(&opt.cmdStoreOptions, flags)
+	addAdaptiveOptions(&opt.cmdStoreOptions, flags)
 	return cmd
 }
 
@@ -53,6 +80,17 @@ func runUntar(ctx context.Context, opt untarOptions, args []string) error {
 	if opt.readIndex && len(opt.stores) == 0 {
 		return errors.New("-i requires at least one store (-s <location>)")
 	}
+	if opt.ownerMap != "" {
+		f, err := os.Open(opt.ownerMap)
+		if err != nil {
+			return err
+		}
+		opt.OwnerMap, err = desync.NewOwnerMap(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
 
 	input := args[0]
 	targetDir := args[1]
@@ -64,6 +102,13 @@ func runUntar(ctx context.Context, opt untarOptions, args []string) error {
 			return err
 		}
 		defer f.Close()
+		if len(opt.paths) > 0 {
+			info, err := f.Stat()
+			if err != nil {
+				return err
+			}
+			return desync.UnTarPaths(ctx, f, info.Size(), targetDir, opt.paths, opt.UntarOptions)
+		}
 		var r io.Reader = f
 		pb := NewProgressBar("Unpacking ")
 		if pb != nil {
@@ -92,5 +137,16 @@ func runUntar(ctx context.Context, opt untarOptions, args []string) error {
 		return err
 	}
 
-	return desync.UnTarIndex(ctx, targetDir, index, s, opt.n, opt.UntarOptions, NewProgressBar("Unpacking "))
+	if len(opt.paths) > 0 {
+		err = desync.UnTarIndexPaths(ctx, targetDir, index, s, opt.requests(), opt.paths, opt.UntarOptions, NewProgressBar("Unpacking "))
+	} else {
+		err = desync.UnTarIndex(ctx, targetDir, index, s, opt.requests(), opt.UntarOptions, NewProgressBar("Unpacking "))
+	}
+	if err != nil {
+		return err
+	}
+	if opt.printStats {
+		return printJSON(stdout, storeStats{Stores: opt.adaptiveStores.stats()})
+	}
+	return nil
 }
@@ -6,6 +6,7 @@ import (
 	"context"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -36,3 +37,32 @@ func TestUntarCommandIndex(t *testing.T) {
 	_, err = cmd.ExecuteC()
 	require.NoError(t, err)
 }
+
+func TestUntarCommandPaths(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		args []string
+	}{
+		{"catar", []string{"testdata/tree.catar"}},
+		{"caidx", []string{"-s", "testdata/tree.store", "-i", "testdata/tree.caidx"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			out, err := ioutil.TempDir("", "")
+			require.NoError(t, err)
+			defer os.RemoveAll(out)
+
+			// Only extract one directory and one file
+			cmd := newUntarCommand(context.Background())
+			cmd.SetArgs(append([]string{"--no-same-owner", "--no-same-permissions", "--path", "subdir1", "--path", "/nested1/nested2/f"}, append(test.args, out)...))
+			_, err = cmd.ExecuteC()
+			require.NoError(t, err)
+
+			_, err = os.Stat(filepath.Join(out, "subdir1", "f1"))
+			require.NoError(t, err)
+			_, err = os.Stat(filepath.Join(out, "nested1", "nested2", "f"))
+			require.NoError(t, err)
+			_, err = os.Stat(filepath.Join(out, "subdir2"))
+			require.True(t, os.IsNotExist(err))
+		})
+	}
+}
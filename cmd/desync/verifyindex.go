@@ -9,6 +9,7 @@ import (
 
 type verifyIndexOptions struct {
 	cmdStoreOptions
+	digest bool
 }
 
 func newVerifyIndexCommand(ctx context.Context) *cobra.Command {
@@ -27,6 +28,7 @@ from STDIN.`,
 		SilenceUsage: true,
 	}
 	flags := cmd.Flags()
+	flags.BoolVar(&opt.digest, "verify-digest", false, "verify the blob against the SHA-256 digest stored next to the index")
 	addStoreOptions(&opt.cmdStoreOptions, flags)
 	return cmd
 }
@@ -46,6 +48,13 @@ func runVerifyIndex(ctx context.Context, opt verifyIndexOptions, args []string)
 	// If this is a terminal, we want a progress bar
 	pb := NewProgressBar("")
 
-	// Chop up the file into chunks and store them in the target store
+	// Compare the blob to the index, and to its digest if requested
+	if opt.digest {
+		digest, err := readBlobDigest(indexFile, opt.cmdStoreOptions)
+		if err != nil {
+			return err
+		}
+		return desync.VerifyIndexDigest(ctx, dataFile, idx, digest, opt.n, pb)
+	}
 	return desync.VerifyIndex(ctx, dataFile, idx, opt.n, pb)
 }
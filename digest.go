@@ -0,0 +1,216 @@
+package desync
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// IndexDigestExt is appended to the name of an index to store the SHA-256 digest
+// of the whole blob in the same index store.
+const IndexDigestExt = ".sha256"
+
+// IndexDigestWriteStore is implemented by index stores that can store blob
+// digests next to the indexes.
+type IndexDigestWriteStore interface {
+	StoreIndexDigest(name string, b []byte) error
+}
+
+// StoreBlobDigest writes the SHA-256 digest of a blob next to its index in the
+// store. The digest is stored in hex, like the output of sha256sum.
+func StoreBlobDigest(s IndexStore, name string, digest []byte) error {
+	ws, ok := s.(IndexDigestWriteStore)
+	if !ok {
+		return errors.Errorf("index store '%s' does not support blob digests", s)
+	}
+	return ws.StoreIndexDigest(name+IndexDigestExt, []byte(hex.EncodeToString(digest)+"\n"))
+}
+
+// GetBlobDigest reads the SHA-256 digest of a blob that was stored next to its
+// index.
+func GetBlobDigest(s IndexStore, name string) ([]byte, error) {
+	r, err := s.GetIndexReader(name + IndexDigestExt)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading blob digest")
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(r, 1024))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading blob digest")
+	}
+	return parseBlobDigest(b)
+}
+
+// Parses a digest in hex format. Anything following the digest, like a filename
+// in the output of sha256sum, is ignored.
+func parseBlobDigest(b []byte) ([]byte, error) {
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return nil, errors.New("invalid blob digest")
+	}
+	digest, err := hex.DecodeString(fields[0])
+	if err != nil || len(digest) != sha256.Size {
+		return nil, errors.New("invalid blob digest")
+	}
+	return digest, nil
+}
+
+// BlobDigest calculates the SHA-256 digest of a file.
+func BlobDigest(ctx context.Context, name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	buf := make([]byte, 64*1024)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, Interrupted{}
+		default:
+		}
+		n, err := f.Read(buf)
+		h.Write(buf[:n])
+		if err == io.EOF {
+			return h.Sum(nil), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Calculates the SHA-256 digest of a file that is written or read out of order,
+// one range at a time. As soon as the ranges are contiguous from the start of
+// the file, the data is read back and hashed in the background. The data is
+// typically still in the page cache at that point.
+type fileDigest struct {
+	f       *os.File
+	size    uint64
+	chunks  []IndexChunk
+	hash    hash.Hash
+	mu      sync.Mutex
+	ranges  map[uint64]uint64 // start -> end of completed byte ranges
+	next    uint64            // offset of the next byte to be hashed
+	notify  chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+	err     error
+}
+
+// Returns a digest for a file that is built from the chunks of an index.
+func newFileDigest(name string, idx Index) (*fileDigest, error) {
+	d, err := newFileRangeDigest(name, uint64(idx.Length()))
+	if err != nil {
+		return nil, err
+	}
+	d.chunks = idx.Chunks
+	return d, nil
+}
+
+// Returns a digest for a file of the given size that is completed in ranges of
+// bytes.
+func newFileRangeDigest(name string, size uint64) (*fileDigest, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	d := &fileDigest{
+		f:       f,
+		size:    size,
+		hash:    sha256.New(),
+		ranges:  make(map[uint64]uint64),
+		notify:  make(chan struct{}, 1),
+		stopped: make(chan struct{}),
+	}
+	go d.run()
+	return d, nil
+}
+
+// Records a range of chunks of the index as complete.
+func (d *fileDigest) add(first, last int) {
+	d.addRange(d.chunks[first].Start, d.chunks[last].Start+d.chunks[last].Size)
+}
+
+// Records the bytes from start up to end as complete.
+func (d *fileDigest) addRange(start, end uint64) {
+	d.mu.Lock()
+	d.ranges[start] = end
+	d.mu.Unlock()
+	select {
+	case d.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Hashes contiguous data until all ranges have been hashed, or an error occurs.
+func (d *fileDigest) run() {
+	defer close(d.stopped)
+	for range d.notify {
+		for {
+			// Find the end of the contiguous ranges that haven't been hashed yet
+			d.mu.Lock()
+			end := d.next
+			for {
+				next, ok := d.ranges[end]
+				if !ok {
+					break
+				}
+				delete(d.ranges, end)
+				end = next
+			}
+			d.mu.Unlock()
+			if end == d.next {
+				break
+			}
+			if _, err := io.Copy(d.hash, io.NewSectionReader(d.f, int64(d.next), int64(end-d.next))); err != nil {
+				d.err = err
+				return
+			}
+			d.next = end
+		}
+	}
+}
+
+// Stops hashing and releases the file. Can be called more than once.
+func (d *fileDigest) close() {
+	d.once.Do(func() {
+		close(d.notify)
+		<-d.stopped
+		d.f.Close()
+	})
+}
+
+// Stops hashing and returns the digest. Fails if not all chunks were hashed.
+func (d *fileDigest) sum() ([]byte, error) {
+	d.close()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if d.next != d.size {
+		return nil, errors.New("unable to calculate digest of incomplete blob")
+	}
+	return d.hash.Sum(nil), nil
+}
+
+// Compares the digest to the expected one.
+func (d *fileDigest) verify(expected []byte) ([]byte, error) {
+	digest, err := d.sum()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(digest, expected) {
+		return digest, BlobDigestMismatch{Expected: expected, Actual: digest}
+	}
+	return digest, nil
+}
@@ -0,0 +1,109 @@
+package desync
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlobDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := filepath.Join(dir, "store")
+	if err := os.Mkdir(store, 0755); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewLocalStore(store, StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Build an index from random chunks
+	size := 1024
+	var (
+		idx  Index
+		data []byte
+	)
+	for i := 0; i < 20; i++ {
+		b := make([]byte, size)
+		rand.Read(b)
+		chunk := NewChunkFromUncompressed(b)
+		if err := s.StoreChunk(chunk); err != nil {
+			t.Fatal(err)
+		}
+		idx.Chunks = append(idx.Chunks, IndexChunk{ID: chunk.ID(), Start: uint64(i * size), Size: uint64(size)})
+		data = append(data, b...)
+	}
+	expected := sha256.Sum256(data)
+
+	// Extract with several goroutines so chunks are written out of order
+	target := filepath.Join(dir, "target")
+	stats, err := AssembleFile(context.Background(), target, idx, s, nil, 4, AssembleOptions{Digest: expected[:]}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Digest == "" {
+		t.Fatal("expected digest in stats")
+	}
+	if err := VerifyIndexDigest(context.Background(), target, idx, expected[:], 4, nil); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := BlobDigest(context.Background(), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(digest) != string(expected[:]) {
+		t.Fatal("digest of file doesn't match expected")
+	}
+
+	// A different digest should fail the extract and the verification
+	wrong := sha256.Sum256(nil)
+	_, err = AssembleFile(context.Background(), target, idx, s, nil, 4, AssembleOptions{Digest: wrong[:]}, nil)
+	if _, ok := err.(BlobDigestMismatch); !ok {
+		t.Fatalf("expected BlobDigestMismatch, got %v", err)
+	}
+	err = VerifyIndexDigest(context.Background(), target, idx, wrong[:], 4, nil)
+	if _, ok := err.(BlobDigestMismatch); !ok {
+		t.Fatalf("expected BlobDigestMismatch, got %v", err)
+	}
+}
+
+func TestBlobDigestSidecar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewLocalIndexStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("data"))
+	if err := StoreBlobDigest(s, "blob.caibx", digest[:]); err != nil {
+		t.Fatal(err)
+	}
+	got, err := GetBlobDigest(s, "blob.caibx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(digest[:]) {
+		t.Fatal("digest read from store doesn't match")
+	}
+
+	// Output of sha256sum should be accepted as well
+	if _, err := parseBlobDigest([]byte("3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7  blob.img\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseBlobDigest([]byte("abc")); err == nil {
+		t.Fatal("expected error for invalid digest")
+	}
+}
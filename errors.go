@@ -39,6 +39,47 @@ func (e InvalidFormat) Error() string {
 	return fmt.Sprintf("invalid archive format : %s", e.Msg)
 }
 
+// IndexSignatureInvalid is returned when the signature of an index doesn't match
+// any of the trusted keys
+type IndexSignatureInvalid struct{}
+
+func (e IndexSignatureInvalid) Error() string {
+	return "index signature does not match any of the trusted keys"
+}
+
+// SeedInvalid is returned when the data of a seed file doesn't match its index,
+// for example because the file was modified after the index was created
+type SeedInvalid struct {
+	File string
+}
+
+func (e SeedInvalid) Error() string {
+	return fmt.Sprintf("seed index for %s doesn't match its data", e.File)
+}
+
+// BlobDigestMismatch is returned when the SHA-256 digest of a blob doesn't match
+// the digest recorded for its index
+type BlobDigestMismatch struct {
+	Expected []byte
+	Actual   []byte
+}
+
+func (e BlobDigestMismatch) Error() string {
+	return fmt.Sprintf("blob digest %x does not match expected %x", e.Actual, e.Expected)
+}
+
+// StoreThrottled is returned by remote stores when the server rejected a request
+// because it's overloaded or received too many requests, for example with HTTP
+// status 429 or 503
+type StoreThrottled struct {
+	Location string
+	Status   int
+}
+
+func (e StoreThrottled) Error() string {
+	return fmt.Sprintf("request to %s throttled with status code %d", e.Location, e.Status)
+}
+
 // Interrupted is returned when a user interrupted a long-running operation, for
 // example by pressing Ctrl+C
 type Interrupted struct{}
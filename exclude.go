@@ -0,0 +1,156 @@
+package desync
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ExcludeFileName is the name of files listing patterns of files to leave out
+// of archives, like in casync. Patterns in it apply to the directory the file
+// is in and everything below.
+const ExcludeFileName = ".caexclude"
+
+// Pattern of files to exclude from an archive. The syntax is similar to
+// .gitignore files:
+//
+//   - Patterns are matched with path.Match, "**" matches any number of
+//     directories.
+//   - A pattern without a slash matches files and directories with that name
+//     at any depth. Patterns with a slash (other than a trailing one) are
+//     relative to the directory of the .caexclude file, or the root of the
+//     archive if given on the command line.
+//   - A trailing slash only matches directories.
+//   - A leading ! includes files that were excluded by an earlier pattern. The
+//     last matching pattern wins.
+type excludePattern struct {
+	dir      string   // Directory the pattern is relative to, "" for the root
+	segments []string // Pattern split at slashes
+	anchored bool
+	dirOnly  bool
+	negate   bool
+}
+
+type excludePatterns []excludePattern
+
+// Parses exclude patterns relative to a directory in the archive. Empty
+// patterns and comments starting with # are ignored.
+func parseExcludePatterns(patterns []string, dir string) (excludePatterns, error) {
+	var p excludePatterns
+	for _, pattern := range patterns {
+		s := strings.TrimSpace(pattern)
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		e := excludePattern{dir: dir}
+		if strings.HasPrefix(s, "!") {
+			e.negate = true
+			s = s[1:]
+		}
+		if strings.HasSuffix(s, "/") {
+			e.dirOnly = true
+			s = strings.TrimRight(s, "/")
+		}
+		if strings.Contains(s, "/") {
+			e.anchored = true
+			s = strings.TrimLeft(s, "/")
+		}
+		if s == "" {
+			return nil, fmt.Errorf("invalid exclude pattern %q", pattern)
+		}
+		e.segments = strings.Split(s, "/")
+		for _, seg := range e.segments {
+			if _, err := path.Match(seg, ""); err != nil {
+				return nil, fmt.Errorf("invalid exclude pattern %q: %s", pattern, err)
+			}
+		}
+		p = append(p, e)
+	}
+	return p, nil
+}
+
+// Reads the exclude file in a directory, if there is one, and returns its
+// patterns appended to the existing ones. dir is the path of the directory
+// relative to the root of the archive.
+func (p excludePatterns) withExcludeFile(fsDir, dir string) (excludePatterns, error) {
+	f, err := os.Open(filepath.Join(fsDir, ExcludeFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	added, err := parseExcludePatterns(lines, dir)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filepath.Join(fsDir, ExcludeFileName), err)
+	}
+	if len(added) == 0 {
+		return p, nil
+	}
+	// Copy before appending, the slice is shared with the parent directories
+	return append(append(excludePatterns{}, p...), added...), nil
+}
+
+// Returns true if a file or directory is excluded. name is the path relative
+// to the root of the archive, with forward slashes.
+func (p excludePatterns) excluded(name string, isDir bool) bool {
+	var excluded bool
+	for _, e := range p {
+		if e.match(name, isDir) {
+			excluded = !e.negate
+		}
+	}
+	return excluded
+}
+
+func (e excludePattern) match(name string, isDir bool) bool {
+	if e.dirOnly && !isDir {
+		return false
+	}
+	if e.dir != "" {
+		if !strings.HasPrefix(name, e.dir+"/") {
+			return false
+		}
+		name = name[len(e.dir)+1:]
+	}
+	elements := strings.Split(name, "/")
+	if !e.anchored {
+		elements = elements[len(elements)-1:]
+	}
+	return matchSegments(e.segments, elements)
+}
+
+// Matches path elements against pattern segments, where "**" matches any
+// number of elements.
+func matchSegments(pattern, elements []string) bool {
+	if len(pattern) == 0 {
+		return len(elements) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(elements); i++ {
+			if matchSegments(pattern[1:], elements[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(elements) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], elements[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], elements[1:])
+}
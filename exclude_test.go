@@ -0,0 +1,57 @@
+package desync
+
+import "testing"
+
+func TestExcludePatterns(t *testing.T) {
+	root, err := parseExcludePatterns([]string{
+		"# comment",
+		"*.o",
+		"build/",
+		"/docs/*.pdf",
+		"**/cache/tmp",
+		"!keep.o",
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := parseExcludePatterns([]string{"data", "/out/"}, "src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := append(root, sub...)
+
+	for _, test := range []struct {
+		name     string
+		isDir    bool
+		excluded bool
+	}{
+		{"main.o", false, true},
+		{"src/lib/util.o", false, true},
+		{"src/lib/keep.o", false, false},
+		{"main.c", false, false},
+		{"build", true, true},
+		{"src/build", true, true},
+		{"build", false, false}, // Only directories
+		{"docs/manual.pdf", false, true},
+		{"docs/en/manual.pdf", false, false}, // Anchored, only one level
+		{"src/docs/manual.pdf", false, false},
+		{"cache/tmp", true, true},
+		{"a/b/cache/tmp", true, true},
+		{"a/cache/tmp2", true, false},
+		{"src/data", false, true}, // From the .caexclude in src
+		{"src/a/data", true, true},
+		{"data", false, false},
+		{"src/out", true, true},
+		{"src/a/out", true, false},
+	} {
+		if excluded := p.excluded(test.name, test.isDir); excluded != test.excluded {
+			t.Errorf("%s: expected excluded=%v, got %v", test.name, test.excluded, excluded)
+		}
+	}
+
+	for _, invalid := range []string{"/", "!", "a/[b"} {
+		if _, err := parseExcludePatterns([]string{invalid}, ""); err == nil {
+			t.Errorf("expected error for pattern %q", invalid)
+		}
+	}
+}
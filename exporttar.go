@@ -0,0 +1,129 @@
+// +build !windows
+
+package desync
+
+import (
+	gotar "archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+// ExportTar decodes a catar archive and writes its content as a tar stream in
+// PAX format, with the records GNU tar uses. Extended attributes and file
+// capabilities are stored as SCHILY.xattr records, ACLs in text form as
+// SCHILY.acl records, and SELinux labels as RHT.security.selinux. Tar can't
+// hold sockets, they're skipped.
+func ExportTar(ctx context.Context, w io.Writer, r io.Reader) error {
+	dec := NewArchiveDecoder(r)
+	tw := gotar.NewWriter(w)
+loop:
+	for {
+		// See if we're meant to stop
+		select {
+		case <-ctx.Done():
+			return Interrupted{}
+		default:
+		}
+		c, err := dec.Next()
+		if err != nil {
+			return err
+		}
+		var (
+			hdr  *gotar.Header
+			data io.Reader
+		)
+		switch n := c.(type) {
+		case NodeDirectory:
+			hdr = tarHeader(gotar.TypeDir, n.Name+"/", n.UID, n.GID, n.User, n.Group, n.Mode, n.MTime, n.Xattrs, n.SELinuxLabel)
+			addACLRecords(hdr, n.Mode, n.ACL)
+		case NodeFile:
+			hdr = tarHeader(gotar.TypeReg, n.Name, n.UID, n.GID, n.User, n.Group, n.Mode, n.MTime, n.Xattrs, n.SELinuxLabel)
+			hdr.Size = int64(n.Size)
+			if len(n.FCaps) > 0 {
+				hdr.PAXRecords[paxXattrPrefix+xattrFCaps] = string(n.FCaps)
+			}
+			addACLRecords(hdr, n.Mode, n.ACL)
+			data = n.Data
+		case NodeSymlink:
+			hdr = tarHeader(gotar.TypeSymlink, n.Name, n.UID, n.GID, n.User, n.Group, n.Mode, n.MTime, n.Xattrs, n.SELinuxLabel)
+			hdr.Linkname = n.Target
+		case NodeDevice:
+			typ := byte(gotar.TypeBlock)
+			if n.Mode&ModeTypeMask == syscall.S_IFCHR {
+				typ = gotar.TypeChar
+			}
+			hdr = tarHeader(typ, n.Name, n.UID, n.GID, n.User, n.Group, n.Mode, n.MTime, n.Xattrs, n.SELinuxLabel)
+			hdr.Devmajor, hdr.Devminor = int64(n.Major), int64(n.Minor)
+		case NodeFIFO:
+			hdr = tarHeader(gotar.TypeFifo, n.Name, n.UID, n.GID, n.User, n.Group, n.Mode, n.MTime, n.Xattrs, n.SELinuxLabel)
+		case NodeSocket:
+			fmt.Fprintf(os.Stderr, "skipping '%s' : sockets can't be stored in tar files\n", n.Name)
+			continue
+		case nil:
+			break loop
+		default:
+			return fmt.Errorf("unsupported type %s", reflect.TypeOf(c))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if data != nil {
+			if _, err := io.Copy(tw, data); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+// ExportTarIndex takes an index file of a chunked catar, re-assembles the catar
+// and writes its content as a tar stream. Uses n goroutines to retrieve and
+// decompress the chunks.
+func ExportTarIndex(ctx context.Context, w io.Writer, index Index, s Store, n int, pb ProgressBar) error {
+	return streamIndex(ctx, index, s, n, pb, func(ctx context.Context, r io.Reader) error {
+		return ExportTar(ctx, w, r)
+	})
+}
+
+// Returns a tar header with the metadata common to all types of nodes. Names
+// are relative to the root directory, which is written as "./".
+func tarHeader(typ byte, name string, uid, gid int, user, group string, mode os.FileMode, mtime time.Time, xattrs Xattrs, label string) *gotar.Header {
+	hdr := &gotar.Header{
+		Typeflag:   typ,
+		Name:       name,
+		Uid:        uid,
+		Gid:        gid,
+		Uname:      user,
+		Gname:      group,
+		Mode:       int64(mode & 07777),
+		ModTime:    mtime,
+		Format:     gotar.FormatPAX,
+		PAXRecords: make(map[string]string),
+	}
+	for key, value := range xattrs {
+		hdr.PAXRecords[paxXattrPrefix+key] = value
+	}
+	if label != "" {
+		hdr.PAXRecords[paxSELinux] = label
+	}
+	return hdr
+}
+
+// Adds the ACLs of a file or directory to a tar header, in text form.
+func addACLRecords(hdr *gotar.Header, mode os.FileMode, acl *ACL) {
+	if acl == nil {
+		return
+	}
+	access, def := acl.text(uint64(mode))
+	if access != "" {
+		hdr.PAXRecords[paxACLAccess] = access
+	}
+	if def != "" {
+		hdr.PAXRecords[paxACLDefault] = def
+	}
+}
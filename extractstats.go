@@ -7,15 +7,27 @@ import (
 // ExtractStats contains detailed statistics about a file extract operation, such
 // as if data chunks were copied from seeds or cloned.
 type ExtractStats struct {
-	ChunksFromSeeds uint64 `json:"chunks-from-seeds"`
-	ChunksFromStore uint64 `json:"chunks-from-store"`
-	ChunksInPlace   uint64 `json:"chunks-in-place"`
-	BytesCopied     uint64 `json:"bytes-copied-from-seeds"`
-	BytesCloned     uint64 `json:"bytes-cloned-from-seeds"`
-	Blocksize       uint64 `json:"blocksize"`
-	BytesTotal      int64  `json:"bytes-total"`
-	ChunksTotal     int    `json:"chunks-total"`
-	Seeds           int    `json:"seeds"`
+	ChunksFromSeeds   uint64 `json:"chunks-from-seeds"`
+	ChunksFromStore   uint64 `json:"chunks-from-store"`
+	ChunksInPlace     uint64 `json:"chunks-in-place"`
+	ChunksFromJournal uint64 `json:"chunks-from-journal"`
+	BytesCopied       uint64 `json:"bytes-copied-from-seeds"`
+	BytesCloned       uint64 `json:"bytes-cloned-from-seeds"`
+	BytesOffloaded    uint64 `json:"bytes-copied-in-kernel-from-seeds"` // Part of BytesCopied
+	Blocksize         uint64 `json:"blocksize"`
+	BytesTotal        int64  `json:"bytes-total"`
+	ChunksTotal       int    `json:"chunks-total"`
+	Seeds             int    `json:"seeds"`
+
+	// Seed files that were discarded during the extract because their data no
+	// longer matched their index
+	SeedsInvalid []string `json:"seeds-invalid,omitempty"`
+
+	// SHA-256 digest of the blob in hex, if it was verified during the extract
+	Digest string `json:"sha256,omitempty"`
+
+	// Concurrency chosen for remote stores, if it was adjusted during the extract
+	Stores []AdaptiveStats `json:"stores,omitempty"`
 }
 
 func (s *ExtractStats) incChunksFromStore() {
@@ -26,6 +38,10 @@ func (s *ExtractStats) incChunksInPlace() {
 	atomic.AddUint64(&s.ChunksInPlace, 1)
 }
 
+func (s *ExtractStats) addChunksFromJournal(n uint64) {
+	atomic.AddUint64(&s.ChunksFromJournal, n)
+}
+
 func (s *ExtractStats) addChunksFromSeed(n uint64) {
 	atomic.AddUint64(&s.ChunksFromSeeds, n)
 }
@@ -37,3 +53,7 @@ func (s *ExtractStats) addBytesCopied(n uint64) {
 func (s *ExtractStats) addBytesCloned(n uint64) {
 	atomic.AddUint64(&s.BytesCloned, n)
 }
+
+func (s *ExtractStats) addBytesOffloaded(n uint64) {
+	atomic.AddUint64(&s.BytesOffloaded, n)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sync"
 )
 
 // FileSeed is used to copy or clone blocks from an existing index+blob during
@@ -14,11 +15,14 @@ type FileSeed struct {
 	index      Index
 	pos        map[ChunkID][]int
 	canReflink bool
+
+	mu        sync.RWMutex
+	isInvalid bool
 }
 
 // NewIndexSeed initializes a new seed that uses an existing index and its blob
 func NewIndexSeed(dstFile string, srcFile string, index Index) (*FileSeed, error) {
-	s := FileSeed{
+	s := &FileSeed{
 		srcFile:    srcFile,
 		pos:        make(map[ChunkID][]int),
 		index:      index,
@@ -27,13 +31,14 @@ func NewIndexSeed(dstFile string, srcFile string, index Index) (*FileSeed, error
 	for i, c := range s.index.Chunks {
 		s.pos[c.ID] = append(s.pos[c.ID], i)
 	}
-	return &s, nil
+	return s, nil
 }
 
 // LongestMatchWith returns the longest sequence of of chunks anywhere in Source
-// that match b starting at b[0]. If there is no match, it returns nil
+// that match b starting at b[0]. If there is no match, it returns nil. Once the
+// seed has been found to not match its data, there are no more matches.
 func (s *FileSeed) LongestMatchWith(chunks []IndexChunk) (int, SeedSegment) {
-	if len(chunks) == 0 || len(s.index.Chunks) == 0 {
+	if len(chunks) == 0 || len(s.index.Chunks) == 0 || s.IsInvalid() {
 		return 0, nil
 	}
 	pos, ok := s.pos[chunks[0].ID]
@@ -53,7 +58,24 @@ func (s *FileSeed) LongestMatchWith(chunks []IndexChunk) (int, SeedSegment) {
 			max = len(m)
 		}
 	}
-	return max, newFileSeedSegment(s.srcFile, match, s.canReflink, true)
+	segment := newFileSeedSegment(s.srcFile, match, s.canReflink, true)
+	segment.seed = s
+	return max, segment
+}
+
+// IsInvalid returns true if the seed's data was found to not match its index
+// during extraction.
+func (s *FileSeed) IsInvalid() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.isInvalid
+}
+
+// Marks the seed as invalid so it's not used for any further matches.
+func (s *FileSeed) setInvalid() {
+	s.mu.Lock()
+	s.isInvalid = true
+	s.mu.Unlock()
 }
 
 // Returns a slice of chunks from the seed. Compares chunks from position 0
@@ -84,6 +106,7 @@ type fileSeedSegment struct {
 	chunks         []IndexChunk
 	canReflink     bool
 	needValidation bool
+	seed           *FileSeed // Seed the segment came from, invalidated if validation fails
 }
 
 func newFileSeedSegment(file string, chunks []IndexChunk, canReflink, needValidation bool) *fileSeedSegment {
@@ -103,67 +126,92 @@ func (s *fileSeedSegment) Size() uint64 {
 	return last.Start + last.Size - s.chunks[0].Start
 }
 
-func (s *fileSeedSegment) WriteInto(dst *os.File, offset, length, blocksize uint64, isBlank bool) (uint64, uint64, error) {
+func (s *fileSeedSegment) WriteInto(dst *os.File, offset, length, blocksize uint64, isBlank bool) (uint64, uint64, uint64, error) {
 	if length != s.Size() {
-		return 0, 0, fmt.Errorf("unable to copy %d bytes from %s to %s : wrong size", length, s.file, dst.Name())
+		return 0, 0, 0, fmt.Errorf("unable to copy %d bytes from %s to %s : wrong size", length, s.file, dst.Name())
 	}
 	src, err := os.Open(s.file)
 	if err != nil {
-		return 0, 0, err
+		if os.IsNotExist(err) && s.needValidation {
+			return 0, 0, 0, s.invalidate()
+		}
+		return 0, 0, 0, err
 	}
 	defer src.Close()
 
 	// Make sure the data we're planning on pulling from the file matches what
-	// the index says it is if that's required.
+	// the index says it is if that's required. If it doesn't, the seed is
+	// discarded and SeedInvalid returned so the caller can use another source.
 	if s.needValidation {
 		if err := s.validate(src); err != nil {
-			return 0, 0, err
+			return 0, 0, 0, err
 		}
 	}
 	// Do a straight copy if reflinks are not supported or blocks aren't aligned
 	if !s.canReflink || s.chunks[0].Start%blocksize != offset%blocksize {
-		return s.copy(dst, src, s.chunks[0].Start, length, offset)
+		copied, offloaded, err := copyRange(dst, src, s.chunks[0].Start, length, offset)
+		return copied, 0, offloaded, err
 	}
 	return s.clone(dst, src, s.chunks[0].Start, length, offset, blocksize)
 }
 
 // Compares all chunks in this slice of the seed index to the underlying data
-// and fails if they don't match.
+// and fails with SeedInvalid if they don't match or the file is too short.
 func (s *fileSeedSegment) validate(src *os.File) error {
 	for _, c := range s.chunks {
 		b := make([]byte, c.Size)
 		if _, err := src.ReadAt(b, int64(c.Start)); err != nil {
+			if err == io.EOF {
+				return s.invalidate()
+			}
 			return err
 		}
 		sum := sha512.Sum512_256(b)
 		if sum != c.ID {
-			return fmt.Errorf("seed index for %s doesn't match its data", s.file)
+			return s.invalidate()
 		}
 	}
 	return nil
 }
 
-// Performs a plain copy of everything in the seed to the target, not cloning
-// of blocks.
-func (s *fileSeedSegment) copy(dst, src *os.File, srcOffset, length, dstOffset uint64) (uint64, uint64, error) {
+// Marks the seed this segment came from as invalid and returns the error for it.
+func (s *fileSeedSegment) invalidate() error {
+	if s.seed != nil {
+		s.seed.setInvalid()
+	}
+	return SeedInvalid{File: s.file}
+}
+
+// Performs a plain copy of a range from one file to another, not cloning of
+// blocks. The copy is done by the kernel with copy_file_range if possible, and
+// through a buffer if not. Returns the number of bytes copied, and how many of
+// those were copied by the kernel.
+func copyRange(dst, src *os.File, srcOffset, length, dstOffset uint64) (uint64, uint64, error) {
+	offloaded, err := CopyRange(dst, src, srcOffset, length, dstOffset)
+	if err == nil {
+		return offloaded, offloaded, nil
+	}
+	// Copy whatever the kernel didn't
+	srcOffset += offloaded
+	dstOffset += offloaded
 	if _, err := dst.Seek(int64(dstOffset), os.SEEK_SET); err != nil {
-		return 0, 0, err
+		return offloaded, offloaded, err
 	}
 	if _, err := src.Seek(int64(srcOffset), os.SEEK_SET); err != nil {
-		return 0, 0, err
+		return offloaded, offloaded, err
 	}
 
 	// Copy using a fixed buffer. Using io.Copy() with a LimitReader will make it
 	// create a buffer matching N of the LimitReader which can be too large
-	copied, err := io.CopyBuffer(dst, io.LimitReader(src, int64(length)), make([]byte, 64*1024))
-	return uint64(copied), 0, err
+	copied, err := io.CopyBuffer(dst, io.LimitReader(src, int64(length-offloaded)), make([]byte, 64*1024))
+	return offloaded + uint64(copied), offloaded, err
 }
 
 // Reflink the overlapping blocks in the two ranges and copy the bit before and
 // after the blocks.
-func (s *fileSeedSegment) clone(dst, src *os.File, srcOffset, srcLength, dstOffset, blocksize uint64) (uint64, uint64, error) {
+func (s *fileSeedSegment) clone(dst, src *os.File, srcOffset, srcLength, dstOffset, blocksize uint64) (uint64, uint64, uint64, error) {
 	if srcOffset%blocksize != dstOffset%blocksize {
-		return 0, 0, fmt.Errorf("reflink ranges not aligned between %s and %s", src.Name(), dst.Name())
+		return 0, 0, 0, fmt.Errorf("reflink ranges not aligned between %s and %s", src.Name(), dst.Name())
 	}
 
 	srcAlignStart := (srcOffset/blocksize + 1) * blocksize
@@ -173,18 +221,15 @@ func (s *fileSeedSegment) clone(dst, src *os.File, srcOffset, srcLength, dstOffs
 	dstAlignEnd := dstAlignStart + alignLength
 
 	// fill the area before the first aligned block
-	var copied uint64
-	c1, _, err := s.copy(dst, src, srcOffset, srcAlignStart-srcOffset, dstOffset)
+	c1, o1, err := copyRange(dst, src, srcOffset, srcAlignStart-srcOffset, dstOffset)
 	if err != nil {
-		return c1, 0, err
+		return c1, 0, o1, err
 	}
-	copied += c1
 	// fill the area after the last aligned block
-	c2, _, err := s.copy(dst, src, srcAlignEnd, srcOffset+srcLength-srcAlignEnd, dstAlignEnd)
+	c2, o2, err := copyRange(dst, src, srcAlignEnd, srcOffset+srcLength-srcAlignEnd, dstAlignEnd)
 	if err != nil {
-		return copied + c2, 0, err
+		return c1 + c2, 0, o1 + o2, err
 	}
-	copied += c2
 	// close the aligned blocks
-	return copied, alignLength, CloneRange(dst, src, srcAlignStart, alignLength, dstAlignStart)
+	return c1 + c2, alignLength, o1 + o2, CloneRange(dst, src, srcAlignStart, alignLength, dstAlignStart)
 }
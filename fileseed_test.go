@@ -0,0 +1,64 @@
+package desync
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCopyRange(t *testing.T) {
+	src, err := ioutil.TempFile("", "src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+	dst, err := ioutil.TempFile("", "dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	b := make([]byte, 256*1024)
+	rand.Read(b)
+	if _, err := src.Write(b); err != nil {
+		t.Fatal(err)
+	}
+
+	// Copy a range that's not aligned to anything into the middle of the target
+	copied, offloaded, err := copyRange(dst, src, 1000, 200000, 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied != 200000 {
+		t.Fatalf("expected 200000 bytes copied, got %d", copied)
+	}
+	if offloaded > copied {
+		t.Fatalf("more bytes copied by the kernel (%d) than copied in total (%d)", offloaded, copied)
+	}
+	out, err := ioutil.ReadFile(dst.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 203000 {
+		t.Fatalf("expected target of 203000 bytes, got %d", len(out))
+	}
+	if !bytes.Equal(out[3000:], b[1000:201000]) {
+		t.Fatal("copied data doesn't match the source")
+	}
+	if !bytes.Equal(out[:3000], make([]byte, 3000)) {
+		t.Fatal("data before the copied range was modified")
+	}
+
+	// Copying beyond the end of the source should copy what's there
+	copied, _, err = copyRange(dst, src, uint64(len(b))-100, 1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied != 100 {
+		t.Fatalf("expected 100 bytes copied, got %d", copied)
+	}
+}
@@ -1,6 +1,9 @@
 package desync
 
-import "os"
+import (
+	"io"
+	"os"
+)
 
 func isSymlink(m os.FileMode) bool {
 	return m&os.ModeSymlink != 0
@@ -9,3 +12,29 @@ func isSymlink(m os.FileMode) bool {
 func isDevice(m os.FileMode) bool {
 	return m&os.ModeDevice != 0
 }
+
+func isFIFO(m os.FileMode) bool {
+	return m&os.ModeNamedPipe != 0
+}
+
+func isSocket(m os.FileMode) bool {
+	return m&os.ModeSocket != 0
+}
+
+// Returns the size of a file. Block devices report a size of 0 in their file
+// info, so their size is determined by seeking to the end.
+func sizeOfFile(name string) (int64, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	if !isDevice(info.Mode()) {
+		return info.Size(), nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.Seek(0, io.SeekEnd)
+}
@@ -99,6 +99,14 @@ type FormatACLGroup struct {
 	Name        string
 }
 
+// FormatACLDefaultUser is an entry for a named user in the default ACL of a
+// directory. It's encoded the same way as FormatACLUser.
+type FormatACLDefaultUser FormatACLUser
+
+// FormatACLDefaultGroup is an entry for a named group in the default ACL of a
+// directory. It's encoded the same way as FormatACLGroup.
+type FormatACLDefaultGroup FormatACLGroup
+
 type FormatACLGroupObj struct {
 	FormatHeader
 	Permissions uint64
@@ -278,7 +286,7 @@ func (d *FormatDecoder) Next() (interface{}, error) {
 		}
 		return FormatFCaps{FormatHeader: hdr, Data: b}, nil
 
-	case CaFormatACLUser:
+	case CaFormatACLUser, CaFormatACLDefaultUser:
 		e := FormatACLUser{FormatHeader: hdr}
 		e.UID, err = d.r.ReadUint64()
 		if err != nil {
@@ -295,9 +303,12 @@ func (d *FormatDecoder) Next() (interface{}, error) {
 		// Strip off the 0 byte
 		b = b[:len(b)-1]
 		e.Name = string(b)
+		if hdr.Type == CaFormatACLDefaultUser {
+			return FormatACLDefaultUser(e), nil
+		}
 		return e, nil
 
-	case CaFormatACLGroup:
+	case CaFormatACLGroup, CaFormatACLDefaultGroup:
 		e := FormatACLGroup{FormatHeader: hdr}
 		e.GID, err = d.r.ReadUint64()
 		if err != nil {
@@ -314,6 +325,9 @@ func (d *FormatDecoder) Next() (interface{}, error) {
 		// Strip off the 0 byte
 		b = b[:len(b)-1]
 		e.Name = string(b)
+		if hdr.Type == CaFormatACLDefaultGroup {
+			return FormatACLDefaultGroup(e), nil
+		}
 		return e, nil
 
 	case CaFormatACLGroupObj:
@@ -551,6 +565,22 @@ func (e *FormatEncoder) Encode(v interface{}) (int64, error) {
 		n1, err := io.Copy(e.w, strings.NewReader(t.Name+"\x00"))
 		return n + n1, err
 
+	case FormatACLDefaultUser:
+		n, err := e.w.WriteUint64(t.Size, t.Type, t.UID, t.Permissions)
+		if err != nil {
+			return n, err
+		}
+		n1, err := io.Copy(e.w, strings.NewReader(t.Name+"\x00"))
+		return n + n1, err
+
+	case FormatACLDefaultGroup:
+		n, err := e.w.WriteUint64(t.Size, t.Type, t.GID, t.Permissions)
+		if err != nil {
+			return n, err
+		}
+		n1, err := io.Copy(e.w, strings.NewReader(t.Name+"\x00"))
+		return n + n1, err
+
 	case FormatACLGroupObj:
 		return e.w.WriteUint64(t.Size, t.Type, t.Permissions)
 
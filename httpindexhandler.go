@@ -3,9 +3,15 @@ package desync
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ed25519"
 )
 
 // HTTPIndexHandler is the HTTP handler for index stores.
@@ -36,11 +42,24 @@ func (h HTTPIndexHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h HTTPIndexHandler) get(indexName string, w http.ResponseWriter) {
+	// Signatures are not indexes, serve them as they are
+	if strings.HasSuffix(indexName, IndexSignatureExt) {
+		h.getSignature(indexName, w)
+		return
+	}
+	// Same for blob digests
+	if strings.HasSuffix(indexName, IndexDigestExt) {
+		h.getDigest(indexName, w)
+		return
+	}
 	idx, err := h.s.GetIndex(indexName)
 	if err != nil {
-		if os.IsNotExist(err) {
+		switch {
+		case os.IsNotExist(err):
 			w.WriteHeader(http.StatusNotFound)
-		} else {
+		case isSignatureInvalid(err):
+			w.WriteHeader(http.StatusForbidden)
+		default:
 			w.WriteHeader(http.StatusBadRequest)
 		}
 		fmt.Fprintln(w, err)
@@ -55,6 +74,53 @@ func (h HTTPIndexHandler) get(indexName string, w http.ResponseWriter) {
 	h.HTTPHandlerBase.get(indexName, b.Bytes(), err, w)
 }
 
+func (h HTTPIndexHandler) getSignature(name string, w http.ResponseWriter) {
+	r, err := h.s.GetIndexReader(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		fmt.Fprintln(w, err)
+		return
+	}
+	defer r.Close()
+	// Don't serve up arbitrary files, only what could be a signature
+	b, err := ioutil.ReadAll(io.LimitReader(r, ed25519.SignatureSize+1))
+	if err == nil && len(b) != ed25519.SignatureSize {
+		http.Error(w, "invalid index signature", http.StatusBadRequest)
+		return
+	}
+	h.HTTPHandlerBase.get(name, b, err, w)
+}
+
+func (h HTTPIndexHandler) getDigest(name string, w http.ResponseWriter) {
+	r, err := h.s.GetIndexReader(name)
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			w.WriteHeader(http.StatusNotFound)
+		case isSignatureInvalid(err):
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		fmt.Fprintln(w, err)
+		return
+	}
+	defer r.Close()
+	// Only serve what could be a digest
+	b, err := ioutil.ReadAll(io.LimitReader(r, 1024))
+	if err == nil {
+		if _, err := parseBlobDigest(b); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	h.HTTPHandlerBase.get(name, b, err, w)
+}
+
 func (h HTTPIndexHandler) head(indexName string, w http.ResponseWriter) {
 	_, err := h.s.GetIndexReader(indexName)
 	if err != nil {
@@ -70,6 +136,17 @@ func (h HTTPIndexHandler) put(indexName string, w http.ResponseWriter, r *http.R
 		return
 	}
 
+	// Signatures and blob digests are stored as they are, if the upstream store
+	// supports them
+	if strings.HasSuffix(indexName, IndexSignatureExt) {
+		h.putSignature(indexName, w, r)
+		return
+	}
+	if strings.HasSuffix(indexName, IndexDigestExt) {
+		h.putDigest(indexName, w, r)
+		return
+	}
+
 	// The upstream store needs to support writing as well
 	s, ok := h.s.(IndexWriteStore)
 	if !ok {
@@ -93,3 +170,59 @@ func (h HTTPIndexHandler) put(indexName string, w http.ResponseWriter, r *http.R
 	}
 	w.WriteHeader(http.StatusOK)
 }
+
+func (h HTTPIndexHandler) putSignature(name string, w http.ResponseWriter, r *http.Request) {
+	s, ok := h.s.(IndexSignatureWriteStore)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "upstream index store '%s' does not support signatures\n", h.s)
+		return
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, ed25519.SignatureSize+1))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, err)
+		return
+	}
+	if len(b) != ed25519.SignatureSize {
+		http.Error(w, "invalid index signature", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err := s.StoreIndexSignature(name, b); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h HTTPIndexHandler) putDigest(name string, w http.ResponseWriter, r *http.Request) {
+	s, ok := h.s.(IndexDigestWriteStore)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "upstream index store '%s' does not support blob digests\n", h.s)
+		return
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, 1024))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, err)
+		return
+	}
+	if _, err := parseBlobDigest(b); err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err := s.StoreIndexDigest(name, b); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Returns true if the error, or the cause of it, is an invalid index signature.
+func isSignatureInvalid(err error) bool {
+	_, ok := errors.Cause(err).(IndexSignatureInvalid)
+	return ok
+}
@@ -0,0 +1,343 @@
+// +build !windows
+
+package desync
+
+import (
+	gotar "archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/datadog/zstd"
+)
+
+// Prefix of PAX records holding extended attributes, as written by GNU tar,
+// star and Go's archive/tar
+const paxXattrPrefix = "SCHILY.xattr."
+
+// PAX records GNU tar uses for ACLs in text form with --acls, and for SELinux
+// labels with --selinux
+const (
+	paxACLAccess  = "SCHILY.acl.access"
+	paxACLDefault = "SCHILY.acl.default"
+	paxSELinux    = "RHT.security.selinux"
+)
+
+// Node of a tar stream that's being imported
+type importNode struct {
+	md           tarMetadata
+	major, minor uint64
+	target       string // Target of symlinks
+	offset, size int64  // Content of regular files in the spool file
+	children     map[string]*importNode
+}
+
+// ImportTar encodes a tar stream, like a GNU or PAX tar file or a container
+// image layer, into a catar archive without extracting it first. Streams
+// compressed with gzip or zstd are decompressed. Since entries in a catar
+// archive are sorted by name and tar streams aren't, the content of files is
+// held in a temporary file until the whole stream has been read. Hardlinks are
+// stored as copies of the file they link to. Options that apply to
+// directories on disk, like OneFileSystem or exclude files, are ignored.
+func ImportTar(ctx context.Context, w io.Writer, r io.Reader, opts TarOptions) error {
+	st := &tarState{opts: opts, flags: opts.FeatureFlags()}
+	var err error
+	if st.exclude, err = parseExcludePatterns(opts.Exclude, ""); err != nil {
+		return err
+	}
+	if _, ok := tarTimeFlags[opts.TimeGranularity]; !ok && opts.TimeGranularity != 0 {
+		return fmt.Errorf("unsupported time granularity %s", opts.TimeGranularity)
+	}
+
+	r, err = decompressedReader(r)
+	if err != nil {
+		return err
+	}
+	spool, err := ioutil.TempFile("", ".desync-import")
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
+	os.Remove(spool.Name())
+
+	root, err := readTarStream(ctx, r, spool)
+	if err != nil {
+		return err
+	}
+	_, err = st.encodeImportNode(ctx, NewFormatEncoder(w), spool, root, "")
+	return err
+}
+
+// Reads all entries of a tar stream into a tree, writing the content of files
+// into the spool file.
+func readTarStream(ctx context.Context, r io.Reader, spool *os.File) (*importNode, error) {
+	root := &importNode{
+		md:       tarMetadata{mode: syscall.S_IFDIR | 0755, mtime: time.Unix(0, 0)},
+		children: make(map[string]*importNode),
+	}
+	var offset int64
+	tr := gotar.NewReader(r)
+	for {
+		// See if we're meant to stop
+		select {
+		case <-ctx.Done():
+			return nil, Interrupted{}
+		default:
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return root, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Clean up the name, it can't point outside the root
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+
+		n := &importNode{
+			md: tarMetadata{
+				uid:   hdr.Uid,
+				gid:   hdr.Gid,
+				user:  hdr.Uname,
+				group: hdr.Gname,
+				mode:  uint32(hdr.Mode) & 07777,
+				mtime: hdr.ModTime,
+			},
+		}
+		switch hdr.Typeflag {
+		case gotar.TypeReg, gotar.TypeRegA, gotar.TypeGNUSparse:
+			n.md.mode |= syscall.S_IFREG
+			written, err := io.Copy(spool, tr)
+			if err != nil {
+				return nil, err
+			}
+			n.offset, n.size = offset, written
+			offset += written
+		case gotar.TypeLink:
+			target, ok := root.lookup(strings.TrimPrefix(path.Clean("/"+hdr.Linkname), "/"))
+			if !ok || target.md.mode&ModeTypeMask != syscall.S_IFREG {
+				return nil, fmt.Errorf("hardlink %s points to %s which is not a file in the stream", hdr.Name, hdr.Linkname)
+			}
+			file := *target
+			n = &file
+		case gotar.TypeDir:
+			n.md.mode |= syscall.S_IFDIR
+			n.children = make(map[string]*importNode)
+		case gotar.TypeSymlink:
+			n.md.mode |= syscall.S_IFLNK
+			n.target = hdr.Linkname
+		case gotar.TypeChar:
+			n.md.mode |= syscall.S_IFCHR
+			n.major, n.minor = uint64(hdr.Devmajor), uint64(hdr.Devminor)
+		case gotar.TypeBlock:
+			n.md.mode |= syscall.S_IFBLK
+			n.major, n.minor = uint64(hdr.Devmajor), uint64(hdr.Devminor)
+		case gotar.TypeFifo:
+			n.md.mode |= syscall.S_IFIFO
+		case gotar.TypeXGlobalHeader:
+			continue
+		default:
+			fmt.Fprintf(os.Stderr, "skipping '%s' : unsupported tar entry type %q\n", hdr.Name, hdr.Typeflag)
+			continue
+		}
+
+		// Extended attributes, ACLs and SELinux labels. Those can be in the records
+		// GNU tar uses, or stored as xattrs.
+		if hdr.Typeflag != gotar.TypeLink {
+			var access, def []aclXattrEntry
+			setXattr := func(key, value string) {
+				if n.md.xattrs == nil {
+					n.md.xattrs = make(map[string][]byte)
+				}
+				n.md.xattrs[key] = []byte(value)
+			}
+			for key, value := range hdr.PAXRecords {
+				switch {
+				case key == paxACLAccess:
+					access, err = parseACLText(value)
+				case key == paxACLDefault:
+					def, err = parseACLText(value)
+				case key == paxSELinux:
+					setXattr(xattrSELinux, value)
+				case key == paxXattrPrefix+aclXattrAccess:
+					if _, ok := hdr.PAXRecords[paxACLAccess]; !ok {
+						access, err = parseACLXattr([]byte(value))
+					}
+				case key == paxXattrPrefix+aclXattrDefault:
+					if _, ok := hdr.PAXRecords[paxACLDefault]; !ok {
+						def, err = parseACLXattr([]byte(value))
+					}
+				case key == paxXattrPrefix+xattrSELinux:
+					if _, ok := hdr.PAXRecords[paxSELinux]; !ok {
+						setXattr(xattrSELinux, value)
+					}
+				case strings.HasPrefix(key, paxXattrPrefix):
+					setXattr(strings.TrimPrefix(key, paxXattrPrefix), value)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("%s in %s", err, hdr.Name)
+				}
+			}
+			n.md.acl = aclFromXattrs(access, def)
+		}
+
+		if err := root.insert(name, n); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Returns the node at a path below this one.
+func (n *importNode) lookup(name string) (*importNode, bool) {
+	if name == "" {
+		return n, true
+	}
+	for _, element := range strings.Split(name, "/") {
+		child, ok := n.children[element]
+		if !ok {
+			return nil, false
+		}
+		n = child
+	}
+	return n, true
+}
+
+// Adds a node to the tree, creating missing parent directories. Nodes that are
+// already in the tree are replaced, like when extracting a tar stream. A
+// directory only gets the metadata of its replacement if that's a directory as
+// well, to keep what's already in it.
+func (n *importNode) insert(name string, node *importNode) error {
+	parent, base := n, ""
+	if name != "" {
+		elements := strings.Split(name, "/")
+		for _, element := range elements[:len(elements)-1] {
+			child, ok := parent.children[element]
+			if !ok {
+				child = &importNode{
+					md:       tarMetadata{mode: syscall.S_IFDIR | 0755, mtime: time.Unix(0, 0)},
+					children: make(map[string]*importNode),
+				}
+				parent.children[element] = child
+			}
+			if child.children == nil {
+				return fmt.Errorf("%s is not a directory in the stream", path.Join(elements[:len(elements)-1]...))
+			}
+			parent = child
+		}
+		base = elements[len(elements)-1]
+	}
+	existing := n
+	if base != "" {
+		existing = parent.children[base]
+	}
+	if existing != nil && existing.children != nil && node.children != nil {
+		existing.md = node.md
+		return nil
+	}
+	if base == "" {
+		return fmt.Errorf("root of the stream needs to be a directory")
+	}
+	parent.children[base] = node
+	return nil
+}
+
+// Encodes a node of an imported tar stream, and all nodes below it.
+func (st *tarState) encodeImportNode(ctx context.Context, enc FormatEncoder, spool *os.File, node *importNode, name string) (n int64, err error) {
+	// See if we're meant to stop
+	select {
+	case <-ctx.Done():
+		return n, Interrupted{}
+	default:
+	}
+
+	nn, err := st.encodeMetadata(enc, node.md)
+	n += nn
+	if err != nil {
+		return n, err
+	}
+
+	switch node.md.mode & ModeTypeMask {
+	case syscall.S_IFDIR:
+		names := make([]string, 0, len(node.children))
+		for childName := range node.children {
+			names = append(names, childName)
+		}
+		sort.Strings(names)
+		var items []FormatGoodbyeItem
+		for _, childName := range names {
+			child := node.children[childName]
+			if st.exclude.excluded(path.Join(name, childName), child.children != nil) {
+				continue
+			}
+			start := n
+			nn, err = enc.Encode(FormatFilename{
+				FormatHeader: FormatHeader{Size: uint64(16 + len(childName) + 1), Type: CaFormatFilename},
+				Name:         childName,
+			})
+			n += nn
+			if err != nil {
+				return n, err
+			}
+			nn, err = st.encodeImportNode(ctx, enc, spool, child, path.Join(name, childName))
+			n += nn
+			if err != nil {
+				return n, err
+			}
+			items = append(items, FormatGoodbyeItem{
+				Offset: uint64(start),
+				Size:   uint64(n - start),
+				Hash:   SipHash([]byte(childName)),
+			})
+		}
+		nn, err = encodeGoodbye(enc, items, n)
+
+	case syscall.S_IFREG:
+		nn, err = enc.Encode(FormatPayload{
+			FormatHeader: FormatHeader{Size: 16 + uint64(node.size), Type: CaFormatPayload},
+			Data:         io.NewSectionReader(spool, node.offset, node.size),
+		})
+
+	case syscall.S_IFLNK:
+		nn, err = enc.Encode(FormatSymlink{
+			FormatHeader: FormatHeader{Size: uint64(16 + len(node.target) + 1), Type: CaFormatSymlink},
+			Target:       node.target,
+		})
+
+	case syscall.S_IFCHR, syscall.S_IFBLK:
+		nn, err = enc.Encode(FormatDevice{
+			FormatHeader: FormatHeader{Size: 32, Type: CaFormatDevice},
+			Major:        node.major,
+			Minor:        node.minor,
+		})
+	}
+	n += nn
+	return n, err
+}
+
+// Returns a reader that decompresses a stream if it's compressed with gzip or
+// zstd, recognized by the magic bytes at the start.
+func decompressedReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return zstd.NewReader(br), nil
+	}
+	return br, nil
+}
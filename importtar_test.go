@@ -0,0 +1,255 @@
+// +build !windows
+
+package desync
+
+import (
+	gotar "archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestImportTar(t *testing.T) {
+	mtime := time.Unix(1577836800, 0)
+
+	// Build a gzip compressed tar stream with entries out of order and a
+	// missing parent directory
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	tw := gotar.NewWriter(gz)
+	entries := []struct {
+		hdr  gotar.Header
+		data string
+	}{
+		{gotar.Header{Typeflag: gotar.TypeReg, Name: "dir/b", Mode: 0600, Uid: 1000, Gid: 1000, Uname: "user", Gname: "group", ModTime: mtime,
+			PAXRecords: map[string]string{paxXattrPrefix + "user.test": "value"}}, "content"},
+		{gotar.Header{Typeflag: gotar.TypeDir, Name: "dir/", Mode: 0700, ModTime: mtime}, ""},
+		{gotar.Header{Typeflag: gotar.TypeLink, Name: "dir/a", Linkname: "dir/b", ModTime: mtime}, ""},
+		{gotar.Header{Typeflag: gotar.TypeSymlink, Name: "./link", Linkname: "dir/b", Mode: 0777, ModTime: mtime}, ""},
+		{gotar.Header{Typeflag: gotar.TypeChar, Name: "missing/null", Mode: 0666, Devmajor: 1, Devminor: 3, ModTime: mtime}, ""},
+		{gotar.Header{Typeflag: gotar.TypeFifo, Name: "fifo", Mode: 0644, ModTime: mtime}, ""},
+	}
+	for _, e := range entries {
+		e.hdr.Size = int64(len(e.data))
+		e.hdr.Format = gotar.FormatPAX
+		if err := tw.WriteHeader(&e.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	catar := new(bytes.Buffer)
+	if err := ImportTar(context.Background(), catar, buf, TarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Decode the archive again, entries should come out sorted
+	dec := NewArchiveDecoder(catar)
+	var names []string
+	for {
+		c, err := dec.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c == nil {
+			break
+		}
+		switch n := c.(type) {
+		case NodeDirectory:
+			names = append(names, n.Name)
+			if n.Name == "dir" && (n.Mode&07777 != 0700 || !n.MTime.Equal(mtime)) {
+				t.Fatalf("unexpected metadata of %s: %o %s", n.Name, n.Mode, n.MTime)
+			}
+		case NodeFile:
+			names = append(names, n.Name)
+			b, err := ioutil.ReadAll(n.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != "content" || n.Mode&07777 != 0600 || n.UID != 1000 || n.User != "user" || n.Group != "group" {
+				t.Fatalf("unexpected file %s: %q %o %d %s:%s", n.Name, b, n.Mode, n.UID, n.User, n.Group)
+			}
+			if n.Xattrs["user.test"] != "value" {
+				t.Fatalf("expected xattr in %s, got %v", n.Name, n.Xattrs)
+			}
+		case NodeSymlink:
+			names = append(names, n.Name)
+			if n.Target != "dir/b" {
+				t.Fatalf("unexpected symlink target %s", n.Target)
+			}
+		case NodeDevice:
+			names = append(names, n.Name)
+			if n.Major != 1 || n.Minor != 3 {
+				t.Fatalf("unexpected device %d:%d", n.Major, n.Minor)
+			}
+		case NodeFIFO:
+			names = append(names, n.Name)
+		}
+	}
+	expected := []string{".", "dir", "dir/a", "dir/b", "fifo", "link", "missing", "missing/null"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+}
+
+func TestExportTarRoundTrip(t *testing.T) {
+	base, err := ioutil.TempDir("", "desync-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	if err := os.MkdirAll(filepath.Join(base, "dir", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(base, "dir", "file"), []byte("content"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir/file", filepath.Join(base, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	catar := new(bytes.Buffer)
+	if err := Tar(context.Background(), catar, base, TarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Convert the archive to tar and check the entries
+	tarBuf := new(bytes.Buffer)
+	if err := ExportTar(context.Background(), tarBuf, bytes.NewReader(catar.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	tr := gotar.NewReader(bytes.NewReader(tarBuf.Bytes()))
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		switch hdr.Name {
+		case "dir/file":
+			b, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Typeflag != gotar.TypeReg || string(b) != "content" || hdr.Mode != 0640 {
+				t.Fatalf("unexpected file: %q %o", b, hdr.Mode)
+			}
+		case "link":
+			if hdr.Typeflag != gotar.TypeSymlink || hdr.Linkname != "dir/file" {
+				t.Fatalf("unexpected symlink to %s", hdr.Linkname)
+			}
+		}
+	}
+	expected := []string{"./", "dir/", "dir/file", "dir/sub/", "link"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+
+	// Importing the tar stream again should produce the original archive
+	imported := new(bytes.Buffer)
+	if err := ImportTar(context.Background(), imported, tarBuf, TarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(catar.Bytes(), imported.Bytes()) {
+		t.Fatal("archive changed after converting to tar and back")
+	}
+}
+
+func TestImportExportTarACL(t *testing.T) {
+	// Access ACL with an entry for a user that doesn't exist locally, like the
+	// kernel stores it in the xattr
+	aclXattr := new(bytes.Buffer)
+	for _, v := range []interface{}{
+		uint32(aclXattrVersion),
+		aclXattrEntry{Tag: aclTagUserObj, Perm: 6, ID: aclUndefinedID},
+		aclXattrEntry{Tag: aclTagUser, Perm: 4, ID: 54321},
+		aclXattrEntry{Tag: aclTagGroupObj, Perm: 4, ID: aclUndefinedID},
+		aclXattrEntry{Tag: aclTagMask, Perm: 4, ID: aclUndefinedID},
+		aclXattrEntry{Tag: aclTagOther, Perm: 0, ID: aclUndefinedID},
+	} {
+		if err := binary.Write(aclXattr, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The same ACL and an SELinux label in the records of GNU tar
+	aclText := "user::rw-,user:54321:r--,group::r--,mask::r--,other::---"
+	label := "system_u:object_r:bin_t:s0"
+
+	tests := map[string]map[string]string{
+		"gnu tar": {
+			paxACLAccess: aclText,
+			paxSELinux:   label,
+		},
+		"xattrs": {
+			paxXattrPrefix + aclXattrAccess: aclXattr.String(),
+			paxXattrPrefix + xattrSELinux:   label + "\x00",
+		},
+	}
+	for name, records := range tests {
+		t.Run(name, func(t *testing.T) {
+			in := new(bytes.Buffer)
+			tw := gotar.NewWriter(in)
+			if err := tw.WriteHeader(&gotar.Header{
+				Typeflag:   gotar.TypeReg,
+				Name:       "file",
+				Mode:       0640,
+				ModTime:    time.Unix(1577836800, 0),
+				Format:     gotar.FormatPAX,
+				PAXRecords: records,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Convert to catar and back to tar, the ACL and label should be in the
+			// records GNU tar uses
+			catar := new(bytes.Buffer)
+			if err := ImportTar(context.Background(), catar, in, TarOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			out := new(bytes.Buffer)
+			if err := ExportTar(context.Background(), out, catar); err != nil {
+				t.Fatal(err)
+			}
+			tr := gotar.NewReader(out)
+			for {
+				hdr, err := tr.Next()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if hdr.Name != "file" {
+					continue
+				}
+				if got := hdr.PAXRecords[paxACLAccess]; got != aclText {
+					t.Fatalf("expected ACL %q, got %q", aclText, got)
+				}
+				if got := hdr.PAXRecords[paxSELinux]; got != label {
+					t.Fatalf("expected label %q, got %q", label, got)
+				}
+				break
+			}
+		})
+	}
+}
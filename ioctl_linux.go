@@ -5,6 +5,7 @@ package desync
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -12,11 +13,21 @@ import (
 	"unsafe"
 
 	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 )
 
 // FICLONERANGE ioctl
 const fiCloneRange = 0x4020940d
 
+// BLKZEROOUT ioctl
+const blkZeroOut = 0x127f
+
+// Flags for fallocate(2)
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+)
+
 // CanClone tries to determine if the filesystem allows cloning of blocks between
 // two files. It'll create two tempfiles in the same dirs and attempt to perfom
 // a 0-byte long block clone. If that's successful it'll return true.
@@ -63,3 +74,46 @@ func ioctl(fd, operation, argp uintptr) error {
 	}
 	return nil
 }
+
+// PunchHole deallocates a range of a file with fallocate(2) and
+// FALLOC_FL_PUNCH_HOLE. The size of the file doesn't change, the range reads as
+// zeros afterwards. Not supported by all filesystems.
+func PunchHole(f *os.File, offset, length uint64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocPunchHole|fallocKeepSize, int64(offset), int64(length))
+	return errors.Wrapf(err, "failure punching hole into %s", f.Name())
+}
+
+// ZeroOutRange uses the BLKZEROOUT ioctl to zero a range of a block device.
+// Devices that support it, like thin-provisioned volumes or SSDs, can deallocate
+// the range instead of writing zeros. Offset and length need to be aligned to
+// the logical block size of the device.
+func ZeroOutRange(f *os.File, offset, length uint64) error {
+	arg := [2]uint64{offset, length}
+	err := ioctl(f.Fd(), blkZeroOut, uintptr(unsafe.Pointer(&arg[0])))
+	return errors.Wrapf(err, "failure zeroing out range in %s", f.Name())
+}
+
+// CopyRange copies a range between two files with copy_file_range(2), leaving
+// it to the kernel to move the data. Some filesystems can copy without reading
+// the data at all, like NFS 4.2 with server-side copy. Returns the number of
+// bytes copied, which can be less than length if it fails part of the way. Not
+// supported by all kernels and filesystems, callers need to fall back to a
+// regular copy.
+func CopyRange(dst, src *os.File, srcOffset, length, dstOffset uint64) (uint64, error) {
+	srcOff, dstOff := int64(srcOffset), int64(dstOffset)
+	var copied uint64
+	for copied < length {
+		n, err := unix.CopyFileRange(int(src.Fd()), &srcOff, int(dst.Fd()), &dstOff, int(length-copied), 0)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return copied, errors.Wrapf(err, "failure copying range from %s to %s", src.Name(), dst.Name())
+		}
+		if n == 0 {
+			return copied, fmt.Errorf("failure copying range from %s to %s: unexpected end of file", src.Name(), dst.Name())
+		}
+		copied += uint64(n)
+	}
+	return copied, nil
+}
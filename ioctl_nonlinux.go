@@ -14,3 +14,15 @@ func CanClone(dstFile string, srcFile string) bool {
 func CloneRange(dst, src *os.File, srcOffset, srcLength, dstOffset uint64) error {
 	return errors.New("Not available on this platform")
 }
+
+func PunchHole(f *os.File, offset, length uint64) error {
+	return errors.New("Not available on this platform")
+}
+
+func ZeroOutRange(f *os.File, offset, length uint64) error {
+	return errors.New("Not available on this platform")
+}
+
+func CopyRange(dst, src *os.File, srcOffset, length, dstOffset uint64) (uint64, error) {
+	return 0, errors.New("Not available on this platform")
+}
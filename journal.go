@@ -0,0 +1,213 @@
+package desync
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/folbricht/tempfile"
+)
+
+// Records which chunks of the target have been written or verified during
+// AssembleFile. It's written to disk periodically so an interrupted extract can
+// be resumed without reading the completed parts of the target again.
+type extractJournal struct {
+	name   string
+	index  string
+	chunks []IndexChunk
+	mu     sync.Mutex
+	done   []bool
+}
+
+// On-disk format of the journal. Completed holds ranges of chunk positions in
+// the index (first and last, inclusive). Size and ModTime (in nanoseconds since
+// epoch) are those of the target at the time the journal was written.
+type extractJournalFile struct {
+	Index     string   `json:"index"`
+	Size      int64    `json:"size"`
+	ModTime   int64    `json:"mtime"`
+	Completed [][2]int `json:"completed"`
+}
+
+func newExtractJournal(name string, idx Index) (*extractJournal, error) {
+	h := sha256.New()
+	if _, err := idx.WriteTo(h); err != nil {
+		return nil, err
+	}
+	return &extractJournal{
+		name:   name,
+		index:  fmt.Sprintf("%x", h.Sum(nil)),
+		chunks: idx.Chunks,
+		done:   make([]bool, len(idx.Chunks)),
+	}, nil
+}
+
+// Reads the journal from disk and returns the completed ranges if the journal
+// was written for the same index and the target still has the same size and
+// modification time. For regular files, the first and last chunk of every range
+// are read back and compared to the index in addition, ranges that don't match
+// are not returned. The modification time of block devices doesn't tell if
+// they were written to, so every chunk in the ranges is verified and only the
+// valid ones are returned. Returns nil if there's no usable journal.
+func (j *extractJournal) load(target string) [][2]int {
+	f, err := os.Open(j.name)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var jf extractJournalFile
+	if err := json.NewDecoder(f).Decode(&jf); err != nil {
+		return nil
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return nil
+	}
+	size, err := sizeOfFile(target)
+	if err != nil {
+		return nil
+	}
+	if jf.Index != j.index || jf.Size != size || jf.ModTime != info.ModTime().UnixNano() {
+		return nil
+	}
+	for _, r := range jf.Completed {
+		if r[0] < 0 || r[1] < r[0] || r[1] >= len(j.done) {
+			return nil
+		}
+	}
+	t, err := os.Open(target)
+	if err != nil {
+		return nil
+	}
+	defer t.Close()
+	var completed [][2]int
+	for _, r := range jf.Completed {
+		if info.Mode().IsRegular() {
+			if j.validChunk(t, r[0]) && j.validChunk(t, r[1]) {
+				completed = append(completed, r)
+			}
+			continue
+		}
+		start := -1
+		for i := r[0]; i <= r[1]; i++ {
+			switch valid := j.validChunk(t, i); {
+			case valid && start < 0:
+				start = i
+			case !valid && start >= 0:
+				completed = append(completed, [2]int{start, i - 1})
+				start = -1
+			}
+		}
+		if start >= 0 {
+			completed = append(completed, [2]int{start, r[1]})
+		}
+	}
+	return completed
+}
+
+// Returns true if the data in the target matches the chunk at position i in
+// the index.
+func (j *extractJournal) validChunk(t *os.File, i int) bool {
+	c := j.chunks[i]
+	b := make([]byte, c.Size)
+	if _, err := t.ReadAt(b, int64(c.Start)); err != nil {
+		return false
+	}
+	return ChunkID(sha512.Sum512_256(b)) == c.ID
+}
+
+// Marks a range of chunks as complete.
+func (j *extractJournal) add(first, last int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for i := first; i <= last; i++ {
+		j.done[i] = true
+	}
+}
+
+// Returns ranges of chunks that are complete, or not, depending on state.
+func (j *extractJournal) ranges(state bool) [][2]int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var (
+		ranges [][2]int
+		start  = -1
+	)
+	for i, done := range j.done {
+		switch {
+		case done == state && start < 0:
+			start = i
+		case done != state && start >= 0:
+			ranges = append(ranges, [2]int{start, i - 1})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		ranges = append(ranges, [2]int{start, len(j.done) - 1})
+	}
+	return ranges
+}
+
+// Writes the journal to disk, replacing any existing one. The target is synced
+// first so that everything the journal has as complete is actually on disk,
+// even if the system crashes before the next write. Its modification time is
+// recorded after that, so a journal written while the target is still being
+// written to, or one that was written to afterwards, isn't trusted.
+func (j *extractJournal) write(target string) error {
+	// Get the completed ranges before syncing, chunks completed after that may
+	// not be on disk yet
+	completed := j.ranges(true)
+	t, err := os.Open(target)
+	if err != nil {
+		return err
+	}
+	err = t.Sync()
+	t.Close()
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	size, err := sizeOfFile(target)
+	if err != nil {
+		return err
+	}
+	jf := extractJournalFile{
+		Index:     j.index,
+		Size:      size,
+		ModTime:   info.ModTime().UnixNano(),
+		Completed: completed,
+	}
+	tmp, err := tempfile.NewMode(filepath.Dir(j.name), "."+filepath.Base(j.name), 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := json.NewEncoder(tmp).Encode(jf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), j.name)
+}
+
+// Removes the journal from disk.
+func (j *extractJournal) remove() error {
+	err := os.Remove(j.name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+package desync
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAssembleJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Setup two stores, one with all chunks, one with only the first half
+	var stores []LocalStore
+	for _, name := range []string{"full", "partial"} {
+		d := filepath.Join(dir, name)
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewLocalStore(d, StoreOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores = append(stores, s)
+	}
+	full, partial := stores[0], stores[1]
+
+	// Build an index from random chunks
+	size := 1024
+	numChunks := 10
+	var (
+		idx      Index
+		expected []byte
+	)
+	for i := 0; i < numChunks; i++ {
+		b := make([]byte, size)
+		rand.Read(b)
+		chunk := NewChunkFromUncompressed(b)
+		if err := full.StoreChunk(chunk); err != nil {
+			t.Fatal(err)
+		}
+		if i < numChunks/2 {
+			if err := partial.StoreChunk(chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		idx.Chunks = append(idx.Chunks, IndexChunk{ID: chunk.ID(), Start: uint64(i * size), Size: uint64(size)})
+		expected = append(expected, b...)
+	}
+
+	tests := map[string]struct {
+		touch       bool
+		modify      bool
+		offset      int64
+		forceVerify bool
+		fromJournal uint64
+		inPlace     uint64
+	}{
+		"resume with journal":         {fromJournal: 5},
+		"target touched":              {touch: true, inPlace: 5},
+		"target modified":             {modify: true, inPlace: 4},
+		"target modified mid-range":   {modify: true, offset: int64(2 * size), inPlace: 4},
+		"resume with full validation": {forceVerify: true, inPlace: 5},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			target := filepath.Join(dir, "target")
+			journal := filepath.Join(dir, "journal")
+			defer os.Remove(target)
+
+			// Extract with only half the chunks available, this should fail and leave
+			// a journal behind
+			opt := AssembleOptions{Journal: journal, ForceVerify: test.forceVerify}
+			if _, err := AssembleFile(context.Background(), target, idx, partial, nil, 1, opt, nil); err == nil {
+				t.Fatal("expected error extracting from partial store")
+			}
+			if _, err := os.Stat(journal); err != nil {
+				t.Fatal(err)
+			}
+			if test.touch {
+				future := time.Now().Add(time.Hour)
+				if err := os.Chtimes(target, future, future); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.modify {
+				// Make sure the modification time changes even on filesystems
+				// with coarse timestamps
+				time.Sleep(20 * time.Millisecond)
+				f, err := os.OpenFile(target, os.O_WRONLY, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = f.WriteAt(make([]byte, 16), test.offset)
+				f.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Resume with all chunks available
+			stats, err := AssembleFile(context.Background(), target, idx, full, nil, 1, opt, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.ChunksFromJournal != test.fromJournal {
+				t.Fatalf("expected %d chunks from journal, got %d", test.fromJournal, stats.ChunksFromJournal)
+			}
+			if stats.ChunksInPlace != test.inPlace {
+				t.Fatalf("expected %d chunks in place, got %d", test.inPlace, stats.ChunksInPlace)
+			}
+			b, err := ioutil.ReadFile(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, expected) {
+				t.Fatal("extracted file doesn't match expected")
+			}
+
+			// The journal should be gone after a successful extract
+			if _, err := os.Stat(journal); !os.IsNotExist(err) {
+				t.Fatal("expected journal to be removed")
+			}
+		})
+	}
+}
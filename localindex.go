@@ -3,6 +3,7 @@ package desync
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"strings"
 
@@ -62,6 +63,16 @@ func (s LocalIndexStore) StoreIndex(name string, idx Index) error {
 	return err
 }
 
+// StoreIndexSignature stores a detached index signature with the given name.
+func (s LocalIndexStore) StoreIndexSignature(name string, sig []byte) error {
+	return ioutil.WriteFile(s.Path+name, sig, 0644)
+}
+
+// StoreIndexDigest stores a blob digest with the given name.
+func (s LocalIndexStore) StoreIndexDigest(name string, b []byte) error {
+	return ioutil.WriteFile(s.Path+name, b, 0644)
+}
+
 func (s LocalIndexStore) String() string {
 	return s.Path
 }
@@ -25,6 +25,30 @@ func IndexFromFile(ctx context.Context,
 	min, avg, max uint64,
 	pb ProgressBar,
 ) (Index, ChunkingStats, error) {
+	index, stats, _, err := indexFromFile(ctx, name, n, min, avg, max, false, pb)
+	return index, stats, err
+}
+
+// IndexFromFileWithDigest works like IndexFromFile and also returns the SHA-256
+// digest of the whole file. The data is hashed in the background as soon as its
+// chunks are confirmed, while it's likely still in the page cache, so the file
+// doesn't need to be read again.
+func IndexFromFileWithDigest(ctx context.Context,
+	name string,
+	n int,
+	min, avg, max uint64,
+	pb ProgressBar,
+) (Index, ChunkingStats, []byte, error) {
+	return indexFromFile(ctx, name, n, min, avg, max, true, pb)
+}
+
+func indexFromFile(ctx context.Context,
+	name string,
+	n int,
+	min, avg, max uint64,
+	withDigest bool,
+	pb ProgressBar,
+) (Index, ChunkingStats, []byte, error) {
 
 	stats := ChunkingStats{}
 
@@ -43,7 +67,7 @@ func IndexFromFile(ctx context.Context,
 	// If our input file has a catar header, copy its feature flags into the index
 	f, err := os.Open(name)
 	if err != nil {
-		return index, stats, err
+		return index, stats, nil, err
 	}
 	fDecoder := NewFormatDecoder(f)
 	piece, err := fDecoder.Next()
@@ -56,20 +80,29 @@ func IndexFromFile(ctx context.Context,
 	f.Close()
 
 	// Adjust n if it's a small file that doesn't have n*max bytes
-	info, err := os.Stat(name)
+	fileSize, err := sizeOfFile(name)
 	if err != nil {
-		return index, stats, err
+		return index, stats, nil, err
 	}
-	nn := int(info.Size()/int64(max)) + 1
+	nn := int(fileSize/int64(max)) + 1
 	if nn < n {
 		n = nn
 	}
-	size := uint64(info.Size())
+	size := uint64(fileSize)
 	span := size / uint64(n) // initial spacing between chunkers
 
+	// Hash the confirmed chunks in the background if requested
+	var digest *fileDigest
+	if withDigest {
+		if digest, err = newFileRangeDigest(name, size); err != nil {
+			return index, stats, nil, err
+		}
+		defer digest.close()
+	}
+
 	// Setup and start the progressbar if any
 	if pb != nil {
-		pb.SetTotal(int(info.Size()))
+		pb.SetTotal(int(fileSize))
 		pb.Start()
 		defer pb.Finish()
 	}
@@ -84,21 +117,21 @@ func IndexFromFile(ctx context.Context,
 	for i := 0; i < n; i++ {
 		f, err := os.Open(name) // open one file per worker
 		if err != nil {
-			return index, stats, err
+			return index, stats, nil, err
 		}
 		defer f.Close()
 		start := span * uint64(i)       // starting position for this chunker
 		mChunks := (size-start)/min + 1 // max # of chunks this worker can produce
 		s, err := f.Seek(int64(start), io.SeekStart)
 		if err != nil {
-			return index, stats, err
+			return index, stats, nil, err
 		}
 		if uint64(s) != start {
-			return index, stats, fmt.Errorf("requested seek to position %d, but got %d", start, s)
+			return index, stats, nil, fmt.Errorf("requested seek to position %d, but got %d", start, s)
 		}
 		c, err := NewChunker(f, min, avg, max)
 		if err != nil {
-			return index, stats, err
+			return index, stats, nil, err
 		}
 		p := &pChunker{
 			chunker:   c,
@@ -130,6 +163,9 @@ func IndexFromFile(ctx context.Context,
 		for chunk := range w.results {
 			// Assemble the list of chunks in the index
 			index.Chunks = append(index.Chunks, chunk)
+			if digest != nil {
+				digest.addRange(chunk.Start, chunk.Start+chunk.Size)
+			}
 			if pb != nil {
 				pb.Set(int(chunk.Start + chunk.Size))
 			}
@@ -137,7 +173,7 @@ func IndexFromFile(ctx context.Context,
 		}
 		// Done reading all chunks from this worker, check for any errors
 		if w.err != nil {
-			return index, stats, w.err
+			return index, stats, nil, w.err
 		}
 		// Stop if this worker reached the end of the stream (it's not necessarily
 		// the last worker!)
@@ -145,7 +181,11 @@ func IndexFromFile(ctx context.Context,
 			break
 		}
 	}
-	return index, stats, nil
+	if digest == nil {
+		return index, stats, nil, nil
+	}
+	sum, err := digest.sum()
+	return index, stats, sum, err
 }
 
 // Parallel chunk worker - Splits a stream and stores start, size and ID in
@@ -3,6 +3,7 @@ package desync
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/sha512"
 	"fmt"
 	"math/rand"
@@ -60,10 +61,12 @@ func TestParallelChunking(t *testing.T) {
 				expected = append(expected, IndexChunk{Start: start, Size: uint64(len(buf)), ID: id})
 			}
 
-			// Chunk the file with the parallel chunking algorithm and different degrees of concurrency
+			// Chunk the file with the parallel chunking algorithm and different degrees of
+			// concurrency, the digest should match that of the whole file
+			sum := sha256.Sum256(b)
 			for n := 1; n <= 10; n++ {
 				t.Run(fmt.Sprintf("%s, n=%d", name, n), func(t *testing.T) {
-					index, _, err := IndexFromFile(
+					index, _, digest, err := IndexFromFileWithDigest(
 						context.Background(),
 						f.Name(),
 						n,
@@ -79,6 +82,9 @@ func TestParallelChunking(t *testing.T) {
 							t.Fatal("chunks from parallel splitter don't match single stream chunks")
 						}
 					}
+					if !bytes.Equal(digest, sum[:]) {
+						t.Fatal("digest doesn't match the content of the file")
+					}
 				})
 			}
 		})
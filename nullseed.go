@@ -11,7 +11,10 @@ import (
 type nullChunkSeed struct {
 	id         ChunkID
 	blockfile  *os.File
+	zeroSize   uint64 // Number of 0 bytes in the blockfile
 	canReflink bool
+	punchHoles bool // Deallocate null chunk ranges in existing regular files
+	zeroOut    bool // Use BLKZEROOUT for null chunk ranges in block devices
 }
 
 func newNullChunkSeed(dstFile string, blocksize uint64, max uint64) (*nullChunkSeed, error) {
@@ -19,18 +22,25 @@ func newNullChunkSeed(dstFile string, blocksize uint64, max uint64) (*nullChunkS
 	if err != nil {
 		return nil, err
 	}
+	// Ranges of 0 bytes are cloned or copied with copy_file_range from the
+	// blockfile. If cloning isn't supported, a sparse file is enough for that.
 	var canReflink bool
+	zeroSize := max
 	if CanClone(dstFile, blockfile.Name()) {
 		canReflink = true
+		zeroSize = blocksize
 		b := make([]byte, blocksize)
 		if _, err := blockfile.Write(b); err != nil {
 			return nil, err
 		}
+	} else if err := blockfile.Truncate(int64(max)); err != nil {
+		zeroSize = 0
 	}
 	return &nullChunkSeed{
 		id:         NewNullChunk(max).ID,
 		canReflink: canReflink,
 		blockfile:  blockfile,
+		zeroSize:   zeroSize,
 	}, nil
 }
 
@@ -60,70 +70,126 @@ func (s *nullChunkSeed) LongestMatchWith(chunks []IndexChunk) (int, SeedSegment)
 		from:       chunks[0].Start,
 		to:         chunks[n-1].Start + chunks[n-1].Size,
 		blockfile:  s.blockfile,
+		zeroSize:   s.zeroSize,
 		canReflink: s.canReflink,
+		punchHoles: s.punchHoles,
+		zeroOut:    s.zeroOut,
 	}
 }
 
 type nullChunkSection struct {
 	from, to   uint64
 	blockfile  *os.File
+	zeroSize   uint64
 	canReflink bool
+	punchHoles bool
+	zeroOut    bool
 }
 
 func (s *nullChunkSection) Size() uint64 { return s.to - s.from }
 
-func (s *nullChunkSection) WriteInto(dst *os.File, offset, length, blocksize uint64, isBlank bool) (uint64, uint64, error) {
+func (s *nullChunkSection) WriteInto(dst *os.File, offset, length, blocksize uint64, isBlank bool) (uint64, uint64, uint64, error) {
 	if length != s.Size() {
-		return 0, 0, fmt.Errorf("unable to copy %d bytes to %s : wrong size", length, dst.Name())
+		return 0, 0, 0, fmt.Errorf("unable to copy %d bytes to %s : wrong size", length, dst.Name())
 	}
 
-	// When cloning isn'a available we'd normally have to copy the 0 bytes into
-	// the target range. But if that's already blank (because it's a new/truncated
-	// file) there's no need to copy 0 bytes.
-	if !s.canReflink {
-		if isBlank {
-			return 0, 0, nil
+	// If the target is blank (because it's a new/truncated file) the range is
+	// already a hole that reads as 0 bytes, there's nothing to write.
+	if isBlank {
+		return 0, 0, 0, nil
+	}
+
+	// Deallocate the range in existing files to keep them sparse, or zero it out
+	// on block devices if requested. If that's not supported, fall back to
+	// cloning or copying 0 bytes.
+	switch {
+	case s.punchHoles:
+		if err := PunchHole(dst, offset, length); err == nil {
+			return 0, 0, 0, nil
 		}
-		return s.copy(dst, offset, s.Size())
+	case s.zeroOut:
+		if copied, offloaded, err := s.zeroOutRange(dst, offset, length, blocksize); err == nil {
+			return copied, 0, offloaded, nil
+		}
+	}
+	if !s.canReflink {
+		copied, offloaded, err := s.copy(dst, offset, s.Size())
+		return copied, 0, offloaded, err
 	}
 	return s.clone(dst, offset, length, blocksize)
 }
 
-func (s *nullChunkSection) copy(dst *os.File, offset, length uint64) (uint64, uint64, error) {
-	if _, err := dst.Seek(int64(offset), os.SEEK_SET); err != nil {
+// Zeroes out the blocks in the range with BLKZEROOUT and copies 0 bytes into
+// the parts before and after that aren't aligned to the blocksize.
+func (s *nullChunkSection) zeroOutRange(dst *os.File, offset, length, blocksize uint64) (uint64, uint64, error) {
+	alignStart := (offset + blocksize - 1) / blocksize * blocksize
+	alignEnd := (offset + length) / blocksize * blocksize
+	if alignEnd <= alignStart {
+		return s.copy(dst, offset, length)
+	}
+	if err := ZeroOutRange(dst, alignStart, alignEnd-alignStart); err != nil {
 		return 0, 0, err
 	}
+	c1, o1, err := s.copy(dst, offset, alignStart-offset)
+	if err != nil {
+		return c1, o1, err
+	}
+	c2, o2, err := s.copy(dst, alignEnd, offset+length-alignEnd)
+	return c1 + c2, o1 + o2, err
+}
+
+// Writes 0 bytes into a range of the target. They're copied from the blockfile
+// by the kernel with copy_file_range if possible, and through a buffer if not.
+// Returns the number of bytes copied, and how many of those were copied by the
+// kernel.
+func (s *nullChunkSection) copy(dst *os.File, offset, length uint64) (uint64, uint64, error) {
+	var offloaded uint64
+	for s.zeroSize > 0 && offloaded < length {
+		n := length - offloaded
+		if n > s.zeroSize {
+			n = s.zeroSize
+		}
+		c, err := CopyRange(dst, s.blockfile, 0, n, offset+offloaded)
+		offloaded += c
+		if err != nil {
+			break
+		}
+	}
+	if offloaded == length {
+		return offloaded, offloaded, nil
+	}
+	if _, err := dst.Seek(int64(offset+offloaded), os.SEEK_SET); err != nil {
+		return offloaded, offloaded, err
+	}
 	// Copy using a fixed buffer. Using io.Copy() with a LimitReader will make it
 	// create a buffer matching N of the LimitReader which can be too large
-	copied, err := io.CopyBuffer(dst, io.LimitReader(nullReader{}, int64(length)), make([]byte, 64*1024))
-	return uint64(copied), 0, err
+	copied, err := io.CopyBuffer(dst, io.LimitReader(nullReader{}, int64(length-offloaded)), make([]byte, 64*1024))
+	return offloaded + uint64(copied), offloaded, err
 }
 
-func (s *nullChunkSection) clone(dst *os.File, offset, length, blocksize uint64) (uint64, uint64, error) {
+func (s *nullChunkSection) clone(dst *os.File, offset, length, blocksize uint64) (uint64, uint64, uint64, error) {
 	dstAlignStart := (offset/blocksize + 1) * blocksize
 	dstAlignEnd := (offset + length) / blocksize * blocksize
 
 	// fill the area before the first aligned block
-	var copied, cloned uint64
-	c1, _, err := s.copy(dst, offset, dstAlignStart-offset)
+	var cloned uint64
+	c1, o1, err := s.copy(dst, offset, dstAlignStart-offset)
 	if err != nil {
-		return c1, 0, err
+		return c1, 0, o1, err
 	}
-	copied += c1
 	// fill the area after the last aligned block
-	c2, _, err := s.copy(dst, dstAlignEnd, offset+length-dstAlignEnd)
+	c2, o2, err := s.copy(dst, dstAlignEnd, offset+length-dstAlignEnd)
 	if err != nil {
-		return copied + c2, 0, err
+		return c1 + c2, 0, o1 + o2, err
 	}
-	copied += c2
 
 	for blkOffset := dstAlignStart; blkOffset < dstAlignEnd; blkOffset += blocksize {
 		if err := CloneRange(dst, s.blockfile, 0, blocksize, blkOffset); err != nil {
-			return copied, cloned, err
+			return c1 + c2, cloned, o1 + o2, err
 		}
 		cloned += blocksize
 	}
-	return copied, cloned, nil
+	return c1 + c2, cloned, o1 + o2, nil
 }
 
 type nullReader struct{}
@@ -0,0 +1,89 @@
+package desync
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestNullChunkPunchHole(t *testing.T) {
+	dir, err := ioutil.TempDir("", "punch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := filepath.Join(dir, "store")
+	if err := os.Mkdir(store, 0755); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewLocalStore(store, StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Build an index with a random chunk followed by null chunks
+	max := uint64(64 * 1024)
+	data := make([]byte, max)
+	rand.Read(data)
+	chunk := NewChunkFromUncompressed(data)
+	if err := s.StoreChunk(chunk); err != nil {
+		t.Fatal(err)
+	}
+	null := NewNullChunk(max)
+	idx := Index{Index: FormatIndex{ChunkSizeMax: max}}
+	idx.Chunks = append(idx.Chunks, IndexChunk{ID: chunk.ID(), Start: 0, Size: max})
+	for i := uint64(1); i < 16; i++ {
+		idx.Chunks = append(idx.Chunks, IndexChunk{ID: null.ID, Start: i * max, Size: max})
+	}
+	expected := append(data, make([]byte, 15*max)...)
+
+	// Fill the target with random data so it's fully allocated
+	target := filepath.Join(dir, "target")
+	b := make([]byte, len(expected))
+	rand.Read(b)
+	if err := ioutil.WriteFile(target, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Skip the test if the filesystem doesn't support punching holes
+	f, err := os.OpenFile(target, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = PunchHole(f, 0, 4096)
+	f.Close()
+	if err != nil {
+		t.Skipf("punching holes not supported: %s", err)
+	}
+	before := allocatedBytes(t, target)
+
+	// Extract in-place, the null chunks should be deallocated
+	if _, err := AssembleFile(context.Background(), target, idx, s, nil, 1, AssembleOptions{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatal("extracted file doesn't match expected")
+	}
+	after := allocatedBytes(t, target)
+	if after > before/2 {
+		t.Fatalf("expected target to be sparse, %d bytes allocated before, %d after", before, after)
+	}
+}
+
+func allocatedBytes(t *testing.T, name string) int64 {
+	var st syscall.Stat_t
+	if err := syscall.Stat(name, &st); err != nil {
+		t.Fatal(err)
+	}
+	return st.Blocks * 512
+}
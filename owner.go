@@ -0,0 +1,167 @@
+package desync
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// OwnerMap translates the owners of files in an archive to local users and
+// groups when extracting. It's read from a file with one mapping per line in
+// the form "user|group <archive> <local>". Users and groups can be given by
+// name or ID on either side. Empty lines and lines starting with # are ignored.
+//
+//	user  alice 1001
+//	user  1000  bob
+//	group 500   wheel
+type OwnerMap struct {
+	users  map[string]int
+	groups map[string]int
+}
+
+// NewOwnerMap reads an owner mapping. Local users and groups given by name
+// need to exist.
+func NewOwnerMap(r io.Reader) (*OwnerMap, error) {
+	m := &OwnerMap{users: make(map[string]int), groups: make(map[string]int)}
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid owner mapping in line %d: %q", line, text)
+		}
+		switch fields[0] {
+		case "user":
+			uid, ok := lookupUID(fields[2])
+			if !ok {
+				return nil, fmt.Errorf("unknown user %q in line %d of owner mapping", fields[2], line)
+			}
+			m.users[fields[1]] = uid
+		case "group":
+			gid, ok := lookupGID(fields[2])
+			if !ok {
+				return nil, fmt.Errorf("unknown group %q in line %d of owner mapping", fields[2], line)
+			}
+			m.groups[fields[1]] = gid
+		default:
+			return nil, fmt.Errorf("invalid owner mapping type %q in line %d, expected user or group", fields[0], line)
+		}
+	}
+	return m, s.Err()
+}
+
+// Returns the mapped UID for a user, looked up by name first, then by ID.
+func (m *OwnerMap) uid(id int, name string) (int, bool) {
+	if m == nil {
+		return 0, false
+	}
+	return m.lookup(m.users, id, name)
+}
+
+// Returns the mapped GID for a group, looked up by name first, then by ID.
+func (m *OwnerMap) gid(id int, name string) (int, bool) {
+	if m == nil {
+		return 0, false
+	}
+	return m.lookup(m.groups, id, name)
+}
+
+func (m *OwnerMap) lookup(ids map[string]int, id int, name string) (int, bool) {
+	if name != "" {
+		if mapped, ok := ids[name]; ok {
+			return mapped, true
+		}
+	}
+	mapped, ok := ids[strconv.Itoa(id)]
+	return mapped, ok
+}
+
+// Cache of user and group lookups, in both directions. Looking them up can
+// be expensive, for example with NSS modules that query the network.
+var ownerCache = struct {
+	sync.Mutex
+	userNames, groupNames map[int]string
+	uids, gids            map[string]int
+}{
+	userNames:  make(map[int]string),
+	groupNames: make(map[int]string),
+	uids:       make(map[string]int),
+	gids:       make(map[string]int),
+}
+
+// Returns the name of a local user, or an empty string if there's none.
+func userName(uid int) string {
+	ownerCache.Lock()
+	defer ownerCache.Unlock()
+	if name, ok := ownerCache.userNames[uid]; ok {
+		return name
+	}
+	var name string
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		name = u.Username
+	}
+	ownerCache.userNames[uid] = name
+	return name
+}
+
+// Returns the name of a local group, or an empty string if there's none.
+func groupName(gid int) string {
+	ownerCache.Lock()
+	defer ownerCache.Unlock()
+	if name, ok := ownerCache.groupNames[gid]; ok {
+		return name
+	}
+	var name string
+	if g, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+		name = g.Name
+	}
+	ownerCache.groupNames[gid] = name
+	return name
+}
+
+// Returns the UID of a local user given by name or ID.
+func lookupUID(s string) (int, bool) {
+	if id, err := strconv.Atoi(s); err == nil {
+		return id, true
+	}
+	ownerCache.Lock()
+	defer ownerCache.Unlock()
+	if id, ok := ownerCache.uids[s]; ok {
+		return id, id >= 0
+	}
+	id := -1
+	if u, err := user.Lookup(s); err == nil {
+		if n, err := strconv.Atoi(u.Uid); err == nil {
+			id = n
+		}
+	}
+	ownerCache.uids[s] = id
+	return id, id >= 0
+}
+
+// Returns the GID of a local group given by name or ID.
+func lookupGID(s string) (int, bool) {
+	if id, err := strconv.Atoi(s); err == nil {
+		return id, true
+	}
+	ownerCache.Lock()
+	defer ownerCache.Unlock()
+	if id, ok := ownerCache.gids[s]; ok {
+		return id, id >= 0
+	}
+	id := -1
+	if g, err := user.LookupGroup(s); err == nil {
+		if n, err := strconv.Atoi(g.Gid); err == nil {
+			id = n
+		}
+	}
+	ownerCache.gids[s] = id
+	return id, id >= 0
+}
@@ -0,0 +1,183 @@
+package desync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+)
+
+// Sources of data in an extract plan other than seed files
+const (
+	PlanSourceStore     = "store"
+	PlanSourceNullChunk = "null-chunk"
+	PlanSourceSelf      = "self"
+)
+
+// ExtractPlan describes what AssembleFile would do to assemble a file from an
+// index and seeds. The embedded ExtractStats hold the numbers that would be
+// expected after the extract.
+type ExtractPlan struct {
+	ExtractStats
+
+	// Ranges in the target and where the data for them would come from
+	Segments []PlanSegment `json:"segments"`
+
+	// Unique chunks that would need to be read from the store (including the cache)
+	UniqueChunksFromStore int `json:"unique-chunks-from-store"`
+
+	// Unique chunks that need to come from the store but are already in the cache
+	ChunksInCache int `json:"chunks-in-cache"`
+
+	// Total (uncompressed) size of all unique chunks that are not in the cache
+	BytesToDownload uint64 `json:"bytes-to-download"`
+}
+
+// PlanSegment is a range of the target and the source of the data for it. Source
+// is the name of a seed file, or one of PlanSourceStore, PlanSourceNullChunk or
+// PlanSourceSelf. Reflink is true if at least part of the range can be cloned.
+type PlanSegment struct {
+	Start   uint64 `json:"start"`
+	Size    uint64 `json:"size"`
+	Chunks  int    `json:"chunks"`
+	Source  string `json:"source"`
+	Reflink bool   `json:"reflink"`
+}
+
+// PlanExtract determines how AssembleFile would assemble the file name from an
+// index and seeds, without writing to the target. The same sequencing of seeds is
+// used, including the null-chunk seed and using ranges earlier in the target as
+// seed. If cache is not nil, it's queried for chunks that need to be read from the
+// store. Chunks already present in an existing target are not taken into account.
+func PlanExtract(ctx context.Context, name string, idx Index, cache Store, seeds []Seed) (*ExtractPlan, error) {
+	plan := &ExtractPlan{
+		ExtractStats: ExtractStats{
+			BytesTotal:  idx.Length(),
+			ChunksTotal: len(idx.Chunks),
+		},
+		Segments: []PlanSegment{},
+	}
+	if len(idx.Chunks) == 0 {
+		return plan, nil
+	}
+
+	// Use the blocksize of the target if it exists, or of the directory it'd be in.
+	// Null chunks are only written into block devices, regular files get holes.
+	var (
+		blocksize   uint64
+		isBlkDevice bool
+	)
+	info, err := os.Stat(name)
+	switch {
+	case err != nil:
+		blocksize = blocksizeOfFile(filepath.Dir(name))
+	case isDevice(info.Mode()):
+		blocksize = blocksizeOfFile(name)
+		isBlkDevice = true
+	default:
+		blocksize = blocksizeOfFile(name)
+	}
+	plan.Blocksize = blocksize
+
+	// Setup the same seeds as AssembleFile, but without a blockfile for the null
+	// chunk since nothing is written
+	ns := &nullChunkSeed{id: NewNullChunk(idx.Index.ChunkSizeMax).ID}
+	ss, err := newSelfSeed(name, idx)
+	if err != nil {
+		return plan, err
+	}
+	seeds = append([]Seed{ns, ss}, seeds...)
+	plan.Seeds = len(seeds)
+
+	// Run the sequencer and record where each segment would come from
+	fromStore := make(map[ChunkID]uint64)
+	seq := NewSeedSequencer(idx, seeds...)
+	for {
+		select {
+		case <-ctx.Done():
+			return plan, Interrupted{}
+		default:
+		}
+		segment, source, done := seq.Next()
+		ps := PlanSegment{
+			Start:  segment.start(),
+			Size:   segment.lengthBytes(),
+			Chunks: segment.lengthChunks(),
+		}
+		switch src := source.(type) {
+		case nil:
+			ps.Source = PlanSourceStore
+			plan.ChunksFromStore++
+			c := segment.chunks()[0]
+			fromStore[c.ID] = c.Size
+		case *nullChunkSection:
+			ps.Source = PlanSourceNullChunk
+			plan.ChunksFromSeeds += uint64(ps.Chunks)
+			if isBlkDevice {
+				plan.addPlannedWrite(ps.Start, ps.Size, blocksize, false)
+			}
+		case *fileSeedSegment:
+			ps.Source = src.file
+			if src.file == name {
+				ps.Source = PlanSourceSelf
+			}
+			aligned := src.chunks[0].Start%blocksize == ps.Start%blocksize
+			ps.Reflink = src.canReflink && aligned
+			plan.ChunksFromSeeds += uint64(ps.Chunks)
+			plan.addPlannedWrite(ps.Start, ps.Size, blocksize, ps.Reflink)
+		default:
+			ps.Source = "unknown"
+			plan.ChunksFromSeeds += uint64(ps.Chunks)
+		}
+		plan.addSegment(ps)
+
+		// Everything up to here would have been written, make it available in the
+		// self-seed
+		ss.add(segment)
+		if done {
+			break
+		}
+	}
+
+	// Find out how many of the chunks from the store are already in the cache
+	plan.UniqueChunksFromStore = len(fromStore)
+	for id, size := range fromStore {
+		if cache != nil {
+			if hasChunk, err := cache.HasChunk(id); err == nil && hasChunk {
+				plan.ChunksInCache++
+				continue
+			}
+		}
+		plan.BytesToDownload += size
+	}
+	return plan, nil
+}
+
+// Adds a segment to the plan, merging adjacent segments from the store.
+func (p *ExtractPlan) addSegment(s PlanSegment) {
+	if n := len(p.Segments); n > 0 && s.Source == PlanSourceStore {
+		last := &p.Segments[n-1]
+		if last.Source == PlanSourceStore && last.Start+last.Size == s.Start {
+			last.Size += s.Size
+			last.Chunks += s.Chunks
+			return
+		}
+	}
+	p.Segments = append(p.Segments, s)
+}
+
+// Records how many bytes would be copied or cloned when writing a range from a
+// seed, splitting it the same way as seeds do when cloning.
+func (p *ExtractPlan) addPlannedWrite(offset, length, blocksize uint64, reflink bool) {
+	if !reflink {
+		p.BytesCopied += length
+		return
+	}
+	alignStart := (offset/blocksize + 1) * blocksize
+	alignEnd := (offset + length) / blocksize * blocksize
+	if alignEnd <= alignStart {
+		p.BytesCopied += length
+		return
+	}
+	p.BytesCloned += alignEnd - alignStart
+	p.BytesCopied += length - (alignEnd - alignStart)
+}
@@ -0,0 +1,89 @@
+package desync
+
+import (
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPlanExtract(t *testing.T) {
+	// Setup a temporary cache store
+	cacheDir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := NewLocalStore(cacheDir, StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Build 3 random chunks, only the last one is in the cache
+	size := 1024
+	var ids []ChunkID
+	for i := 0; i < 3; i++ {
+		b := make([]byte, size)
+		rand.Read(b)
+		chunk := NewChunkFromUncompressed(b)
+		if i == 2 {
+			if err := cache.StoreChunk(chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ids = append(ids, chunk.ID())
+	}
+
+	// Build an index with a repeating sequence, the second occurrence should come
+	// from the self-seed
+	var idx Index
+	idx.Index.ChunkSizeMax = uint64(size)
+	for i, p := range []int{0, 1, 0, 1, 2} {
+		idx.Chunks = append(idx.Chunks, IndexChunk{
+			ID:    ids[p],
+			Start: uint64(i * size),
+			Size:  uint64(size),
+		})
+	}
+
+	// The target doesn't exist, nothing should be written
+	dst := filepath.Join(cacheDir, "dst")
+	plan, err := PlanExtract(context.Background(), dst, idx, cache, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Fatal("expected target to not be created")
+	}
+
+	expected := []PlanSegment{
+		{Start: 0, Size: uint64(2 * size), Chunks: 2, Source: PlanSourceStore},
+		{Start: uint64(2 * size), Size: uint64(2 * size), Chunks: 2, Source: PlanSourceSelf},
+		{Start: uint64(4 * size), Size: uint64(size), Chunks: 1, Source: PlanSourceStore},
+	}
+	if len(plan.Segments) != len(expected) {
+		t.Fatalf("expected %d segments, got %+v", len(expected), plan.Segments)
+	}
+	for i := range expected {
+		got := plan.Segments[i]
+		got.Reflink = false
+		if got != expected[i] {
+			t.Fatalf("segment %d: expected %+v, got %+v", i, expected[i], got)
+		}
+	}
+	if plan.ChunksTotal != 5 || plan.ChunksFromStore != 3 || plan.ChunksFromSeeds != 2 {
+		t.Fatalf("unexpected chunk counts in plan: %+v", plan.ExtractStats)
+	}
+	if plan.UniqueChunksFromStore != 3 {
+		t.Fatalf("expected 3 unique chunks from store, got %d", plan.UniqueChunksFromStore)
+	}
+	if plan.ChunksInCache != 1 {
+		t.Fatalf("expected 1 chunk in cache, got %d", plan.ChunksInCache)
+	}
+	if plan.BytesToDownload != uint64(2*size) {
+		t.Fatalf("expected %d bytes to download, got %d", 2*size, plan.BytesToDownload)
+	}
+}
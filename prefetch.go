@@ -0,0 +1,252 @@
+package desync
+
+import (
+	"context"
+	"crypto/sha512"
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+// DefaultFetchMemory is the default for the amount of chunk data AssembleFile
+// fetches from the store ahead of the writers.
+const DefaultFetchMemory = 64 << 20
+
+// Chunk that is being fetched from the store ahead of the writers. It's complete
+// when done is closed.
+type chunkFetch struct {
+	chunk   IndexChunk
+	weight  int64
+	done    chan struct{}
+	inPlace bool   // Data in the target already matches the chunk, nothing was fetched
+	data    []byte // Uncompressed chunk data
+	err     error
+}
+
+func (f *chunkFetch) wait() ([]byte, bool, error) {
+	<-f.done
+	return f.data, f.inPlace, f.err
+}
+
+// Fetches chunks from a store ahead of the writers of AssembleFile. It walks the
+// index in the same order as the writers and requests every chunk that is
+// expected to come from the store, without holding more than a given amount of
+// chunk data in memory. The writers then take the fetched chunks by their
+// position in the index. If the target isn't blank, the data already in it is
+// checked first and the chunk is only fetched if it doesn't match.
+type chunkPrefetcher struct {
+	s       Store
+	name    string
+	isBlank bool
+	memory  int64
+	sem     *semaphore.Weighted
+	queue   chan *chunkFetch
+
+	mu      sync.Mutex
+	fetches map[int]*chunkFetch // Chunks that were requested, by position
+	passed  map[int]struct{}    // Positions the writers got to before they were requested
+	next    int                 // Next position to be considered for fetching
+}
+
+func newChunkPrefetcher(s Store, name string, isBlank bool, memory int64) *chunkPrefetcher {
+	return &chunkPrefetcher{
+		s:       s,
+		name:    name,
+		isBlank: isBlank,
+		memory:  memory,
+		sem:     semaphore.NewWeighted(memory),
+		queue:   make(chan *chunkFetch),
+		fetches: make(map[int]*chunkFetch),
+		passed:  make(map[int]struct{}),
+	}
+}
+
+// Starts n goroutines in the group that fetch chunks, plus one that walks the
+// given ranges of the index and queues the chunks that aren't expected to come
+// from the seeds. Errors are reported to the writers of the chunks, not to the
+// group.
+func (p *chunkPrefetcher) start(ctx context.Context, g *errgroup.Group, n int, idx Index, ranges [][2]int, seeds []Seed) error {
+	for i := 0; i < n; i++ {
+		var f *os.File
+		if !p.isBlank {
+			var err error
+			if f, err = os.Open(p.name); err != nil {
+				close(p.queue)
+				return fmt.Errorf("unable to open file %s, %s", p.name, err)
+			}
+		}
+		g.Go(func() error {
+			if f != nil {
+				defer f.Close()
+			}
+			for cf := range p.queue {
+				p.fetch(f, cf)
+				close(cf.done)
+			}
+			return nil
+		})
+	}
+	g.Go(func() error {
+		defer close(p.queue)
+		p.lookahead(ctx, idx, ranges, seeds)
+		return nil
+	})
+	return nil
+}
+
+// Queues all chunks in the ranges that are expected to come from the store.
+// Chunks that are available in one of the seeds are skipped, as are null chunks
+// and chunks that appear earlier in the index, since those are likely to be
+// copied from the target itself by then. Memory for the chunks is reserved in
+// order so chunks needed earlier by the writers are always fetched first.
+func (p *chunkPrefetcher) lookahead(ctx context.Context, idx Index, ranges [][2]int, seeds []Seed) {
+	nullID := NewNullChunk(idx.Index.ChunkSizeMax).ID
+	seen := make(map[ChunkID]struct{})
+	for _, r := range ranges {
+		// Chunks before this range are in the target already
+		for _, c := range idx.Chunks[p.next:r[0]] {
+			seen[c.ID] = struct{}{}
+		}
+		for i := r[0]; i <= r[1]; i++ {
+			c := idx.Chunks[i]
+			_, dup := seen[c.ID]
+			seen[c.ID] = struct{}{}
+			if dup || c.ID == nullID || inSeeds(c, seeds) {
+				p.skip(i)
+				continue
+			}
+			cf := &chunkFetch{chunk: c, weight: int64(c.Size), done: make(chan struct{})}
+			if cf.weight > p.memory {
+				cf.weight = p.memory
+			}
+			if !p.register(i, cf) {
+				continue
+			}
+			if err := p.sem.Acquire(ctx, cf.weight); err != nil {
+				cf.err = err
+				close(cf.done)
+				return
+			}
+			select {
+			case <-ctx.Done():
+				cf.err = ctx.Err()
+				p.sem.Release(cf.weight)
+				close(cf.done)
+				return
+			case p.queue <- cf:
+			}
+		}
+	}
+}
+
+func (p *chunkPrefetcher) fetch(f *os.File, cf *chunkFetch) {
+	if f != nil {
+		cf.inPlace, cf.err = chunkInPlace(f, cf.chunk)
+		if cf.err != nil || cf.inPlace {
+			p.sem.Release(cf.weight)
+			return
+		}
+	}
+	if cf.data, cf.err = fetchChunk(p.s, cf.chunk); cf.err != nil {
+		p.sem.Release(cf.weight)
+	}
+}
+
+// Records a chunk as requested, unless the writers got to it already.
+func (p *chunkPrefetcher) register(pos int, cf *chunkFetch) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.next = pos + 1
+	if _, ok := p.passed[pos]; ok {
+		delete(p.passed, pos)
+		return false
+	}
+	p.fetches[pos] = cf
+	return true
+}
+
+// Moves past a position without requesting the chunk.
+func (p *chunkPrefetcher) skip(pos int) {
+	p.mu.Lock()
+	p.next = pos + 1
+	delete(p.passed, pos)
+	p.mu.Unlock()
+}
+
+// Returns the chunk at the given position if it was requested, nil otherwise.
+// The caller needs to release the chunk once it's been written.
+func (p *chunkPrefetcher) take(pos int) *chunkFetch {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cf, ok := p.fetches[pos]; ok {
+		delete(p.fetches, pos)
+		return cf
+	}
+	// Make sure it's not requested anymore if the lookahead didn't get here yet
+	if pos >= p.next {
+		p.passed[pos] = struct{}{}
+	}
+	return nil
+}
+
+// Drops any chunks that were requested for the given range of positions, when
+// the range was written from a seed instead. Memory is released once chunks that
+// are still being fetched are done.
+func (p *chunkPrefetcher) discard(first, last int) {
+	for i := first; i <= last; i++ {
+		if cf := p.take(i); cf != nil {
+			go func() {
+				cf.wait()
+				p.release(cf)
+			}()
+		}
+	}
+}
+
+// Releases the memory held by a fetched chunk once it's been written.
+func (p *chunkPrefetcher) release(cf *chunkFetch) {
+	if cf.data == nil {
+		return
+	}
+	cf.data = nil
+	p.sem.Release(cf.weight)
+}
+
+// Returns true if the chunk is available in any of the seeds.
+func inSeeds(c IndexChunk, seeds []Seed) bool {
+	for _, s := range seeds {
+		if n, _ := s.LongestMatchWith([]IndexChunk{c}); n > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the data in the file at the position of the chunk matches it.
+func chunkInPlace(f *os.File, c IndexChunk) (bool, error) {
+	b := make([]byte, c.Size)
+	if _, err := f.ReadAt(b, int64(c.Start)); err != nil {
+		return false, err
+	}
+	return sha512.Sum512_256(b) == c.ID, nil
+}
+
+// Pulls a chunk from the store and returns its uncompressed data.
+func fetchChunk(s Store, c IndexChunk) ([]byte, error) {
+	chunk, err := s.GetChunk(c.ID)
+	if err != nil {
+		return nil, err
+	}
+	b, err := chunk.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	// Might as well verify the chunk size while we're at it
+	if c.Size != uint64(len(b)) {
+		return nil, fmt.Errorf("unexpected size for chunk %s", c.ID)
+	}
+	return b, nil
+}
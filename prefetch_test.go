@@ -0,0 +1,114 @@
+package desync
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Store with a fixed latency per request that records how many requests are
+// in flight at most.
+type slowStore struct {
+	Store
+	latency time.Duration
+
+	mu            sync.Mutex
+	inFlight, max int
+}
+
+func (s *slowStore) GetChunk(id ChunkID) (*Chunk, error) {
+	s.mu.Lock()
+	s.inFlight++
+	if s.inFlight > s.max {
+		s.max = s.inFlight
+	}
+	s.mu.Unlock()
+	time.Sleep(s.latency)
+	s.mu.Lock()
+	s.inFlight--
+	s.mu.Unlock()
+	return s.Store.GetChunk(id)
+}
+
+func TestAssemblePrefetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prefetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := filepath.Join(dir, "store")
+	if err := os.Mkdir(store, 0755); err != nil {
+		t.Fatal(err)
+	}
+	ls, err := NewLocalStore(store, StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Build an index from random chunks
+	size := 1024
+	var (
+		idx  Index
+		data []byte
+	)
+	for i := 0; i < 50; i++ {
+		b := make([]byte, size)
+		rand.Read(b)
+		chunk := NewChunkFromUncompressed(b)
+		if err := ls.StoreChunk(chunk); err != nil {
+			t.Fatal(err)
+		}
+		idx.Chunks = append(idx.Chunks, IndexChunk{ID: chunk.ID(), Start: uint64(i * size), Size: uint64(size)})
+		data = append(data, b...)
+	}
+
+	tests := map[string]struct {
+		options     AssembleOptions
+		minInFlight int
+		maxInFlight int
+	}{
+		"fetch ahead of a single writer": {
+			options:     AssembleOptions{FetchConcurrency: 8},
+			minInFlight: 2,
+			maxInFlight: 9, // The writer can fetch a chunk itself if it gets there first
+		},
+		"memory for a single chunk": {
+			options:     AssembleOptions{FetchConcurrency: 8, FetchMemory: int64(size)},
+			minInFlight: 1,
+			maxInFlight: 2,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := &slowStore{Store: ls, latency: 5 * time.Millisecond}
+			target := filepath.Join(dir, "target")
+			defer os.Remove(target)
+
+			// Extract with a single writer
+			stats, err := AssembleFile(context.Background(), target, idx, s, nil, 1, test.options, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadFile(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, data) {
+				t.Fatal("extracted file doesn't match expected")
+			}
+			if stats.ChunksFromStore != uint64(len(idx.Chunks)) {
+				t.Fatalf("expected %d chunks from store, got %d", len(idx.Chunks), stats.ChunksFromStore)
+			}
+			if s.max < test.minInFlight || s.max > test.maxInFlight {
+				t.Fatalf("expected between %d and %d requests in flight, got %d", test.minInFlight, test.maxInFlight, s.max)
+			}
+		})
+	}
+}
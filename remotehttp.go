@@ -122,6 +122,8 @@ retry:
 	case 200: // expected
 	case 404:
 		return nil, NoSuchObject{name}
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return nil, StoreThrottled{Location: u.String(), Status: resp.StatusCode}
 	default:
 		return nil, fmt.Errorf("unexpected status code %d from %s", resp.StatusCode, name)
 	}
@@ -162,6 +164,10 @@ retry:
 	}
 	defer resp.Body.Close()
 	msg, _ := ioutil.ReadAll(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return StoreThrottled{Location: u.String(), Status: resp.StatusCode}
+	}
 	if resp.StatusCode != 200 {
 		return errors.New(string(msg))
 	}
@@ -223,6 +229,8 @@ retry:
 		return true, nil
 	case 404:
 		return false, nil
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return false, StoreThrottled{Location: u.String(), Status: resp.StatusCode}
 	default:
 		return false, fmt.Errorf("unexpected status code: %s", resp.Status)
 	}
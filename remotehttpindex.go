@@ -52,3 +52,13 @@ func (r *RemoteHTTPIndex) StoreIndex(name string, idx Index) error {
 	}()
 	return r.StoreObject(name, rdr)
 }
+
+// StoreIndexSignature adds a detached index signature to the store
+func (r *RemoteHTTPIndex) StoreIndexSignature(name string, sig []byte) error {
+	return r.StoreObject(name, bytes.NewReader(sig))
+}
+
+// StoreIndexDigest adds a blob digest to the store
+func (r *RemoteHTTPIndex) StoreIndexDigest(name string, b []byte) error {
+	return r.StoreObject(name, bytes.NewReader(b))
+}
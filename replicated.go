@@ -0,0 +1,254 @@
+package desync
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+var _ WriteStore = &ReplicatedStore{}
+
+// ReplicatedStore writes every chunk to multiple stores at the same time. A write
+// is successful when at least a quorum of the replicas acknowledged it. Failed
+// writes to individual replicas are recorded in an optional journal so they can
+// be repaired later. Chunks are read from the first replica that has them.
+// Implements the WriteStore interface.
+type ReplicatedStore struct {
+	replicas []WriteStore
+	quorum   int
+	journal  io.Writer
+	mu       sync.Mutex
+}
+
+// NewReplicatedStore returns a store that replicates chunks to all provided
+// stores. quorum is the number of replicas that need to successfully store a
+// chunk. If it is 0, all replicas are required. Failed writes are recorded in
+// journal, one "<chunk-id> <store>" line per failed write. The journal can be
+// nil. If it implements io.Closer, it's closed together with the store.
+func NewReplicatedStore(quorum int, journal io.Writer, replicas ...WriteStore) (*ReplicatedStore, error) {
+	if quorum == 0 {
+		quorum = len(replicas)
+	}
+	if quorum < 0 || quorum > len(replicas) {
+		return nil, fmt.Errorf("invalid quorum %d for %d replicas", quorum, len(replicas))
+	}
+	return &ReplicatedStore{replicas: replicas, quorum: quorum, journal: journal}, nil
+}
+
+// GetChunk reads the chunk from the replicas in order and returns the first
+// one found. Moves on to the next replica on any error. Returns ChunkMissing if
+// none of the replicas have the chunk, or the last error otherwise.
+func (s *ReplicatedStore) GetChunk(id ChunkID) (*Chunk, error) {
+	var gErr error = ChunkMissing{id}
+	for _, r := range s.replicas {
+		chunk, err := r.GetChunk(id)
+		switch err.(type) {
+		case nil:
+			return chunk, nil
+		case ChunkMissing:
+		default:
+			gErr = errors.Wrap(err, r.String())
+		}
+	}
+	return nil, gErr
+}
+
+// HasChunk returns true only if all replicas have the chunk. Errors from
+// replicas are treated as the chunk not being present so writers will go on and
+// attempt to store the chunk, recording the failure if the replica is down.
+func (s *ReplicatedStore) HasChunk(id ChunkID) (bool, error) {
+	for _, r := range s.replicas {
+		if hasChunk, err := r.HasChunk(id); err != nil || !hasChunk {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// StoreChunk writes the chunk to all replicas concurrently. Fails if fewer
+// than quorum replicas stored the chunk successfully.
+func (s *ReplicatedStore) StoreChunk(chunk *Chunk) error {
+	// The ID and compressed data are calculated on first use and cached in the
+	// chunk. Do that before the replicas use the chunk concurrently.
+	id := chunk.ID()
+	if _, err := chunk.Compressed(); err != nil {
+		return err
+	}
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(s.replicas))
+	)
+	for i, r := range s.replicas {
+		wg.Add(1)
+		go func(i int, r WriteStore) {
+			errs[i] = r.StoreChunk(chunk)
+			wg.Done()
+		}(i, r)
+	}
+	wg.Wait()
+
+	var (
+		acks    int
+		lastErr error
+	)
+	for i, err := range errs {
+		if err == nil {
+			acks++
+			continue
+		}
+		lastErr = errors.Wrap(err, s.replicas[i].String())
+		if jErr := s.record(id, s.replicas[i]); jErr != nil {
+			return errors.Wrap(jErr, "failed to write replica journal")
+		}
+	}
+	if acks < s.quorum {
+		return errors.Wrapf(lastErr, "chunk %s stored in %d of %d replicas, quorum is %d", id, acks, len(s.replicas), s.quorum)
+	}
+	return nil
+}
+
+// Repair reads a journal of failed writes and copies the affected chunks from any
+// other replica into the replicas that failed to store them. n is the number of
+// concurrent goroutines. Entries for stores that are not part of this replicated
+// store are ignored. Chunks that can't be read from any replica or can't be
+// written are recorded in the journal of this store (if any) again.
+func (s *ReplicatedStore) Repair(ctx context.Context, journal io.Reader, n int, pb ProgressBar) error {
+	entries, err := readReplicaJournal(journal)
+	if err != nil {
+		return err
+	}
+	replicas := make(map[string]WriteStore)
+	for _, r := range s.replicas {
+		replicas[r.String()] = r
+	}
+
+	// Setup and start the progressbar if any
+	if pb != nil {
+		pb.SetTotal(len(entries))
+		pb.Start()
+		defer pb.Finish()
+	}
+
+	in := make(chan replicaJournalEntry)
+	g, ctx := errgroup.WithContext(ctx)
+
+	// Start the workers
+	for i := 0; i < n; i++ {
+		g.Go(func() error {
+			for e := range in {
+				if pb != nil {
+					pb.Increment()
+				}
+				r, ok := replicas[e.store]
+				if !ok {
+					continue
+				}
+				if hasChunk, err := r.HasChunk(e.id); err == nil && hasChunk {
+					continue
+				}
+				// Keep the entry in the journal if the chunk can't be read or written,
+				// and carry on with the others
+				chunk, err := s.GetChunk(e.id)
+				if err == nil {
+					err = r.StoreChunk(chunk)
+				}
+				if err != nil {
+					if jErr := s.record(e.id, r); jErr != nil {
+						return errors.Wrap(jErr, "failed to write replica journal")
+					}
+				}
+			}
+			return nil
+		})
+	}
+
+	// Feed the workers, the context is cancelled if any goroutine encounters an error
+loop:
+	for _, e := range entries {
+		select {
+		case <-ctx.Done():
+			break loop
+		case in <- e:
+		}
+	}
+	close(in)
+
+	return g.Wait()
+}
+
+func (s *ReplicatedStore) String() string {
+	var str []string
+	for _, r := range s.replicas {
+		str = append(str, r.String())
+	}
+	return strings.Join(str, "+")
+}
+
+// Close calls Close() on all replicas and the journal (if it is an io.Closer) and
+// returns the last error encountered.
+func (s *ReplicatedStore) Close() error {
+	var closeErr error
+	for _, r := range s.replicas {
+		if err := r.Close(); err != nil {
+			closeErr = err
+		}
+	}
+	if c, ok := s.journal.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			closeErr = err
+		}
+	}
+	return closeErr
+}
+
+// Record a failed write to a replica in the journal.
+func (s *ReplicatedStore) record(id ChunkID, r WriteStore) error {
+	if s.journal == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := fmt.Fprintf(s.journal, "%s %s\n", id, r)
+	return err
+}
+
+// A single failed write to a replica as recorded in the journal.
+type replicaJournalEntry struct {
+	id    ChunkID
+	store string
+}
+
+// Parse a replica journal. Duplicate entries are removed.
+func readReplicaJournal(r io.Reader) ([]replicaJournalEntry, error) {
+	var entries []replicaJournalEntry
+	seen := make(map[replicaJournalEntry]struct{})
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid replica journal entry %q", line)
+		}
+		id, err := ChunkIDFromString(fields[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid replica journal entry %q", line)
+		}
+		e := replicaJournalEntry{id: id, store: fields[1]}
+		if _, ok := seen[e]; ok {
+			continue
+		}
+		seen[e] = struct{}{}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
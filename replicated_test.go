@@ -0,0 +1,100 @@
+package desync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Store that fails all writes, used to simulate a replica being down.
+type failingWriteStore struct {
+	LocalStore
+}
+
+func (s failingWriteStore) StoreChunk(*Chunk) error { return errors.New("failed") }
+
+func TestReplicatedStore(t *testing.T) {
+	var stores []LocalStore
+	for i := 0; i < 3; i++ {
+		dir, err := ioutil.TempDir("", "replica")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		s, err := NewLocalStore(dir, StoreOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores = append(stores, s)
+	}
+	chunk := NewChunkFromUncompressed([]byte("some data"))
+
+	// Quorum of 2 with one of the replicas failing
+	journal := new(bytes.Buffer)
+	s, err := NewReplicatedStore(2, journal, stores[0], failingWriteStore{stores[1]}, stores[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StoreChunk(chunk); err != nil {
+		t.Fatal(err)
+	}
+
+	// The failed write should be in the journal
+	expected := chunk.ID().String() + " " + stores[1].String() + "\n"
+	if journal.String() != expected {
+		t.Fatalf("expected journal %q, got %q", expected, journal.String())
+	}
+
+	// The chunk can be read, but isn't considered present in all replicas
+	if _, err := s.GetChunk(chunk.ID()); err != nil {
+		t.Fatal(err)
+	}
+	hasChunk, err := s.HasChunk(chunk.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasChunk {
+		t.Fatal("chunk should not be present in all replicas")
+	}
+
+	// Requiring all replicas should fail
+	s, err = NewReplicatedStore(0, nil, stores[0], failingWriteStore{stores[1]}, stores[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StoreChunk(chunk); err == nil {
+		t.Fatal("expected quorum error")
+	}
+
+	// Repair the failed replica using the journal. A chunk that isn't in any
+	// replica stays in the journal without stopping the repair.
+	missing := NewChunkFromUncompressed([]byte("missing")).ID().String() + " " + stores[1].String() + "\n"
+	repaired := new(bytes.Buffer)
+	s, err = NewReplicatedStore(0, repaired, stores[0], stores[1], stores[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Repair(context.Background(), strings.NewReader(missing+expected), 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if repaired.String() != missing {
+		t.Fatalf("expected journal %q after repair, got %q", missing, repaired.String())
+	}
+	hasChunk, err = s.HasChunk(chunk.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasChunk {
+		t.Fatal("chunk should be present in all replicas after repair")
+	}
+}
+
+func TestReplicatedStoreInvalidQuorum(t *testing.T) {
+	if _, err := NewReplicatedStore(2, nil, LocalStore{}); err == nil {
+		t.Fatal("expected error for quorum larger than number of replicas")
+	}
+}
@@ -1,6 +1,7 @@
 package desync
 
 import (
+	"bytes"
 	"io"
 
 	"path"
@@ -62,3 +63,17 @@ func (s S3IndexStore) StoreIndex(name string, idx Index) error {
 	_, err := s.client.PutObject(s.bucket, s.prefix+name, r, -1, minio.PutObjectOptions{ContentType: contentType})
 	return errors.Wrap(err, path.Base(s.Location))
 }
+
+// StoreIndexSignature writes a detached index signature to the S3 store
+func (s S3IndexStore) StoreIndexSignature(name string, sig []byte) error {
+	contentType := "application/octet-stream"
+	_, err := s.client.PutObject(s.bucket, s.prefix+name, bytes.NewReader(sig), int64(len(sig)), minio.PutObjectOptions{ContentType: contentType})
+	return errors.Wrap(err, path.Base(s.Location))
+}
+
+// StoreIndexDigest writes a blob digest to the S3 store
+func (s S3IndexStore) StoreIndexDigest(name string, b []byte) error {
+	contentType := "text/plain"
+	_, err := s.client.PutObject(s.bucket, s.prefix+name, bytes.NewReader(b), int64(len(b)), minio.PutObjectOptions{ContentType: contentType})
+	return errors.Wrap(err, path.Base(s.Location))
+}
@@ -16,10 +16,12 @@ type Seed interface {
 
 // SeedSegment represents a matching range between a Seed and a a file being
 // assembled from an Index. It's used to copy or reflink data from seeds into
-// a target file during an extract operation.
+// a target file during an extract operation. WriteInto returns the number of
+// bytes that were copied and cloned. Offloaded is the part of the copied bytes
+// that were copied by the kernel with copy_file_range.
 type SeedSegment interface {
 	Size() uint64
-	WriteInto(dst *os.File, offset, end, blocksize uint64, isBlank bool) (copied uint64, cloned uint64, err error)
+	WriteInto(dst *os.File, offset, end, blocksize uint64, isBlank bool) (copied, cloned, offloaded uint64, err error)
 }
 
 // IndexSegment represents a contiguous section of an index which is used when
@@ -65,9 +65,27 @@ func (s *selfSeed) add(segment IndexSegment) {
 	}
 }
 
+// Returns the position of a chunk in the file if it's been written, or false
+// if it's not available yet.
+func (s *selfSeed) find(id ChunkID) (IndexChunk, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pos, ok := s.pos[id]
+	if !ok {
+		return IndexChunk{}, false
+	}
+	return s.index.Chunks[pos[0]], true
+}
+
 // LongestMatchWith returns the longest sequence of of chunks anywhere in Source
 // that match b starting at b[0]. If there is no match, it returns nil
 func (s *selfSeed) LongestMatchWith(chunks []IndexChunk) (int, SeedSegment) {
+	return s.longestMatch(chunks, s.canReflink)
+}
+
+// Returns the longest match like LongestMatchWith, with segments that clone the
+// data if canReflink is true. Used when the file is a seed for a different one.
+func (s *selfSeed) longestMatch(chunks []IndexChunk, canReflink bool) (int, SeedSegment) {
 	if len(chunks) == 0 || len(s.index.Chunks) == 0 {
 		return 0, nil
 	}
@@ -90,7 +108,7 @@ func (s *selfSeed) LongestMatchWith(chunks []IndexChunk) (int, SeedSegment) {
 			max = len(m)
 		}
 	}
-	return max, newFileSeedSegment(s.file, match, s.canReflink, false)
+	return max, newFileSeedSegment(s.file, match, canReflink, false)
 }
 
 // Returns a slice of chunks from the seed. Compares chunks from position 0
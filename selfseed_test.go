@@ -110,7 +110,7 @@ func TestSelfSeed(t *testing.T) {
 			defer dst.Close()
 
 			// Extract the file
-			stats, err := AssembleFile(context.Background(), dst.Name(), idx, s, nil, 1, nil)
+			stats, err := AssembleFile(context.Background(), dst.Name(), idx, s, nil, 1, AssembleOptions{}, nil)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -8,6 +8,7 @@ type SeedSequencer struct {
 	seeds   []Seed
 	index   Index
 	current int
+	end     int
 }
 
 // NewSeedSequencer initializes a new sequencer from a number of seeds.
@@ -15,6 +16,19 @@ func NewSeedSequencer(idx Index, src ...Seed) *SeedSequencer {
 	return &SeedSequencer{
 		seeds: src,
 		index: idx,
+		end:   len(idx.Chunks),
+	}
+}
+
+// newSeedSequencerRange returns a sequencer that only covers the chunks from
+// first to last (inclusive) of the index. Segments returned by it still refer to
+// positions in the whole index.
+func newSeedSequencerRange(idx Index, first, last int, src ...Seed) *SeedSequencer {
+	return &SeedSequencer{
+		seeds:   src,
+		index:   idx,
+		current: first,
+		end:     last + 1,
 	}
 }
 
@@ -28,7 +42,7 @@ func (r *SeedSequencer) Next() (segment IndexSegment, source SeedSegment, done b
 		advance = 1
 	)
 	for _, s := range r.seeds {
-		n, m := s.LongestMatchWith(r.index.Chunks[r.current:])
+		n, m := s.LongestMatchWith(r.index.Chunks[r.current:r.end])
 		if n > 0 && m.Size() > max {
 			source = m
 			advance = n
@@ -38,5 +52,5 @@ func (r *SeedSequencer) Next() (segment IndexSegment, source SeedSegment, done b
 
 	segment = IndexSegment{index: r.index, first: r.current, last: r.current + advance - 1}
 	r.current += advance
-	return segment, source, r.current >= len(r.index.Chunks)
+	return segment, source, r.current >= r.end
 }
@@ -1,6 +1,7 @@
 package desync
 
 import (
+	"bytes"
 	"net/url"
 	"os"
 	"path"
@@ -58,6 +59,16 @@ func (s *SFTPIndexStore) StoreIndex(name string, idx Index) error {
 	return s.StoreObject(s.pathFromName(name), r)
 }
 
+// StoreIndexSignature adds a detached index signature to the store
+func (s *SFTPIndexStore) StoreIndexSignature(name string, sig []byte) error {
+	return s.StoreObject(s.pathFromName(name), bytes.NewReader(sig))
+}
+
+// StoreIndexDigest adds a blob digest to the store
+func (s *SFTPIndexStore) StoreIndexDigest(name string, b []byte) error {
+	return s.StoreObject(s.pathFromName(name), bytes.NewReader(b))
+}
+
 func (s *SFTPIndexStore) pathFromName(name string) string {
 	return path.Join(s.path, name)
 }
@@ -0,0 +1,145 @@
+package desync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Number of points each shard occupies on the hash ring. More points give a more even
+// distribution of chunks across the shards at the cost of a larger ring.
+const shardVirtualNodes = 128
+
+var _ PruneStore = &ShardedStore{}
+
+// ShardedStore distributes chunks over multiple stores using consistent hashing on the
+// chunk ID. Every chunk has exactly one owning shard and all requests for it are routed
+// there. Adding or removing a shard only changes the owner of a small portion of the
+// chunks, those can be moved with Rebalance. Implements the PruneStore interface.
+type ShardedStore struct {
+	shards []WriteStore
+	ring   []shardPoint
+}
+
+// A point on the hash ring, pointing to the shard that owns the range up to it.
+type shardPoint struct {
+	hash  uint64
+	shard int
+}
+
+// NewShardedStore returns a store that distributes chunks over the provided stores. The
+// position of a shard on the hash ring is derived from its String() value, so the same
+// set of stores results in the same distribution independent of their order.
+func NewShardedStore(shards ...WriteStore) *ShardedStore {
+	s := &ShardedStore{shards: shards}
+	for i, shard := range shards {
+		for v := 0; v < shardVirtualNodes; v++ {
+			sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d", shard, v)))
+			s.ring = append(s.ring, shardPoint{hash: binary.BigEndian.Uint64(sum[:8]), shard: i})
+		}
+	}
+	sort.Slice(s.ring, func(i, j int) bool { return s.ring[i].hash < s.ring[j].hash })
+	return s
+}
+
+// Shard returns the store that owns the chunk.
+func (s *ShardedStore) Shard(id ChunkID) WriteStore {
+	return s.shards[s.owner(id)]
+}
+
+// Returns the index of the shard that owns the chunk.
+func (s *ShardedStore) owner(id ChunkID) int {
+	// The chunk ID is already a hash, use the first 8 bytes as position on the ring
+	h := binary.BigEndian.Uint64(id[:8])
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= h })
+	if i == len(s.ring) { // wrap around
+		i = 0
+	}
+	return s.ring[i].shard
+}
+
+// GetChunk reads the chunk from the shard that owns it.
+func (s *ShardedStore) GetChunk(id ChunkID) (*Chunk, error) {
+	return s.Shard(id).GetChunk(id)
+}
+
+// HasChunk returns true if the owning shard has the chunk.
+func (s *ShardedStore) HasChunk(id ChunkID) (bool, error) {
+	return s.Shard(id).HasChunk(id)
+}
+
+// StoreChunk writes the chunk into the shard that owns it.
+func (s *ShardedStore) StoreChunk(chunk *Chunk) error {
+	return s.Shard(chunk.ID()).StoreChunk(chunk)
+}
+
+// Prune removes all chunks from the shards that are not in the list. Each shard is
+// pruned with only the chunks it owns, so any chunk that was left behind on a shard that
+// no longer owns it is removed too. Run a Rebalance before pruning after shards have been
+// added or removed. All shards need to support pruning.
+func (s *ShardedStore) Prune(ctx context.Context, ids map[ChunkID]struct{}) error {
+	// Make sure all shards can be pruned before we start deleting anything
+	stores := make([]PruneStore, 0, len(s.shards))
+	for _, shard := range s.shards {
+		ps, ok := shard.(PruneStore)
+		if !ok {
+			return fmt.Errorf("store '%s' does not support pruning", shard)
+		}
+		stores = append(stores, ps)
+	}
+
+	// Split the list of chunks by owner
+	owned := make([]map[ChunkID]struct{}, len(s.shards))
+	for i := range owned {
+		owned[i] = make(map[ChunkID]struct{})
+	}
+	for id := range ids {
+		owned[s.owner(id)][id] = struct{}{}
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	for i := range stores {
+		ps, keep := stores[i], owned[i]
+		g.Go(func() error { return ps.Prune(ctx, keep) })
+	}
+	return g.Wait()
+}
+
+// Rebalance moves chunks to their owning shard after shards were added or removed. Chunks
+// not present on the owning shard are read from any of the shards or from the optional
+// src store (typically stores that were removed from the set) and written to the owner.
+// Chunks are not deleted from their old location, use Prune for that.
+func (s *ShardedStore) Rebalance(ctx context.Context, ids []ChunkID, src Store, n int, pb ProgressBar) error {
+	var stores []Store
+	for _, shard := range s.shards {
+		stores = append(stores, shard)
+	}
+	if src != nil {
+		stores = append(stores, src)
+	}
+	return Copy(ctx, ids, NewStoreRouter(stores...), s, n, pb)
+}
+
+func (s *ShardedStore) String() string {
+	var str []string
+	for _, shard := range s.shards {
+		str = append(str, shard.String())
+	}
+	return strings.Join(str, ";")
+}
+
+// Close calls Close() on all shards and returns the last error encountered.
+func (s *ShardedStore) Close() error {
+	var closeErr error
+	for _, shard := range s.shards {
+		if err := shard.Close(); err != nil {
+			closeErr = err
+		}
+	}
+	return closeErr
+}
@@ -0,0 +1,100 @@
+package desync
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestShardedStore(t *testing.T) {
+	// Setup 3 temporary stores as shards
+	var shards []WriteStore
+	for i := 0; i < 3; i++ {
+		dir, err := ioutil.TempDir("", "shard")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		s, err := NewLocalStore(dir, StoreOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		shards = append(shards, s)
+	}
+	s := NewShardedStore(shards...)
+
+	// Store a bunch of chunks and make sure each one ends up in exactly one shard
+	var ids []ChunkID
+	for i := 0; i < 300; i++ {
+		chunk := NewChunkFromUncompressed([]byte(fmt.Sprintf("chunk %d", i)))
+		if err := s.StoreChunk(chunk); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, chunk.ID())
+	}
+	count := make([]int, len(shards))
+	for _, id := range ids {
+		var found int
+		for i, shard := range shards {
+			hasChunk, err := shard.HasChunk(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hasChunk {
+				found++
+				count[i]++
+			}
+		}
+		if found != 1 {
+			t.Fatalf("expected chunk %s in 1 shard, found in %d", id, found)
+		}
+		if _, err := s.GetChunk(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// All shards should have gotten some of the chunks
+	for i, n := range count {
+		if n == 0 {
+			t.Fatalf("shard %d didn't get any chunks", i)
+		}
+	}
+
+	// Remove the last shard and rebalance from it, the chunks should now all be
+	// in the remaining two
+	s2 := NewShardedStore(shards[:2]...)
+	if err := s2.Rebalance(context.Background(), ids, shards[2], 4, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		hasChunk, err := s2.HasChunk(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !hasChunk {
+			t.Fatalf("chunk %s missing after rebalance", id)
+		}
+	}
+
+	// Prune the reduced store, which should drop all chunks not owned by a shard
+	keep := make(map[ChunkID]struct{})
+	for _, id := range ids {
+		keep[id] = struct{}{}
+	}
+	if err := s2.Prune(context.Background(), keep); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		for _, shard := range shards[:2] {
+			hasChunk, err := shard.HasChunk(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hasChunk && s2.Shard(id) != shard {
+				t.Fatalf("chunk %s not pruned from non-owning shard", id)
+			}
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package desync
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ed25519"
+)
+
+// IndexSignatureExt is appended to the name of an index to store its detached
+// signature in the same index store.
+const IndexSignatureExt = ".sig"
+
+// IndexSignatureWriteStore is implemented by index stores that can store detached
+// index signatures next to the indexes.
+type IndexSignatureWriteStore interface {
+	StoreIndexSignature(name string, sig []byte) error
+}
+
+// SignIndex returns a detached Ed25519 signature of an index. The signature is
+// calculated over the serialized form of the index.
+func SignIndex(idx Index, key ed25519.PrivateKey) ([]byte, error) {
+	b := new(bytes.Buffer)
+	if _, err := idx.WriteTo(b); err != nil {
+		return nil, err
+	}
+	return ed25519.Sign(key, b.Bytes()), nil
+}
+
+// VerifyIndexSignature checks if the signature of an index was made by any of the provided
+// keys. Returns IndexSignatureInvalid if it wasn't.
+func VerifyIndexSignature(idx Index, sig []byte, keys ...ed25519.PublicKey) error {
+	b := new(bytes.Buffer)
+	if _, err := idx.WriteTo(b); err != nil {
+		return err
+	}
+	return verifySignature(b.Bytes(), sig, keys)
+}
+
+func verifySignature(b, sig []byte, keys []ed25519.PublicKey) error {
+	for _, key := range keys {
+		if ed25519.Verify(key, b, sig) {
+			return nil
+		}
+	}
+	return IndexSignatureInvalid{}
+}
+
+var _ IndexWriteStore = SignedIndexStore{}
+
+// SignedIndexStore wraps an index store and verifies the signature of every index
+// read from it against a set of public keys. Indexes without valid signature are
+// rejected. If a private key is set, indexes written to the store are signed and
+// the signature is stored next to the index. The underlying store needs to
+// implement IndexSignatureWriteStore for that. Blob digests stored next to the
+// indexes are signed and verified the same way, with their own signature.
+type SignedIndexStore struct {
+	s    IndexStore
+	key  ed25519.PrivateKey
+	keys []ed25519.PublicKey
+}
+
+// NewSignedIndexStore returns an index store that verifies indexes against the
+// provided public keys and signs indexes with key when they are written. The key
+// can be nil if the store isn't written to. If no public keys are provided, the
+// store doesn't verify any indexes.
+func NewSignedIndexStore(s IndexStore, key ed25519.PrivateKey, keys ...ed25519.PublicKey) SignedIndexStore {
+	return SignedIndexStore{s: s, key: key, keys: keys}
+}
+
+// GetIndexReader returns a reader for a verified index or blob digest (names
+// ending in IndexDigestExt). Signatures (names ending in IndexSignatureExt) are
+// passed through from the underlying store unverified.
+func (s SignedIndexStore) GetIndexReader(name string) (io.ReadCloser, error) {
+	if strings.HasSuffix(name, IndexSignatureExt) {
+		return s.s.GetIndexReader(name)
+	}
+	if strings.HasSuffix(name, IndexDigestExt) {
+		return s.getDigestReader(name)
+	}
+	idx, err := s.GetIndex(name)
+	if err != nil {
+		return nil, err
+	}
+	b := new(bytes.Buffer)
+	if _, err := idx.WriteTo(b); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(b), nil
+}
+
+// GetIndex reads an index and its signature from the underlying store and returns
+// the index if the signature matches any of the public keys.
+func (s SignedIndexStore) GetIndex(name string) (Index, error) {
+	idx, err := s.s.GetIndex(name)
+	if err != nil || len(s.keys) == 0 {
+		return idx, err
+	}
+	sig, err := s.readSignature(name)
+	if err != nil {
+		return Index{}, err
+	}
+	if err := VerifyIndexSignature(idx, sig, s.keys...); err != nil {
+		return Index{}, errors.Wrap(err, name)
+	}
+	return idx, nil
+}
+
+// Reads a blob digest and returns it if its signature matches any of the
+// public keys.
+func (s SignedIndexStore) getDigestReader(name string) (io.ReadCloser, error) {
+	r, err := s.s.GetIndexReader(name)
+	if err != nil || len(s.keys) == 0 {
+		return r, err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(r, 1024))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading blob digest")
+	}
+	sig, err := s.readSignature(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(b, sig, s.keys); err != nil {
+		return nil, errors.Wrap(err, name)
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+// Reads the signature stored next to an index or blob digest.
+func (s SignedIndexStore) readSignature(name string) ([]byte, error) {
+	r, err := s.s.GetIndexReader(name + IndexSignatureExt)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading index signature")
+	}
+	defer r.Close()
+	sig, err := ioutil.ReadAll(io.LimitReader(r, ed25519.SignatureSize+1))
+	return sig, errors.Wrap(err, "reading index signature")
+}
+
+// StoreIndex writes the index to the underlying store. If a private key was
+// provided, the index is signed and the signature is written as well.
+func (s SignedIndexStore) StoreIndex(name string, idx Index) error {
+	ws, ok := s.s.(IndexWriteStore)
+	if !ok {
+		return errors.Errorf("index store '%s' does not support writing", s.s)
+	}
+	if err := ws.StoreIndex(name, idx); err != nil {
+		return err
+	}
+	if s.key == nil {
+		return nil
+	}
+	sig, err := SignIndex(idx, s.key)
+	if err != nil {
+		return err
+	}
+	return s.StoreIndexSignature(name+IndexSignatureExt, sig)
+}
+
+// StoreIndexSignature writes a signature to the underlying store.
+func (s SignedIndexStore) StoreIndexSignature(name string, sig []byte) error {
+	ss, ok := s.s.(IndexSignatureWriteStore)
+	if !ok {
+		return errors.Errorf("index store '%s' does not support signatures", s.s)
+	}
+	return ss.StoreIndexSignature(name, sig)
+}
+
+// StoreIndexDigest writes a blob digest to the underlying store. If a private
+// key was provided, the digest is signed and the signature is written as well.
+func (s SignedIndexStore) StoreIndexDigest(name string, b []byte) error {
+	ds, ok := s.s.(IndexDigestWriteStore)
+	if !ok {
+		return errors.Errorf("index store '%s' does not support blob digests", s.s)
+	}
+	if err := ds.StoreIndexDigest(name, b); err != nil {
+		return err
+	}
+	if s.key == nil {
+		return nil
+	}
+	return s.StoreIndexSignature(name+IndexSignatureExt, ed25519.Sign(s.key, b))
+}
+
+func (s SignedIndexStore) String() string {
+	return s.s.String()
+}
+
+// Close the underlying index store.
+func (s SignedIndexStore) Close() error { return s.s.Close() }
@@ -0,0 +1,86 @@
+package desync
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestSignedIndexStore(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ls, err := NewLocalIndexStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read an index and write it into a signing store
+	f, err := os.Open("testdata/index.caibx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	idx, err := IndexFromReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewSignedIndexStore(ls, priv).StoreIndex("index.caibx", idx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read it with the matching key
+	if _, err := NewSignedIndexStore(ls, nil, otherPub, pub).GetIndex("index.caibx"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Should fail with a key that doesn't match
+	_, err = NewSignedIndexStore(ls, nil, otherPub).GetIndex("index.caibx")
+	if !isSignatureInvalid(err) {
+		t.Fatalf("expected IndexSignatureInvalid, got %v", err)
+	}
+
+	// Write the index without signature, reading should fail
+	if err := ls.StoreIndex("unsigned.caibx", idx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewSignedIndexStore(ls, nil, pub).GetIndex("unsigned.caibx"); err == nil {
+		t.Fatal("expected error reading unsigned index")
+	}
+
+	// Blob digests are signed as well
+	digest := make([]byte, 32)
+	if err := StoreBlobDigest(NewSignedIndexStore(ls, priv), "index.caibx", digest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetBlobDigest(NewSignedIndexStore(ls, nil, pub), "index.caibx"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetBlobDigest(NewSignedIndexStore(ls, nil, otherPub), "index.caibx")
+	if !isSignatureInvalid(err) {
+		t.Fatalf("expected IndexSignatureInvalid, got %v", err)
+	}
+
+	// A digest that was replaced after signing should be rejected
+	if err := StoreBlobDigest(ls, "index.caibx", append([]byte{1}, digest[1:]...)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetBlobDigest(NewSignedIndexStore(ls, nil, pub), "index.caibx")
+	if !isSignatureInvalid(err) {
+		t.Fatalf("expected IndexSignatureInvalid, got %v", err)
+	}
+}
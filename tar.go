@@ -9,8 +9,12 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/pkg/xattr"
 )
@@ -19,38 +23,184 @@ import (
 // should be used in index files when chunking a catar as well. TODO: Find out what
 // CaFormatWithPermissions is as that's not set incasync-produced catar archives.
 const TarFeatureFlags uint64 = CaFormatWith32BitUIDs |
+	CaFormatWithUserNames |
 	CaFormatWithNSecTime |
 	CaFormatWithPermissions |
 	CaFormatWithSymlinks |
 	CaFormatWithDeviceNodes |
 	CaFormatWithFIFOs |
 	CaFormatWithSockets |
+	CaFormatWithChattr |
 	CaFormatWithXattrs |
+	CaFormatWithACL |
+	CaFormatWithSELinux |
+	CaFormatWithFcaps |
 	CaFormatSHA512256 |
 	CaFormatExcludeNoDump |
 	CaFormatExcludeFile
 
+// CaFormatWithChattr combines the feature flags of all chattr(1) flags, like
+// immutable or nocow. They're stored in the Flags field of entries for files
+// and directories.
+const CaFormatWithChattr uint64 = CaFormatWithFlagAppend |
+	CaFormatWithFlagNoAtime |
+	CaFormatWithFlagCompr |
+	CaFormatWithFlagNoCow |
+	CaFormatWithFlagNoDump |
+	CaFormatWithFlagDirSync |
+	CaFormatWithFlagImmutable |
+	CaFormatWithFlagSync |
+	CaFormatWithFlagNoComp |
+	CaFormatWithFlagProjectInherit
+
+// TarOptions are used to influence the behaviour of Tar
+type TarOptions struct {
+	// Don't cross filesystem boundaries
+	OneFileSystem bool
+
+	// Patterns of files and directories to leave out of the archive, in the
+	// same format as lines in .caexclude files and relative to the source.
+	// They can't be overridden by patterns in .caexclude files.
+	Exclude []string
+
+	// Ignore .caexclude files
+	NoExcludeFile bool
+
+	// Include files and directories with the nodump flag (chattr +d), they're
+	// left out by default
+	IncludeNoDump bool
+
+	// Don't store chattr(1) flags
+	NoChattr bool
+
+	// The options below make archives reproducible, so that trees with the
+	// same content produce the same archive regardless of when and by whom
+	// they were created.
+
+	// Modification times later than this are stored as this time, for example
+	// the time given in SOURCE_DATE_EPOCH. Not used if zero.
+	ClampMTime time.Time
+
+	// Granularity of modification times, time.Nanosecond if 0. Can also be
+	// time.Microsecond, time.Second or 2*time.Second. Times are truncated and
+	// the matching CaFormatWith*Time feature flag is set in the archive.
+	TimeGranularity time.Duration
+
+	// Store all files and directories as owned by UID and GID, without user
+	// and group names
+	NormalizeOwner bool
+	UID, GID       int
+
+	// Store directories and executable files with permissions 0755, other
+	// files with 0644, without ACLs
+	NormalizePermissions bool
+
+	// Extended attributes matching any of these patterns aren't stored,
+	// including SELinux labels (security.selinux) and file capabilities
+	// (security.capability). Patterns are matched with path.Match.
+	ExcludeXattrs []string
+}
+
+// FeatureFlags returns the feature flags of archives created with these
+// options. They should be used in the index when chunking the archive.
+func (o TarOptions) FeatureFlags() uint64 {
+	flags := TarFeatureFlags
+	if o.NoExcludeFile {
+		flags &^= CaFormatExcludeFile
+	}
+	if o.IncludeNoDump {
+		flags &^= CaFormatExcludeNoDump
+	}
+	if o.NoChattr {
+		flags &^= CaFormatWithChattr
+	}
+	if t, ok := tarTimeFlags[o.TimeGranularity]; ok {
+		flags = flags&^CaFormatWithNSecTime | t
+	}
+	return flags
+}
+
+// Feature flags for the supported granularities of modification times
+var tarTimeFlags = map[time.Duration]uint64{
+	time.Nanosecond:  CaFormatWithNSecTime,
+	time.Microsecond: CaFormatWithUSecTime,
+	time.Second:      CaFormatWithSecTime,
+	2 * time.Second:  CaFormatWith2SecTime,
+}
+
+// Returns the modification time as it's stored in the archive.
+func (o TarOptions) mtime(t time.Time) time.Time {
+	if !o.ClampMTime.IsZero() && t.After(o.ClampMTime) {
+		t = o.ClampMTime
+	}
+	if o.TimeGranularity > time.Nanosecond {
+		ns := t.UnixNano()
+		t = time.Unix(0, ns-ns%int64(o.TimeGranularity))
+	}
+	return t
+}
+
+// Returns the mode with normalized permissions, 0777 for symlinks, 0755 for
+// directories and files executable by anyone, and 0644 for the rest.
+func normalizePermissions(mode uint32) uint32 {
+	perm := uint32(0644)
+	switch {
+	case mode&ModeTypeMask == syscall.S_IFLNK:
+		perm = 0777
+	case mode&ModeTypeMask == syscall.S_IFDIR, mode&0111 != 0:
+		perm = 0755
+	}
+	return mode&ModeTypeMask | perm
+}
+
+// State of Tar that's the same in all levels of the recursion
+type tarState struct {
+	opts    TarOptions
+	flags   uint64
+	dev     uint64          // Device of the source with OneFileSystem, 0 otherwise
+	exclude excludePatterns // Patterns from the options
+}
+
 // Tar implements the tar command which recursively parses a directory tree,
 // and produces a stream of encoded casync format elements (catar file).
-func Tar(ctx context.Context, w io.Writer, src string, oneFileSystem bool) error {
+func Tar(ctx context.Context, w io.Writer, src string, opts TarOptions) error {
 	enc := NewFormatEncoder(w)
 	info, err := os.Lstat(src)
 	if err != nil {
 		return err
 	}
-	dev := uint64(0)
-	if oneFileSystem {
-		st, ok := info.Sys().(*syscall.Stat_t)
+	st := &tarState{opts: opts, flags: opts.FeatureFlags()}
+	if opts.OneFileSystem {
+		sys, ok := info.Sys().(*syscall.Stat_t)
 		if ok {
 			// Dev (and Rdev) elements of syscall.Stat_t are uint64 on Linux, but int32 on MacOS. Cast it to uint64 everywhere.
-			dev = uint64(st.Dev)
+			st.dev = uint64(sys.Dev)
+		}
+	}
+	if st.exclude, err = parseExcludePatterns(opts.Exclude, ""); err != nil {
+		return err
+	}
+	if _, ok := tarTimeFlags[opts.TimeGranularity]; !ok && opts.TimeGranularity != 0 {
+		return fmt.Errorf("unsupported time granularity %s", opts.TimeGranularity)
+	}
+	for _, pattern := range opts.ExcludeXattrs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid xattr pattern %q: %s", pattern, err)
 		}
 	}
-	_, err = tar(ctx, enc, src, info, dev)
+	attrFlags, err := st.attrFlags(src, info)
+	if err != nil {
+		return err
+	}
+	_, err = tar(ctx, enc, st, src, "", info, attrFlags, nil)
 	return err
 }
 
-func tar(ctx context.Context, enc FormatEncoder, path string, info os.FileInfo, dev uint64) (n int64, err error) {
+// Encodes a file or directory tree. name is the path of it relative to the
+// source, attrFlags are its inode flags as returned by tarState.attrFlags, and
+// patterns are the exclude patterns read from .caexclude files in the parent
+// directories.
+func tar(ctx context.Context, enc FormatEncoder, st *tarState, path, name string, info os.FileInfo, attrFlags uint32, patterns excludePatterns) (n int64, err error) {
 	// See if we're meant to stop
 	select {
 	case <-ctx.Done():
@@ -80,63 +230,84 @@ func tar(ctx context.Context, enc FormatEncoder, path string, info os.FileInfo,
 	m := info.Mode()
 
 	// Skip (and warn about) things we can't encode properly
-	if !(m.IsDir() || m.IsRegular() || isSymlink(m) || isDevice(m)) {
+	if !(m.IsDir() || m.IsRegular() || isSymlink(m) || isDevice(m) || isFIFO(m) || isSocket(m)) {
 		fmt.Fprintf(os.Stderr, "skipping '%s' : unsupported node type\n", path)
 		return 0, nil
 	}
 
-	// CaFormatEntry
-	entry := FormatEntry{
-		FormatHeader: FormatHeader{Size: 64, Type: CaFormatEntry},
-		FeatureFlags: TarFeatureFlags,
-		UID:          uid,
-		GID:          gid,
-		Mode:         os.FileMode(mode),
-		MTime:        info.ModTime(),
+	md := tarMetadata{
+		uid:   uid,
+		gid:   gid,
+		mode:  mode,
+		mtime: info.ModTime(),
 	}
-	nn, err := enc.Encode(entry)
-	n += nn
-	if err != nil {
-		return n, err
+	if !st.opts.NormalizeOwner {
+		md.user, md.group = userName(uid), groupName(gid)
+	}
+
+	// chattr(1) flags, only files and directories have them
+	if st.flags&CaFormatWithChattr != 0 {
+		md.flags = chattrFeatureFlags(attrFlags)
 	}
 
-	// CaFormatXattrs - Write extended attributes elements
-	keys, err := xattr.LList(filepath.Join(path))
+	// Extended attributes, other than ACLs which are read separately
+	keys, err := xattr.LList(path)
 	if err != nil {
 		return n, err
 	}
 	for _, key := range keys {
-		value, err := xattr.LGet(filepath.Join(path), key)
+		if isACLXattr(key) || st.excludeXattr(key) {
+			continue
+		}
+		value, err := xattr.LGet(path, key)
 		if err != nil {
 			return n, err
 		}
-		x := FormatXAttr{
-			FormatHeader: FormatHeader{Size: uint64(len(key)) + 1 + uint64(len(value)) + 1 + 16, Type: CaFormatXAttr},
-			NameAndValue: key + "\000" + string(value),
+		if md.xattrs == nil {
+			md.xattrs = make(map[string][]byte)
 		}
+		md.xattrs[key] = value
+	}
 
-		nn, err = enc.Encode(x)
-		n += nn
-		if err != nil {
+	if (m.IsDir() || m.IsRegular()) && !st.opts.NormalizePermissions {
+		if md.acl, err = readACL(path); err != nil {
 			return n, err
 		}
 	}
 
+	nn, err := st.encodeMetadata(enc, md)
+	n += nn
+	if err != nil {
+		return n, err
+	}
+
 	switch {
 	case m.IsDir():
 		stats, err := ioutil.ReadDir(path)
 		if err != nil {
 			return n, err
 		}
+		if !st.opts.NoExcludeFile {
+			if patterns, err = patterns.withExcludeFile(path, name); err != nil {
+				return n, err
+			}
+		}
 		var items []FormatGoodbyeItem
 		for _, s := range stats {
-			if dev != 0 {
+			if st.dev != 0 {
 				// one-file-system is set, skip other filesystems
-				st, ok := s.Sys().(*syscall.Stat_t)
-				if !ok || uint64(st.Dev) != dev {
+				sys, ok := s.Sys().(*syscall.Stat_t)
+				if !ok || uint64(sys.Dev) != st.dev {
 					continue
 				}
 			}
+			exclude, attrFlags, err := st.excluded(filepath.Join(path, s.Name()), filepath.Join(name, s.Name()), s, patterns)
+			if err != nil {
+				return n, err
+			}
+			if exclude {
+				continue
+			}
 
 			start := n
 			// CaFormatFilename - Write the filename element, then recursively encode
@@ -150,7 +321,7 @@ func tar(ctx context.Context, enc FormatEncoder, path string, info os.FileInfo,
 			if err != nil {
 				return n, err
 			}
-			nn, err = tar(ctx, enc, filepath.Join(path, s.Name()), s, dev)
+			nn, err = tar(ctx, enc, st, filepath.Join(path, s.Name()), filepath.Join(name, s.Name()), s, attrFlags, patterns)
 			n += nn
 			if err != nil {
 				return n, err
@@ -163,28 +334,7 @@ func tar(ctx context.Context, enc FormatEncoder, path string, info os.FileInfo,
 			})
 		}
 
-		// Fix the offsets in the item list, it needs to be the offset (backwards)
-		// from the start of FormatGoodbye
-		for i := range items {
-			items[i].Offset = uint64(n) - items[i].Offset
-		}
-
-		// Turn the list of Goodbye items into a complete BST
-		items = makeGoodbyeBST(items)
-
-		// Append the tail marker
-		items = append(items, FormatGoodbyeItem{
-			Offset: uint64(n),
-			Size:   uint64(16 + len(items)*24 + 24),
-			Hash:   CaFormatGoodbyeTailMarker,
-		})
-
-		// Build the complete goodbye element and encode it
-		goodbye := FormatGoodbye{
-			FormatHeader: FormatHeader{Size: uint64(16 + len(items)*24), Type: CaFormatGoodbye},
-			Items:        items,
-		}
-		nn, err = enc.Encode(goodbye)
+		nn, err = encodeGoodbye(enc, items, n)
 		n += nn
 		if err != nil {
 			return n, err
@@ -233,8 +383,200 @@ func tar(ctx context.Context, enc FormatEncoder, path string, info os.FileInfo,
 			return n, err
 		}
 
+	case isFIFO(m), isSocket(m):
+		// Nothing else to encode, the type is in the mode of the entry
+
 	default:
 		return n, fmt.Errorf("unable to determine node type of '%s'", path)
 	}
 	return
 }
+
+// Returns true if a file or directory should be left out of the archive,
+// because it matches an exclude pattern or has the nodump flag. Also returns
+// its inode flags, so they don't need to be read again when it's encoded.
+func (st *tarState) excluded(path, name string, info os.FileInfo, patterns excludePatterns) (bool, uint32, error) {
+	if st.exclude.excluded(name, info.IsDir()) || patterns.excluded(name, info.IsDir()) {
+		return true, 0, nil
+	}
+	flags, err := st.attrFlags(path, info)
+	if err != nil {
+		return false, 0, err
+	}
+	return !st.opts.IncludeNoDump && flags&fsNoDumpFl != 0, flags, nil
+}
+
+// Returns the inode flags of a file or directory, if they're needed for the
+// nodump check or to be stored in the archive.
+func (st *tarState) attrFlags(path string, info os.FileInfo) (uint32, error) {
+	if st.opts.IncludeNoDump && st.flags&CaFormatWithChattr == 0 {
+		return 0, nil
+	}
+	return getAttrFlags(path, info)
+}
+
+// Returns true if an extended attribute should be left out of the archive.
+func (st *tarState) excludeXattr(key string) bool {
+	for _, pattern := range st.opts.ExcludeXattrs {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Metadata of a node in an archive, encoded before its content
+type tarMetadata struct {
+	uid, gid    int
+	user, group string // Names of the owner, left out if empty
+	mode        uint32 // Mode like it's returned by stat(2)
+	mtime       time.Time
+	flags       uint64            // chattr(1) flags as CaFormatWithFlag* feature flags
+	xattrs      map[string][]byte // Including the SELinux label and capabilities
+	acl         *ACL
+}
+
+// Encodes the entry of a node and the elements following it, up to the
+// content of the node. Applies the options for reproducible archives.
+func (st *tarState) encodeMetadata(enc FormatEncoder, md tarMetadata) (n int64, err error) {
+	if st.opts.NormalizeOwner {
+		md.uid, md.gid = st.opts.UID, st.opts.GID
+		md.user, md.group = "", ""
+	}
+	if st.opts.NormalizePermissions {
+		md.mode = normalizePermissions(md.mode)
+		md.acl = nil
+	}
+	isDir := md.mode&ModeTypeMask == syscall.S_IFDIR
+	isRegular := md.mode&ModeTypeMask == syscall.S_IFREG
+	if !isDir && !isRegular {
+		md.flags = 0
+		md.acl = nil
+	}
+
+	// CaFormatEntry
+	entry := FormatEntry{
+		FormatHeader: FormatHeader{Size: 64, Type: CaFormatEntry},
+		FeatureFlags: st.flags,
+		Flags:        md.flags & st.flags,
+		UID:          md.uid,
+		GID:          md.gid,
+		Mode:         os.FileMode(md.mode),
+		MTime:        st.opts.mtime(md.mtime),
+	}
+	nn, err := enc.Encode(entry)
+	n += nn
+	if err != nil {
+		return n, err
+	}
+
+	// CaFormatUser/CaFormatGroup - Names of the owner, if known. Like casync,
+	// they're left out for root.
+	if md.uid != 0 && md.user != "" {
+		nn, err = enc.Encode(FormatUser{
+			FormatHeader: FormatHeader{Size: 16 + uint64(len(md.user)) + 1, Type: CaFormatUser},
+			Name:         md.user,
+		})
+		n += nn
+		if err != nil {
+			return n, err
+		}
+	}
+	if md.gid != 0 && md.group != "" {
+		nn, err = enc.Encode(FormatGroup{
+			FormatHeader: FormatHeader{Size: 16 + uint64(len(md.group)) + 1, Type: CaFormatGroup},
+			Name:         md.group,
+		})
+		n += nn
+		if err != nil {
+			return n, err
+		}
+	}
+
+	// CaFormatXattrs - Write extended attributes elements, sorted by name
+	keys := make([]string, 0, len(md.xattrs))
+	for key := range md.xattrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		// ACLs, SELinux labels and file capabilities are encoded separately
+		if isACLXattr(key) || key == xattrSELinux || key == xattrFCaps || st.excludeXattr(key) {
+			continue
+		}
+		value := md.xattrs[key]
+		x := FormatXAttr{
+			FormatHeader: FormatHeader{Size: uint64(len(key)) + 1 + uint64(len(value)) + 1 + 16, Type: CaFormatXAttr},
+			NameAndValue: key + "\000" + string(value),
+		}
+		nn, err = enc.Encode(x)
+		n += nn
+		if err != nil {
+			return n, err
+		}
+	}
+
+	// CaFormatACL* - Write ACL elements for directories and files
+	if md.acl != nil {
+		for _, e := range md.acl.elements() {
+			nn, err = enc.Encode(e)
+			n += nn
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+
+	// CaFormatFCaps - Capabilities of regular files
+	if fcaps := md.xattrs[xattrFCaps]; len(fcaps) > 0 && isRegular && !st.excludeXattr(xattrFCaps) {
+		nn, err = enc.Encode(FormatFCaps{
+			FormatHeader: FormatHeader{Size: 16 + uint64(len(fcaps)), Type: CaFormatFCaps},
+			Data:         fcaps,
+		})
+		n += nn
+		if err != nil {
+			return n, err
+		}
+	}
+
+	// CaFormatSELinux - The label is stored with a trailing 0 byte in the xattr
+	if label := strings.TrimRight(string(md.xattrs[xattrSELinux]), "\x00"); label != "" && !st.excludeXattr(xattrSELinux) {
+		nn, err = enc.Encode(FormatSELinux{
+			FormatHeader: FormatHeader{Size: 16 + uint64(len(label)) + 1, Type: CaFormatSELinux},
+			Label:        label,
+		})
+		n += nn
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Encodes the goodbye element at the end of a directory. n is the position in
+// the archive and the offsets of the items are the positions of the filename
+// elements of the directory's children.
+func encodeGoodbye(enc FormatEncoder, items []FormatGoodbyeItem, n int64) (int64, error) {
+	// Fix the offsets in the item list, it needs to be the offset (backwards)
+	// from the start of FormatGoodbye
+	for i := range items {
+		items[i].Offset = uint64(n) - items[i].Offset
+	}
+
+	// Turn the list of Goodbye items into a complete BST
+	items = makeGoodbyeBST(items)
+
+	// Append the tail marker
+	items = append(items, FormatGoodbyeItem{
+		Offset: uint64(n),
+		Size:   uint64(16 + len(items)*24 + 24),
+		Hash:   CaFormatGoodbyeTailMarker,
+	})
+
+	// Build the complete goodbye element and encode it
+	goodbye := FormatGoodbye{
+		FormatHeader: FormatHeader{Size: uint64(16 + len(items)*24), Type: CaFormatGoodbye},
+		Items:        items,
+	}
+	return enc.Encode(goodbye)
+}
@@ -0,0 +1,393 @@
+package desync
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/pkg/xattr"
+)
+
+func TestTarSELinuxFCaps(t *testing.T) {
+	base, err := ioutil.TempDir("", "desync-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	src := filepath.Join(base, "src")
+	if err = os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(src, "ping")
+	if err = ioutil.WriteFile(file, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Label the file and give it CAP_NET_RAW. Both require privileges.
+	label := "system_u:object_r:ping_exec_t:s0"
+	if err = xattr.LSet(file, xattrSELinux, []byte(label+"\x00")); err != nil {
+		t.Skipf("unable to set SELinux label: %s", err)
+	}
+	caps := new(bytes.Buffer)
+	binary.Write(caps, binary.LittleEndian, []uint32{0x02000001, 1 << 13, 0, 0, 0}) // v2, effective, CAP_NET_RAW
+	if err = xattr.LSet(file, xattrFCaps, caps.Bytes()); err != nil {
+		t.Skipf("unable to set capabilities: %s", err)
+	}
+	fcaps, err := xattr.LGet(file, xattrFCaps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := new(bytes.Buffer)
+	if err = Tar(context.Background(), b, src, TarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The label and capabilities should be elements of their own, not xattrs
+	d := NewArchiveDecoder(bytes.NewReader(b.Bytes()))
+	if _, err = d.Next(); err != nil { // root directory
+		t.Fatal(err)
+	}
+	v, err := d.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, ok := v.(NodeFile)
+	if !ok {
+		t.Fatalf("expected file, got %T", v)
+	}
+	if n.SELinuxLabel != label {
+		t.Fatalf("expected label %q, got %q", label, n.SELinuxLabel)
+	}
+	if !bytes.Equal(n.FCaps, fcaps) {
+		t.Fatalf("expected capabilities %x, got %x", fcaps, n.FCaps)
+	}
+	if _, ok := n.Xattrs[xattrSELinux]; ok {
+		t.Fatal("SELinux label encoded as xattr")
+	}
+	if _, ok := n.Xattrs[xattrFCaps]; ok {
+		t.Fatal("capabilities encoded as xattr")
+	}
+
+	// Extract with and without restoring them
+	for _, test := range []struct {
+		name    string
+		opts    UntarOptions
+		restore bool
+	}{
+		{"restore", UntarOptions{}, true},
+		{"skip", UntarOptions{NoSELinux: true, NoFCaps: true}, false},
+		{"no-same-owner", UntarOptions{NoSameOwner: true}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dst := filepath.Join(base, test.name)
+			if err := os.Mkdir(dst, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := UnTar(context.Background(), bytes.NewReader(b.Bytes()), dst, test.opts); err != nil {
+				t.Fatal(err)
+			}
+			gotLabel, labelErr := xattr.LGet(filepath.Join(dst, "ping"), xattrSELinux)
+			gotCaps, capsErr := xattr.LGet(filepath.Join(dst, "ping"), xattrFCaps)
+			if test.restore {
+				if labelErr != nil || string(gotLabel) != label+"\x00" {
+					t.Fatalf("expected label %q, got %q (%v)", label, gotLabel, labelErr)
+				}
+				if capsErr != nil || !bytes.Equal(gotCaps, fcaps) {
+					t.Fatalf("expected capabilities %x, got %x (%v)", fcaps, gotCaps, capsErr)
+				}
+			} else {
+				if labelErr == nil {
+					t.Fatalf("unexpected label %q", gotLabel)
+				}
+				if capsErr == nil {
+					t.Fatalf("unexpected capabilities %x", gotCaps)
+				}
+			}
+		})
+	}
+}
+
+func TestTarOwnerNames(t *testing.T) {
+	base, err := ioutil.TempDir("", "desync-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	src := filepath.Join(base, "src")
+	if err = os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(src, "file")
+	if err = ioutil.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Owned by daemon:bin, names that exist on most systems
+	uid, gid := 1, 2
+	if userName(uid) != "daemon" || groupName(gid) != "bin" {
+		t.Skip("user daemon or group bin not available")
+	}
+	if err = os.Chown(file, uid, gid); err != nil {
+		t.Skipf("unable to change owner: %s", err)
+	}
+
+	b := new(bytes.Buffer)
+	if err = Tar(context.Background(), b, src, TarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The names should be in the archive
+	d := NewArchiveDecoder(bytes.NewReader(b.Bytes()))
+	v, err := d.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir := v.(NodeDirectory); dir.User != "" || dir.Group != "" {
+		t.Fatalf("expected no names for root, got %q:%q", dir.User, dir.Group)
+	}
+	if v, err = d.Next(); err != nil {
+		t.Fatal(err)
+	}
+	n, ok := v.(NodeFile)
+	if !ok {
+		t.Fatalf("expected file, got %T", v)
+	}
+	if n.User != "daemon" || n.Group != "bin" {
+		t.Fatalf("expected owner daemon:bin, got %q:%q", n.User, n.Group)
+	}
+
+	// Extract it with the owner mapped to different users and groups
+	m, err := NewOwnerMap(strings.NewReader("# archive local\nuser daemon 1234\n\ngroup 2 sys\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(base, "dst")
+	if err = os.Mkdir(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = UnTar(context.Background(), bytes.NewReader(b.Bytes()), dst, UntarOptions{OwnerMap: m}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(filepath.Join(dst, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := info.Sys().(*syscall.Stat_t)
+	if st.Uid != 1234 || st.Gid != 3 {
+		t.Fatalf("expected owner 1234:3, got %d:%d", st.Uid, st.Gid)
+	}
+}
+
+func TestUntarOwnerResolution(t *testing.T) {
+	if userName(1) != "daemon" || groupName(2) != "bin" {
+		t.Skip("user daemon or group bin not available")
+	}
+	m, err := NewOwnerMap(strings.NewReader("user 500 600\ngroup staff 700\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name     string
+		opts     UntarOptions
+		id       int
+		userName string
+		uid      int
+	}{
+		{"by id", UntarOptions{}, 999, "daemon", 999},
+		{"by name", UntarOptions{OwnerByName: true}, 999, "daemon", 1},
+		{"unknown name", UntarOptions{OwnerByName: true}, 999, "no-such-user", 999},
+		{"mapped id", UntarOptions{OwnerByName: true, OwnerMap: m}, 500, "daemon", 600},
+		{"unmapped", UntarOptions{OwnerMap: m}, 501, "daemon", 501},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if uid := test.opts.uid(test.id, test.userName); uid != test.uid {
+				t.Fatalf("expected UID %d, got %d", test.uid, uid)
+			}
+		})
+	}
+	if gid := (UntarOptions{OwnerMap: m}).gid(999, "staff"); gid != 700 {
+		t.Fatalf("expected GID 700, got %d", gid)
+	}
+	if gid := (UntarOptions{OwnerByName: true}).gid(999, "bin"); gid != 2 {
+		t.Fatalf("expected GID 2, got %d", gid)
+	}
+
+	// Local users given by name need to exist
+	if _, err := NewOwnerMap(strings.NewReader("user 500 no-such-user\n")); err == nil {
+		t.Fatal("expected error for unknown local user")
+	}
+	if _, err := NewOwnerMap(strings.NewReader("owner 500 600\n")); err == nil {
+		t.Fatal("expected error for invalid mapping type")
+	}
+}
+
+func TestTarNoDump(t *testing.T) {
+	base, err := ioutil.TempDir("", "desync-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	for _, name := range []string{"dump", "nodump"} {
+		if err = ioutil.WriteFile(filepath.Join(base, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Not all filesystems support the nodump flag
+	if err = setTestAttrFlags(filepath.Join(base, "nodump"), fsNoDumpFl); err != nil {
+		t.Skipf("unable to set nodump flag: %s", err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		opts     TarOptions
+		expected []string
+	}{
+		{"exclude", TarOptions{}, []string{"dump"}},
+		{"include", TarOptions{IncludeNoDump: true}, []string{"dump", "nodump"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			b := new(bytes.Buffer)
+			if err := Tar(context.Background(), b, base, test.opts); err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			d := NewArchiveDecoder(b)
+			for {
+				v, err := d.Next()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v == nil {
+					break
+				}
+				if n, ok := v.(NodeFile); ok {
+					names = append(names, n.Name)
+				}
+			}
+			if !reflect.DeepEqual(names, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, names)
+			}
+		})
+	}
+}
+
+func TestTarChattr(t *testing.T) {
+	base, err := ioutil.TempDir("", "desync-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	src := filepath.Join(base, "src")
+	if err = os.MkdirAll(filepath.Join(src, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(src, "dir", "file")
+	if err = ioutil.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// An immutable directory with an immutable file in it. Needs privileges.
+	if err = setTestAttrFlags(file, fsImmutableFl|fsNoAtimeFl); err != nil {
+		t.Skipf("unable to set flags: %s", err)
+	}
+	defer setTestAttrFlags(file, 0)
+	if err = setTestAttrFlags(filepath.Join(src, "dir"), fsImmutableFl); err != nil {
+		t.Fatal(err)
+	}
+	defer setTestAttrFlags(filepath.Join(src, "dir"), 0)
+
+	b := new(bytes.Buffer)
+	if err = Tar(context.Background(), b, src, TarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Check the flags are in the archive
+	d := NewArchiveDecoder(bytes.NewReader(b.Bytes()))
+	expected := map[string]uint64{
+		".":        0,
+		"dir":      CaFormatWithFlagImmutable,
+		"dir/file": CaFormatWithFlagImmutable | CaFormatWithFlagNoAtime,
+	}
+	for {
+		v, err := d.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v == nil {
+			break
+		}
+		var name string
+		var flags uint64
+		switch n := v.(type) {
+		case NodeDirectory:
+			name, flags = n.Name, n.Flags
+		case NodeFile:
+			name, flags = n.Name, n.Flags
+		}
+		if flags != expected[name] {
+			t.Fatalf("expected flags %x for %s, got %x", expected[name], name, flags)
+		}
+	}
+
+	// Extract it, the directory should only become immutable after the file was
+	// created in it
+	for _, test := range []struct {
+		name      string
+		opts      UntarOptions
+		dirFlags  uint32
+		fileFlags uint32
+	}{
+		{"restore", UntarOptions{}, fsImmutableFl, fsImmutableFl | fsNoAtimeFl},
+		{"skip", UntarOptions{NoChattr: true}, 0, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dst := filepath.Join(base, test.name)
+			if err := os.Mkdir(dst, 0755); err != nil {
+				t.Fatal(err)
+			}
+			err := UnTar(context.Background(), bytes.NewReader(b.Bytes()), dst, test.opts)
+			defer setTestAttrFlags(filepath.Join(dst, "dir", "file"), 0)
+			defer setTestAttrFlags(filepath.Join(dst, "dir"), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, flags := range map[string]uint32{
+				"dir":      test.dirFlags,
+				"dir/file": test.fileFlags,
+			} {
+				path := filepath.Join(dst, name)
+				info, err := os.Lstat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := getAttrFlags(path, info)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got&(fsImmutableFl|fsNoAtimeFl) != flags {
+					t.Fatalf("expected flags %x for %s, got %x", flags, name, got)
+				}
+			}
+		})
+	}
+}
+
+// Sets the inode flags of a file or directory, replacing any existing ones
+func setTestAttrFlags(path string, flags uint32) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	v := int32(flags)
+	return ioctl(f.Fd(), fsIocSetFlags, uintptr(unsafe.Pointer(&v)))
+}
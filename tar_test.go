@@ -7,10 +7,16 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/pkg/xattr"
 )
 
 func TestTar(t *testing.T) {
@@ -47,7 +53,7 @@ func TestTar(t *testing.T) {
 
 	// Encode it all into a buffer
 	b := new(bytes.Buffer)
-	if err = Tar(context.Background(), b, base, false); err != nil {
+	if err = Tar(context.Background(), b, base, TarOptions{}); err != nil {
 		t.Fatal(err)
 	}
 
@@ -98,3 +104,446 @@ func TestTar(t *testing.T) {
 		}
 	}
 }
+
+func TestTarSpecialFiles(t *testing.T) {
+	base, err := ioutil.TempDir("", "desync-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	src := filepath.Join(base, "src")
+	dst := filepath.Join(base, "dst")
+	for _, d := range []string{src, dst} {
+		if err = os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Make a FIFO and a socket
+	if err = syscall.Mkfifo(filepath.Join(src, "fifo"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("unix", filepath.Join(src, "socket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Encode it, both should be entries without any further elements
+	b := new(bytes.Buffer)
+	if err = Tar(context.Background(), b, src, TarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	d := NewFormatDecoder(bytes.NewReader(b.Bytes()))
+	expected := []interface{}{
+		FormatEntry{},
+		FormatFilename{}, // "fifo"
+		FormatEntry{},
+		FormatFilename{}, // "socket"
+		FormatEntry{},
+		FormatGoodbye{},
+		nil,
+	}
+	for _, exp := range expected {
+		v, err := d.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reflect.TypeOf(exp) != reflect.TypeOf(v) {
+			t.Fatalf("expected %s, got %s", reflect.TypeOf(exp), reflect.TypeOf(v))
+		}
+	}
+
+	// Now extract the archive and confirm the FIFO and socket are re-created
+	if err = UnTar(context.Background(), b, dst, UntarOptions{NoSameOwner: true}); err != nil {
+		t.Fatal(err)
+	}
+	for name, typ := range map[string]os.FileMode{
+		"fifo":   os.ModeNamedPipe,
+		"socket": os.ModeSocket,
+	} {
+		srcInfo, err := os.Lstat(filepath.Join(src, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dstInfo, err := os.Lstat(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dstInfo.Mode()&os.ModeType != typ {
+			t.Fatalf("expected %s to be of type %s, got %s", name, typ, dstInfo.Mode()&os.ModeType)
+		}
+		if dstInfo.Mode() != srcInfo.Mode() {
+			t.Fatalf("expected mode %s for %s, got %s", srcInfo.Mode(), name, dstInfo.Mode())
+		}
+	}
+
+	// The casync-encoded FIFO and socket should extract as well
+	f, err := os.Open("testdata/special.catar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	casyncDst := filepath.Join(base, "casync")
+	if err = os.Mkdir(casyncDst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = UnTar(context.Background(), f, casyncDst, UntarOptions{NoSameOwner: true}); err != nil {
+		t.Fatal(err)
+	}
+	for name, typ := range map[string]os.FileMode{
+		"fifo":   os.ModeNamedPipe,
+		"socket": os.ModeSocket,
+	} {
+		info, err := os.Lstat(filepath.Join(casyncDst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode()&os.ModeType != typ {
+			t.Fatalf("expected %s to be of type %s, got %s", name, typ, info.Mode()&os.ModeType)
+		}
+	}
+}
+
+func TestTarExclude(t *testing.T) {
+	base, err := ioutil.TempDir("", "desync-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	for _, d := range []string{"build", "src/build", "src/cache", "docs"} {
+		if err = os.MkdirAll(filepath.Join(base, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range map[string]string{
+		"build/out":        "",
+		"src/main.c":       "",
+		"src/main.o":       "",
+		"src/build/out":    "",
+		"src/cache/data":   "",
+		"src/cache/keep":   "",
+		"docs/manual.txt":  "",
+		".caexclude":       "*.o\n/build/\n",
+		"src/.caexclude":   "# Not needed in the archive\ncache/*\n!cache/keep\n",
+		"docs/.caexclude":  "",
+		"docs/manual.html": "",
+	} {
+		if err = ioutil.WriteFile(filepath.Join(base, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		name     string
+		opts     TarOptions
+		expected []string
+	}{
+		{
+			name: "exclude file",
+			expected: []string{".", ".caexclude", "docs", "docs/.caexclude", "docs/manual.html", "docs/manual.txt",
+				"src", "src/.caexclude", "src/build", "src/build/out", "src/cache", "src/cache/keep", "src/main.c"},
+		},
+		{
+			name: "exclude file and patterns",
+			opts: TarOptions{Exclude: []string{"*.html", "build/", "keep"}},
+			expected: []string{".", ".caexclude", "docs", "docs/.caexclude", "docs/manual.txt",
+				"src", "src/.caexclude", "src/cache", "src/main.c"},
+		},
+		{
+			name: "no exclude file",
+			opts: TarOptions{NoExcludeFile: true, Exclude: []string{".caexclude", "docs"}},
+			expected: []string{".", "build", "build/out", "src", "src/build", "src/build/out",
+				"src/cache", "src/cache/data", "src/cache/keep", "src/main.c", "src/main.o"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			b := new(bytes.Buffer)
+			if err := Tar(context.Background(), b, base, test.opts); err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			d := NewArchiveDecoder(b)
+			for {
+				v, err := d.Next()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v == nil {
+					break
+				}
+				switch n := v.(type) {
+				case NodeDirectory:
+					names = append(names, n.Name)
+				case NodeFile:
+					names = append(names, n.Name)
+				}
+			}
+			if !reflect.DeepEqual(names, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, names)
+			}
+		})
+	}
+
+	// Invalid patterns should fail
+	if err = Tar(context.Background(), ioutil.Discard, base, TarOptions{Exclude: []string{"[a"}}); err == nil {
+		t.Fatal("expected error for invalid pattern")
+	}
+}
+
+func TestTarReproducible(t *testing.T) {
+	base, err := ioutil.TempDir("", "desync-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	// Two trees with the same content but different times and permissions
+	clamp := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, tree := range []struct {
+		dirMode, fileMode, exeMode os.FileMode
+		mtime                      time.Time
+	}{
+		{0700, 0600, 0700, time.Now()},
+		{0755, 0664, 0751, time.Now().Add(-time.Hour)},
+	} {
+		src := filepath.Join(base, fmt.Sprint(i))
+		if err = os.MkdirAll(filepath.Join(src, "dir"), tree.dirMode); err != nil {
+			t.Fatal(err)
+		}
+		files := map[string]os.FileMode{"dir/file": tree.fileMode, "dir/exe": tree.exeMode}
+		for name, mode := range files {
+			p := filepath.Join(src, name)
+			if err = ioutil.WriteFile(p, []byte(name), mode); err != nil {
+				t.Fatal(err)
+			}
+			if err = os.Chmod(p, mode); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if i == 1 {
+			if err = xattr.LSet(filepath.Join(src, "dir/file"), "user.comment", []byte("x")); err != nil {
+				t.Skipf("unable to set xattr: %s", err)
+			}
+		}
+		for _, name := range []string{"dir/file", "dir/exe", "dir", "."} {
+			if err = os.Chtimes(filepath.Join(src, name), tree.mtime, tree.mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	opts := TarOptions{
+		ClampMTime:           clamp,
+		TimeGranularity:      time.Second,
+		NormalizeOwner:       true,
+		NormalizePermissions: true,
+		ExcludeXattrs:        []string{"user.*"},
+	}
+	var archives [][]byte
+	for _, src := range []string{"0", "1"} {
+		b := new(bytes.Buffer)
+		if err = Tar(context.Background(), b, filepath.Join(base, src), opts); err != nil {
+			t.Fatal(err)
+		}
+		archives = append(archives, b.Bytes())
+	}
+	if !bytes.Equal(archives[0], archives[1]) {
+		t.Fatal("expected identical archives")
+	}
+
+	// Check times, permissions and feature flags
+	d := NewFormatDecoder(bytes.NewReader(archives[0]))
+	modes := []os.FileMode{syscall.S_IFDIR | 0755, syscall.S_IFDIR | 0755, syscall.S_IFREG | 0755, syscall.S_IFREG | 0644}
+	for {
+		v, err := d.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v == nil {
+			break
+		}
+		e, ok := v.(FormatEntry)
+		if !ok {
+			continue
+		}
+		if e.FeatureFlags&CaFormatWithSecTime == 0 || e.FeatureFlags&CaFormatWithNSecTime != 0 {
+			t.Fatalf("unexpected time feature flags in %x", e.FeatureFlags)
+		}
+		if !e.MTime.Equal(clamp) {
+			t.Fatalf("expected mtime %s, got %s", clamp, e.MTime)
+		}
+		if e.UID != 0 || e.GID != 0 {
+			t.Fatalf("expected owner 0:0, got %d:%d", e.UID, e.GID)
+		}
+		if len(modes) == 0 || e.Mode != modes[0] {
+			t.Fatalf("expected mode %o, got %o", modes, e.Mode)
+		}
+		modes = modes[1:]
+	}
+
+	if err = Tar(context.Background(), ioutil.Discard, base, TarOptions{TimeGranularity: time.Minute}); err == nil {
+		t.Fatal("expected error for unsupported time granularity")
+	}
+}
+
+func TestUnTarIndexPaths(t *testing.T) {
+	base, err := ioutil.TempDir("", "desync-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	src := filepath.Join(base, "src")
+
+	// A tree with enough files to need several chunks and a deep goodbye table
+	for i := 0; i < 50; i++ {
+		dir := filepath.Join(src, fmt.Sprintf("dir%02d", i))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 10; j++ {
+			content := bytes.Repeat([]byte(fmt.Sprintf("%d/%d ", i, j)), 200)
+			if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("f%d", j)), content, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Chunk the archive into a store
+	catar := new(bytes.Buffer)
+	if err := Tar(context.Background(), catar, src, TarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	store := filepath.Join(base, "store")
+	if err := os.Mkdir(store, 0755); err != nil {
+		t.Fatal(err)
+	}
+	ls, err := NewLocalStore(store, StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewChunker(bytes.NewReader(catar.Bytes()), 1024, 4096, 16384)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := ChunkStream(context.Background(), c, ls, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Extract a directory and a file from another one
+	dst := filepath.Join(base, "dst")
+	s := &countingStore{Store: ls}
+	paths := []string{"dir07", "/dir42/f3", "dir07/f1"}
+	pb := &testProgressBar{}
+	if err := UnTarIndexPaths(context.Background(), dst, index, s, 4, paths, UntarOptions{}, pb); err != nil {
+		t.Fatal(err)
+	}
+	if pb.setTotal != 1 || pb.current != pb.total {
+		t.Fatalf("expected progress total to be set once and reached, got %d calls, %d of %d", pb.setTotal, pb.current, pb.total)
+	}
+	for _, name := range []string{"dir07/f0", "dir07/f9", "dir42/f3"} {
+		expected, err := ioutil.ReadFile(filepath.Join(src, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(expected, got) {
+			t.Fatalf("content of %s differs", name)
+		}
+	}
+	for _, name := range []string{"dir06", "dir08", "dir42/f2"} {
+		if _, err := os.Lstat(filepath.Join(dst, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s shouldn't have been extracted", name)
+		}
+	}
+	if s.n >= int64(len(index.Chunks)) {
+		t.Fatalf("expected fewer than %d chunks to be retrieved, got %d", len(index.Chunks), s.n)
+	}
+
+	// The same from the catar
+	dst = filepath.Join(base, "dst-catar")
+	if err := UnTarPaths(context.Background(), bytes.NewReader(catar.Bytes()), int64(catar.Len()), dst, paths, UntarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "dir42", "f3")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Paths that aren't in the archive
+	if err := UnTarIndexPaths(context.Background(), dst, index, s, 4, []string{"dir07/missing"}, UntarOptions{}, nil); err == nil {
+		t.Fatal("expected error for missing path")
+	}
+}
+
+func TestLookupArchivePaths(t *testing.T) {
+	src, err := ioutil.TempDir("", "desync-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	for _, dir := range []string{"a/b", "a-b", "c"} {
+		if err := os.MkdirAll(filepath.Join(src, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	catar := new(bytes.Buffer)
+	if err := Tar(context.Background(), catar, src, TarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(catar.Bytes())
+
+	// "a-b" sorts between "a" and "a/b", the latter needs to be dropped anyway
+	nodes, err := lookupArchivePaths(r, r.Size(), []string{"a/b", "a-b", "a", "a/b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, n := range nodes {
+		names = append(names, n.Name)
+	}
+	if expected := []string{"a", "a-b"}; !reflect.DeepEqual(expected, names) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+
+	// The root covers everything
+	nodes, err = lookupArchivePaths(r, r.Size(), []string{"c", ".", "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].Name != "." {
+		t.Fatalf("expected only the root, got %v", nodes)
+	}
+}
+
+// Store that counts the chunks that are retrieved from it
+type countingStore struct {
+	Store
+	n int64
+}
+
+func (s *countingStore) GetChunk(id ChunkID) (*Chunk, error) {
+	atomic.AddInt64(&s.n, 1)
+	return s.Store.GetChunk(id)
+}
+
+// Progress bar that records how it's used
+type testProgressBar struct {
+	setTotal       int
+	total, current int
+}
+
+func (p *testProgressBar) SetTotal(total int) {
+	p.setTotal++
+	p.total = total
+}
+func (p *testProgressBar) Start()                      {}
+func (p *testProgressBar) Finish()                     {}
+func (p *testProgressBar) Increment() int              { p.current++; return p.current }
+func (p *testProgressBar) Add(add int) int             { p.current += add; return p.current }
+func (p *testProgressBar) Set(current int)             { p.current = current }
+func (p *testProgressBar) Write(b []byte) (int, error) { return len(b), nil }
@@ -3,31 +3,110 @@
 package desync
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"syscall"
 
-	"golang.org/x/sync/errgroup"
-
 	"github.com/pkg/errors"
 	"github.com/pkg/xattr"
 )
 
 // UntarOptions are used to influence the behaviour of untar
 type UntarOptions struct {
+	// Extract files as the current user. This also skips SELinux labels and
+	// file capabilities.
 	NoSameOwner       bool
 	NoSamePermissions bool
+
+	// Don't restore SELinux labels, for example on hosts without SELinux
+	NoSELinux bool
+
+	// Don't restore file capabilities
+	NoFCaps bool
+
+	// Set the owners by the user and group names stored in the archive rather
+	// than the numeric IDs. IDs are used for names that don't exist locally.
+	OwnerByName bool
+
+	// Maps owners in the archive to local users and groups. Takes precedence
+	// over OwnerByName, owners that aren't in the map are resolved as usual.
+	OwnerMap *OwnerMap
+
+	// Don't restore chattr(1) flags. Setting some of them, like immutable or
+	// append-only, requires privileges.
+	NoChattr bool
+}
+
+// Returns the local UID for a user in an archive, from the mapping, by name or
+// by ID, in that order.
+func (o UntarOptions) uid(id int, name string) int {
+	if mapped, ok := o.OwnerMap.uid(id, name); ok {
+		return mapped
+	}
+	if o.OwnerByName && name != "" {
+		if local, ok := lookupUID(name); ok {
+			return local
+		}
+	}
+	return id
+}
+
+// Returns the local GID for a group in an archive, like uid().
+func (o UntarOptions) gid(id int, name string) int {
+	if mapped, ok := o.OwnerMap.gid(id, name); ok {
+		return mapped
+	}
+	if o.OwnerByName && name != "" {
+		if local, ok := lookupGID(name); ok {
+			return local
+		}
+	}
+	return id
+}
+
+// Returns a copy of an ACL with the IDs of named users and groups resolved
+// the same way as owners.
+func (o UntarOptions) mapACL(acl *ACL) *ACL {
+	if !o.OwnerByName && o.OwnerMap == nil {
+		return acl
+	}
+	mapEntries := func(entries []ACLEntry, resolve func(int, string) int) []ACLEntry {
+		if entries == nil {
+			return nil
+		}
+		mapped := make([]ACLEntry, len(entries))
+		for i, e := range entries {
+			e.ID = resolve(e.ID, e.Name)
+			mapped[i] = e
+		}
+		return mapped
+	}
+	m := *acl
+	m.User = mapEntries(acl.User, o.uid)
+	m.Group = mapEntries(acl.Group, o.gid)
+	m.DefaultUser = mapEntries(acl.DefaultUser, o.uid)
+	m.DefaultGroup = mapEntries(acl.DefaultGroup, o.gid)
+	return &m
 }
 
 // UnTar implements the untar command, decoding a catar file and writing the
 // contained tree to a target directory.
 func UnTar(ctx context.Context, r io.Reader, dst string, opts UntarOptions) error {
 	dec := NewArchiveDecoder(r)
+	return untar(ctx, &dec, dst, opts)
+}
+
+// Writes all nodes returned by a decoder into a target directory.
+func untar(ctx context.Context, dec *ArchiveDecoder, dst string, opts UntarOptions) error {
+	// Flags like immutable prevent adding files to a directory, so directories
+	// get their flags once everything is extracted
+	var flaggedDirs []NodeDirectory
 loop:
 	for {
 		// See if we're meant to stop
@@ -43,12 +122,19 @@ loop:
 		switch n := c.(type) {
 		case NodeDirectory:
 			err = makeDir(dst, n, opts)
+			if n.Flags != 0 && !opts.NoChattr {
+				flaggedDirs = append(flaggedDirs, n)
+			}
 		case NodeFile:
 			err = makeFile(dst, n, opts)
 		case NodeDevice:
 			err = makeDevice(dst, n, opts)
 		case NodeSymlink:
 			err = makeSymlink(dst, n, opts)
+		case NodeFIFO:
+			err = makeSpecial(dst, n, opts)
+		case NodeSocket:
+			err = makeSpecial(dst, NodeFIFO(n), opts)
 		case nil:
 			break loop
 		default:
@@ -58,6 +144,11 @@ loop:
 			return err
 		}
 	}
+	for _, n := range flaggedDirs {
+		if err := writeChattrFlags(filepath.Join(dst, n.Name), n.Flags); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -75,9 +166,15 @@ func makeDir(base string, n NodeDirectory, opts UntarOptions) error {
 			return err
 		}
 	}
+	// Files created in the directory inherit nocow, set it before there are any
+	if n.Flags&CaFormatWithFlagNoCow != 0 && !opts.NoChattr {
+		if err := writeChattrFlags(dst, CaFormatWithFlagNoCow); err != nil {
+			return err
+		}
+	}
 	// The dir exists now, fix the UID/GID if needed
 	if !opts.NoSameOwner {
-		if err := os.Chown(dst, n.UID, n.GID); err != nil {
+		if err := os.Chown(dst, opts.uid(n.UID, n.User), opts.gid(n.GID, n.Group)); err != nil {
 			return err
 		}
 
@@ -93,6 +190,14 @@ func makeDir(base string, n NodeDirectory, opts UntarOptions) error {
 		if err := syscall.Chmod(dst, uint32(n.Mode)); err != nil {
 			return err
 		}
+		if n.ACL != nil {
+			if err := writeACL(dst, n.Mode, opts.mapACL(n.ACL)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := setSecurityAttrs(dst, n.SELinuxLabel, nil, opts); err != nil {
+		return err
 	}
 	return os.Chtimes(dst, n.MTime, n.MTime)
 }
@@ -105,11 +210,17 @@ func makeFile(base string, n NodeFile, opts UntarOptions) error {
 		return err
 	}
 	defer f.Close()
+	// Nocow only has an effect on empty files, set it before writing the data
+	if n.Flags&CaFormatWithFlagNoCow != 0 && !opts.NoChattr {
+		if err := writeChattrFlags(dst, CaFormatWithFlagNoCow); err != nil {
+			return err
+		}
+	}
 	if _, err = io.Copy(f, n.Data); err != nil {
 		return err
 	}
 	if !opts.NoSameOwner {
-		if err = f.Chown(n.UID, n.GID); err != nil {
+		if err = f.Chown(opts.uid(n.UID, n.User), opts.gid(n.GID, n.Group)); err != nil {
 			return err
 		}
 
@@ -125,8 +236,23 @@ func makeFile(base string, n NodeFile, opts UntarOptions) error {
 		if err := syscall.Chmod(dst, uint32(n.Mode)); err != nil {
 			return err
 		}
+		if n.ACL != nil {
+			if err := writeACL(dst, n.Mode, opts.mapACL(n.ACL)); err != nil {
+				return err
+			}
+		}
 	}
-	return os.Chtimes(dst, n.MTime, n.MTime)
+	if err := setSecurityAttrs(dst, n.SELinuxLabel, n.FCaps, opts); err != nil {
+		return err
+	}
+	if err := os.Chtimes(dst, n.MTime, n.MTime); err != nil {
+		return err
+	}
+	// The rest of the flags go last, immutable prevents changing anything else
+	if opts.NoChattr {
+		return nil
+	}
+	return writeChattrFlags(dst, n.Flags)
 }
 
 func makeSymlink(base string, n NodeSymlink, opts UntarOptions) error {
@@ -143,7 +269,7 @@ func makeSymlink(base string, n NodeSymlink, opts UntarOptions) error {
 	// add some Mac-specific logic for that here.
 	// fchmodat() with flag AT_SYMLINK_NOFOLLOW
 	if !opts.NoSameOwner {
-		if err := os.Lchown(dst, n.UID, n.GID); err != nil {
+		if err := os.Lchown(dst, opts.uid(n.UID, n.User), opts.gid(n.GID, n.Group)); err != nil {
 			return err
 		}
 
@@ -155,7 +281,7 @@ func makeSymlink(base string, n NodeSymlink, opts UntarOptions) error {
 			}
 		}
 	}
-	return nil
+	return setSecurityAttrs(dst, n.SELinuxLabel, nil, opts)
 }
 
 func makeDevice(base string, n NodeDevice, opts UntarOptions) error {
@@ -168,7 +294,7 @@ func makeDevice(base string, n NodeDevice, opts UntarOptions) error {
 		return errors.Wrapf(err, "mknod %s", dst)
 	}
 	if !opts.NoSameOwner {
-		if err := os.Chown(dst, n.UID, n.GID); err != nil {
+		if err := os.Chown(dst, opts.uid(n.UID, n.User), opts.gid(n.GID, n.Group)); err != nil {
 			return err
 		}
 
@@ -185,9 +311,67 @@ func makeDevice(base string, n NodeDevice, opts UntarOptions) error {
 			return errors.Wrapf(err, "chmod %s", dst)
 		}
 	}
+	if err := setSecurityAttrs(dst, n.SELinuxLabel, nil, opts); err != nil {
+		return err
+	}
 	return os.Chtimes(dst, n.MTime, n.MTime)
 }
 
+// Creates a FIFO or socket. Sockets have the same fields as FIFOs and are passed
+// in as NodeFIFO, the type is in the mode. Like casync, sockets are created with
+// mknod(2) as there's nothing listening on them after extracting anyway.
+func makeSpecial(base string, n NodeFIFO, opts UntarOptions) error {
+	dst := filepath.Join(base, n.Name)
+
+	if err := syscall.Unlink(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := syscall.Mknod(dst, uint32(n.Mode), 0); err != nil {
+		return errors.Wrapf(err, "mknod %s", dst)
+	}
+	if !opts.NoSameOwner {
+		if err := os.Lchown(dst, opts.uid(n.UID, n.User), opts.gid(n.GID, n.Group)); err != nil {
+			return err
+		}
+
+		for key, value := range n.Xattrs {
+			if err := xattr.LSet(dst, key, []byte(value)); err != nil {
+				return err
+			}
+		}
+	}
+	if !opts.NoSamePermissions {
+		if err := syscall.Chmod(dst, uint32(n.Mode)); err != nil {
+			return errors.Wrapf(err, "chmod %s", dst)
+		}
+	}
+	if err := setSecurityAttrs(dst, n.SELinuxLabel, nil, opts); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, n.MTime, n.MTime)
+}
+
+// Applies the SELinux label and file capabilities of a node, unless that's
+// disabled in the options. Needs to be done after changing the owner, as that
+// clears any capabilities. Both need privileges, so they're skipped when
+// extracting as the current user with NoSameOwner.
+func setSecurityAttrs(dst, label string, fcaps []byte, opts UntarOptions) error {
+	if opts.NoSameOwner {
+		return nil
+	}
+	if label != "" && !opts.NoSELinux {
+		if err := xattr.LSet(dst, xattrSELinux, []byte(label+"\x00")); err != nil {
+			return errors.Wrapf(err, "setting SELinux label of %s", dst)
+		}
+	}
+	if len(fcaps) > 0 && !opts.NoFCaps {
+		if err := xattr.LSet(dst, xattrFCaps, fcaps); err != nil {
+			return errors.Wrapf(err, "setting capabilities of %s", dst)
+		}
+	}
+	return nil
+}
+
 func mkdev(major, minor uint64) uint64 {
 	dev := (major & 0x00000fff) << 8
 	dev |= (major & 0xfffff000) << 32
@@ -200,106 +384,137 @@ func mkdev(major, minor uint64) uint64 {
 // and decodes it on-the-fly into the target directory 'dst'. Uses n gorountines
 // to retrieve and decompress the chunks.
 func UnTarIndex(ctx context.Context, dst string, index Index, s Store, n int, opts UntarOptions, pb ProgressBar) error {
-	type requestJob struct {
-		chunk IndexChunk    // requested chunk
-		data  chan ([]byte) // channel for the (decompressed) chunk
+	return streamIndex(ctx, index, s, n, pb, func(ctx context.Context, r io.Reader) error {
+		return UnTar(ctx, r, dst, opts)
+	})
+}
+
+// UnTarPaths extracts only the nodes at the given paths, and everything below
+// them, from a catar archive of the given size into the target directory. The
+// nodes are found with the goodbye tables of the archive, the rest of it isn't
+// read. Parent directories of the paths are created if they don't exist, but
+// don't get the metadata from the archive.
+func UnTarPaths(ctx context.Context, r io.ReadSeeker, size int64, dst string, paths []string, opts UntarOptions) error {
+	nodes, err := lookupArchivePaths(r, size, paths)
+	if err != nil {
+		return err
 	}
-	var (
-		req      = make(chan requestJob)
-		assemble = make(chan chan []byte, n)
-	)
-	g, ctx := errgroup.WithContext(ctx)
+	for _, node := range nodes {
+		if _, err := r.Seek(node.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		if err := untarNode(ctx, io.LimitReader(r, node.Size), node, dst, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// Initialize and start progress bar if one was provided
+// UnTarIndexPaths is like UnTarPaths for the catar archive of an index. Only
+// the chunks holding the goodbye tables and entries along the paths, and the
+// chunks covering the nodes that are extracted, are retrieved from the store.
+// Uses n goroutines to retrieve and decompress the chunks of each node.
+func UnTarIndexPaths(ctx context.Context, dst string, index Index, s Store, n int, paths []string, opts UntarOptions, pb ProgressBar) error {
+	if len(index.Chunks) == 0 {
+		return errors.New("index is empty")
+	}
+	nodes, err := lookupArchivePaths(NewIndexReadSeeker(index, s), index.Length(), paths)
+	if err != nil {
+		return err
+	}
+
+	// Only stream the chunks that hold each node. The progress bar covers the
+	// chunks of all nodes.
+	subs := make([]Index, len(nodes))
+	var total int
+	for i, node := range nodes {
+		subs[i] = indexRange(index, node.Offset, node.Size)
+		total += len(subs[i].Chunks)
+	}
+	var nodePb ProgressBar
 	if pb != nil {
-		pb.SetTotal(len(index.Chunks))
+		pb.SetTotal(total)
 		pb.Start()
 		defer pb.Finish()
+		nodePb = continuedProgressBar{pb}
 	}
 
-	// Use a pipe as input to untar and write the chunks into that (in the right
-	// order of course)
-	r, w := io.Pipe()
-
-	// Workers - getting chunks from the store
-	for i := 0; i < n; i++ {
-		g.Go(func() error {
-			for r := range req {
-				// Pull the chunk from the store
-				chunk, err := s.GetChunk(r.chunk.ID)
-				if err != nil {
-					close(r.data)
-					return err
-				}
-				b, err := chunk.Uncompressed()
-				if err != nil {
-					close(r.data)
-					return err
-				}
-				// Might as well verify the chunk size while we're at it
-				if r.chunk.Size != uint64(len(b)) {
-					close(r.data)
-					return fmt.Errorf("unexpected size for chunk %s", r.chunk.ID)
-				}
-				r.data <- b
-				close(r.data)
+	for i, node := range nodes {
+		// Skip what comes before the node in the first chunk
+		sub := subs[i]
+		skip := node.Offset - int64(sub.Chunks[0].Start)
+		err := streamIndex(ctx, sub, s, n, nodePb, func(ctx context.Context, r io.Reader) error {
+			if _, err := io.CopyN(ioutil.Discard, r, skip); err != nil {
+				return err
 			}
-			return nil
+			if err := untarNode(ctx, io.LimitReader(r, node.Size), node, dst, opts); err != nil {
+				return err
+			}
+			// Consume the rest of the last chunk, the assembler blocks otherwise
+			_, err := io.Copy(ioutil.Discard, r)
+			return err
 		})
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// Feeder - requesting chunks from the workers and handing a result data channel
-	// to the assembler
-	g.Go(func() error {
-	loop:
-		for _, c := range index.Chunks {
-			data := make(chan []byte, 1)
-			select {
-			case <-ctx.Done():
-				break loop
-			case req <- requestJob{chunk: c, data: data}: // request the chunk
-				assemble <- data // and hand over the data channel to the assembler
-			}
-		}
-		close(req)      // tell the workers this is it
-		close(assemble) // tell the assembler we're done
-		return nil
-	})
+// Progress bar that was set up by the caller and is used for several streams.
+type continuedProgressBar struct {
+	ProgressBar
+}
 
-	// Assember - Read from data channels push the chunks into the pipe that untar reads from
-	g.Go(func() error {
-	loop:
-		for {
-			select {
-			case data := <-assemble:
-				if data == nil {
-					break loop
-				}
-				if pb != nil {
-					pb.Increment()
-				}
-				b := <-data
-				if _, err := io.Copy(w, bytes.NewReader(b)); err != nil {
-					return err
-				}
-			case <-ctx.Done():
-				break loop
-			}
-		}
-		w.Close() // No more chunks to come, stop the untar
-		return nil
-	})
+func (continuedProgressBar) SetTotal(int) {}
+func (continuedProgressBar) Start()       {}
+func (continuedProgressBar) Finish()      {}
 
-	// UnTar - Read from the pipe that Assembler pushes into
-	g.Go(func() error {
-		err := UnTar(ctx, r, dst, opts)
+// Finds the nodes at a list of paths in an archive, in the order they appear
+// in the archive. Nodes that are within other nodes in the list are dropped
+// since they're extracted with their parent.
+func lookupArchivePaths(r io.ReadSeeker, size int64, paths []string) ([]ArchiveNodePos, error) {
+	var nodes []ArchiveNodePos
+	for _, p := range paths {
+		node, err := LookupArchivePath(r, size, p)
 		if err != nil {
-			// If an error has occurred during the UnTar, we need to stop the Assembler.
-			// If we don't, then it would stall on writing to the pipe.
-			r.CloseWithError(err)
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Offset < nodes[j].Offset })
+	var out []ArchiveNodePos
+	for _, node := range nodes {
+		var contained bool
+		for _, kept := range out {
+			if node.Offset >= kept.Offset && node.Offset+node.Size <= kept.Offset+kept.Size {
+				contained = true
+				break
+			}
+		}
+		if !contained {
+			out = append(out, node)
 		}
+	}
+	return out, nil
+}
+
+// Extracts a node, read from r, and everything below it.
+func untarNode(ctx context.Context, r io.Reader, node ArchiveNodePos, dst string, opts UntarOptions) error {
+	if err := os.MkdirAll(filepath.Join(dst, filepath.Dir(node.Name)), 0777); err != nil {
 		return err
-	})
+	}
+	dec := node.Decoder(r)
+	return untar(ctx, &dec, dst, opts)
+}
 
-	return g.Wait()
+// Returns an index with only the chunks that hold a range of the blob.
+func indexRange(index Index, offset, size int64) Index {
+	first := sort.Search(len(index.Chunks), func(i int) bool {
+		return int64(index.Chunks[i].Start+index.Chunks[i].Size) > offset
+	})
+	last := sort.Search(len(index.Chunks), func(i int) bool {
+		return int64(index.Chunks[i].Start) >= offset+size
+	})
+	return Index{Index: index.Index, Chunks: index.Chunks[first:last]}
 }
@@ -13,7 +13,18 @@ import (
 // VerifyIndex re-calculates the checksums of a blob comparing it to a given index.
 // Fails if the index does not match the blob.
 func VerifyIndex(ctx context.Context, name string, idx Index, n int, pb ProgressBar) error {
-	in := make(chan IndexChunk)
+	return verifyIndex(ctx, name, idx, nil, n, pb)
+}
+
+// VerifyIndexDigest works like VerifyIndex and additionally compares the SHA-256
+// digest of the blob to the given one. The digest is calculated while the chunks
+// are being verified.
+func VerifyIndexDigest(ctx context.Context, name string, idx Index, digest []byte, n int, pb ProgressBar) error {
+	return verifyIndex(ctx, name, idx, digest, n, pb)
+}
+
+func verifyIndex(ctx context.Context, name string, idx Index, expected []byte, n int, pb ProgressBar) error {
+	in := make(chan int)
 	g, ctx := errgroup.WithContext(ctx)
 
 	// Setup and start the progressbar if any
@@ -31,6 +42,15 @@ func VerifyIndex(ctx context.Context, name string, idx Index, n int, pb Progress
 		return fmt.Errorf("index size (%d) does not match file size (%d)", idx.Length(), stat.Size())
 	}
 
+	// Hash the blob as chunks are verified if there's a digest to compare to
+	var digest *fileDigest
+	if expected != nil {
+		if digest, err = newFileDigest(name, idx); err != nil {
+			return err
+		}
+		defer digest.close()
+	}
+
 	// Start the workers, each having its own filehandle to read concurrently
 	for i := 0; i < n; i++ {
 		f, err := os.Open(name)
@@ -39,7 +59,8 @@ func VerifyIndex(ctx context.Context, name string, idx Index, n int, pb Progress
 		}
 		defer f.Close()
 		g.Go(func() error {
-			for c := range in {
+			for i := range in {
+				c := idx.Chunks[i]
 				// Update progress bar if any
 				if pb != nil {
 					pb.Increment()
@@ -63,6 +84,9 @@ func VerifyIndex(ctx context.Context, name string, idx Index, n int, pb Progress
 				if sum != c.ID {
 					return fmt.Errorf("checksum does not match chunk %s", c.ID)
 				}
+				if digest != nil {
+					digest.add(i, i)
+				}
 			}
 			return nil
 		})
@@ -70,14 +94,21 @@ func VerifyIndex(ctx context.Context, name string, idx Index, n int, pb Progress
 
 	// Feed the workers, stop if there are any errors
 loop:
-	for _, c := range idx.Chunks {
+	for i := range idx.Chunks {
 		select {
 		case <-ctx.Done():
 			break loop
-		case in <- c:
+		case in <- i:
 		}
 	}
 	close(in)
 
-	return g.Wait()
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if digest != nil {
+		_, err := digest.verify(expected)
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,158 @@
+package desync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// WalkArchive decodes a catar archive and calls fn for every node in it, in
+// the order they're stored. Nodes are of the types returned by
+// ArchiveDecoder.Next. The content of a NodeFile can only be read until fn
+// returns.
+func WalkArchive(ctx context.Context, r io.Reader, fn func(node interface{}) error) error {
+	dec := NewArchiveDecoder(r)
+	for {
+		// See if we're meant to stop
+		select {
+		case <-ctx.Done():
+			return Interrupted{}
+		default:
+		}
+		c, err := dec.Next()
+		if err != nil {
+			return err
+		}
+		if c == nil {
+			return nil
+		}
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+}
+
+// WalkArchiveIndex re-assembles the catar archive of an index, using n
+// goroutines to retrieve and decompress the chunks, and calls fn for every node
+// in it. The chunks are streamed into the decoder, the archive is never held
+// in full.
+func WalkArchiveIndex(ctx context.Context, index Index, s Store, n int, pb ProgressBar, fn func(node interface{}) error) error {
+	return streamIndex(ctx, index, s, n, pb, func(ctx context.Context, r io.Reader) error {
+		return WalkArchive(ctx, r, fn)
+	})
+}
+
+// Re-assembles the blob of an index from chunks retrieved with n goroutines
+// and hands it to a decoder as a stream.
+func streamIndex(ctx context.Context, index Index, s Store, n int, pb ProgressBar, decode func(context.Context, io.Reader) error) error {
+	type requestJob struct {
+		chunk IndexChunk    // requested chunk
+		data  chan ([]byte) // channel for the (decompressed) chunk
+	}
+	var (
+		req      = make(chan requestJob)
+		assemble = make(chan chan []byte, n)
+	)
+	g, ctx := errgroup.WithContext(ctx)
+
+	// Initialize and start progress bar if one was provided
+	if pb != nil {
+		pb.SetTotal(len(index.Chunks))
+		pb.Start()
+		defer pb.Finish()
+	}
+
+	// Use a pipe as input to untar and write the chunks into that (in the right
+	// order of course)
+	r, w := io.Pipe()
+
+	// Workers - getting chunks from the store
+	for i := 0; i < n; i++ {
+		g.Go(func() error {
+			for r := range req {
+				// Pull the chunk from the store
+				chunk, err := s.GetChunk(r.chunk.ID)
+				if err != nil {
+					close(r.data)
+					return err
+				}
+				b, err := chunk.Uncompressed()
+				if err != nil {
+					close(r.data)
+					return err
+				}
+				// Might as well verify the chunk size while we're at it
+				if r.chunk.Size != uint64(len(b)) {
+					close(r.data)
+					return fmt.Errorf("unexpected size for chunk %s", r.chunk.ID)
+				}
+				r.data <- b
+				close(r.data)
+			}
+			return nil
+		})
+	}
+
+	// Feeder - requesting chunks from the workers and handing a result data channel
+	// to the assembler
+	g.Go(func() error {
+	loop:
+		for _, c := range index.Chunks {
+			data := make(chan []byte, 1)
+			select {
+			case <-ctx.Done():
+				break loop
+			case req <- requestJob{chunk: c, data: data}: // request the chunk
+			}
+			// and hand over the data channel to the assembler, unless it stopped
+			select {
+			case <-ctx.Done():
+				break loop
+			case assemble <- data:
+			}
+		}
+		close(req)      // tell the workers this is it
+		close(assemble) // tell the assembler we're done
+		return nil
+	})
+
+	// Assember - Read from data channels push the chunks into the pipe that untar reads from
+	g.Go(func() error {
+	loop:
+		for {
+			select {
+			case data := <-assemble:
+				if data == nil {
+					break loop
+				}
+				if pb != nil {
+					pb.Increment()
+				}
+				b := <-data
+				if _, err := io.Copy(w, bytes.NewReader(b)); err != nil {
+					return err
+				}
+			case <-ctx.Done():
+				break loop
+			}
+		}
+		w.Close() // No more chunks to come, stop the untar
+		return nil
+	})
+
+	// Decoder - Read from the pipe that Assembler pushes into
+	g.Go(func() error {
+		err := decode(ctx, r)
+		if err != nil {
+			// If an error has occurred during decoding, we need to stop the Assembler.
+			// If we don't, then it would stall on writing to the pipe.
+			r.CloseWithError(err)
+		}
+		return err
+	})
+
+	return g.Wait()
+}
@@ -0,0 +1,79 @@
+package desync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestWalkArchive(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/nested.catar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Collect the names of all nodes in the archive with the decoder
+	var expected []string
+	d := NewArchiveDecoder(bytes.NewReader(b))
+	for {
+		n, err := d.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == nil {
+			break
+		}
+		expected = append(expected, reflect.ValueOf(n).FieldByName("Name").String())
+	}
+
+	// Chunk the archive into a store
+	store, err := ioutil.TempDir("", "desync-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(store)
+	s, err := NewLocalStore(store, StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewChunker(bytes.NewReader(b), 64, 256, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := ChunkStream(context.Background(), c, s, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Walking the archive, directly or through the index, should produce the
+	// same nodes
+	var names []string
+	walk := func(n interface{}) error {
+		names = append(names, reflect.ValueOf(n).FieldByName("Name").String())
+		return nil
+	}
+	if err := WalkArchive(context.Background(), bytes.NewReader(b), walk); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, names) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+	names = nil
+	if err := WalkArchiveIndex(context.Background(), index, s, 2, nil, walk); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, names) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+
+	// Errors from the walk function stop the walk
+	errStop := errors.New("stop")
+	err = WalkArchiveIndex(context.Background(), index, s, 2, nil, func(n interface{}) error { return errStop })
+	if err != errStop {
+		t.Fatalf("expected %v, got %v", errStop, err)
+	}
+}